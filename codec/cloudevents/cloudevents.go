@@ -0,0 +1,177 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package cloudevents provides an encoder/decoder which wraps the events in
+// CloudEvents v1.0 envelopes, using the structured content mode with the
+// JSON event format:
+//
+//	{
+//	  "specversion": "1.0",
+//	  "id": "<event id>",
+//	  "source": "<source>",
+//	  "type": "<type>",
+//	  "time": "<event timestamp>",
+//	  "datacontenttype": "application/json",
+//	  "data": <the event encoded as JSON>
+//	}
+//
+// See https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/spec.md.
+package cloudevents
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+)
+
+const (
+	// ContentType is the content type of the events encoded as structured
+	// CloudEvents.
+	ContentType = "application/cloudevents+json"
+	// SpecVersion is the version of the CloudEvents specification of the
+	// encoded events.
+	SpecVersion = "1.0"
+	// DefaultSource is the source of the encoded events when none is
+	// configured.
+	DefaultSource = "/apm-queue"
+	// DefaultType is the type of the encoded events when none is configured.
+	DefaultType = "co.elastic.apm.event"
+)
+
+// dataContentType is the content type of the data of the encoded events.
+const dataContentType = "application/json"
+
+// ErrInvalidEnvelope is returned by Decode when the envelope of the event
+// isn't a valid CloudEvents v1.0 envelope.
+var ErrInvalidEnvelope = errors.New("cloudevents: invalid envelope")
+
+// Options holds the options for encoding events as CloudEvents.
+type Options struct {
+	// Source identifies the context in which the events happened, and is
+	// set as the source attribute. If empty, it defaults to DefaultSource.
+	Source string
+	// Type identifies the type of the events, and is set as the type
+	// attribute. If empty, it defaults to DefaultType.
+	Type string
+}
+
+// CloudEvents encodes events as structured CloudEvents, and decodes them. The
+// zero value uses DefaultSource and DefaultType, use New to configure them.
+type CloudEvents struct {
+	source string
+	typ    string
+}
+
+// New returns a CloudEvents codec configured with opts.
+func New(opts Options) CloudEvents {
+	return CloudEvents{source: opts.Source, typ: opts.Type}
+}
+
+// envelope is the CloudEvents envelope of an encoded event.
+type envelope struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// ContentType returns the content type of the encoded events.
+func (c CloudEvents) ContentType() string {
+	return ContentType
+}
+
+// Encode wraps the JSON encoded event in a CloudEvents envelope. The id
+// attribute is set to the ID of the event's transaction, span or error, in
+// that order, or to a random ID if it has none. The time attribute is set to
+// the event Timestamp, and omitted if the event has none.
+func (c CloudEvents) Encode(in model.APMEvent) ([]byte, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("cloudevents: failed encoding event: %w", err)
+	}
+	id, err := eventID(in)
+	if err != nil {
+		return nil, err
+	}
+	env := envelope{
+		SpecVersion:     SpecVersion,
+		ID:              id,
+		Source:          c.source,
+		Type:            c.typ,
+		DataContentType: dataContentType,
+		Data:            data,
+	}
+	if env.Source == "" {
+		env.Source = DefaultSource
+	}
+	if env.Type == "" {
+		env.Type = DefaultType
+	}
+	if !in.Timestamp.IsZero() {
+		env.Time = in.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	return json.Marshal(env)
+}
+
+// Decode decodes the event wrapped in a CloudEvents envelope by Encode. It
+// returns an error wrapping ErrInvalidEnvelope if the specversion isn't 1.0,
+// or any of the required id, source and type attributes is missing. The
+// source and type aren't checked against the configured ones.
+func (c CloudEvents) Decode(in []byte, out *model.APMEvent) error {
+	var env envelope
+	if err := json.Unmarshal(in, &env); err != nil {
+		return fmt.Errorf("cloudevents: failed decoding envelope: %w", err)
+	}
+	switch {
+	case env.SpecVersion != SpecVersion:
+		return fmt.Errorf("%w: unsupported specversion %q", ErrInvalidEnvelope, env.SpecVersion)
+	case env.ID == "", env.Source == "", env.Type == "":
+		return fmt.Errorf("%w: missing required attributes", ErrInvalidEnvelope)
+	case env.DataContentType != "" && env.DataContentType != dataContentType:
+		return fmt.Errorf("%w: unsupported datacontenttype %q", ErrInvalidEnvelope, env.DataContentType)
+	}
+	if err := json.Unmarshal(env.Data, out); err != nil {
+		return fmt.Errorf("cloudevents: failed decoding event: %w", err)
+	}
+	return nil
+}
+
+// eventID returns the ID of the event's transaction, span or error, or a
+// random ID if it has none.
+func eventID(event model.APMEvent) (string, error) {
+	switch {
+	case event.Transaction != nil && event.Transaction.ID != "":
+		return event.Transaction.ID, nil
+	case event.Span != nil && event.Span.ID != "":
+		return event.Span.ID, nil
+	case event.Error != nil && event.Error.ID != "":
+		return event.Error.ID, nil
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("cloudevents: failed generating event id: %w", err)
+	}
+	return hex.EncodeToString(id[:]), nil
+}
@@ -0,0 +1,93 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package cloudevents_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec"
+	"github.com/elastic/apm-queue/codec/cloudevents"
+)
+
+var (
+	_ codec.Decoder      = cloudevents.CloudEvents{}
+	_ codec.ContentTyper = cloudevents.CloudEvents{}
+)
+
+func TestCloudEventsRoundTrip(t *testing.T) {
+	c := cloudevents.New(cloudevents.Options{
+		Source: "/apm-server/production",
+		Type:   "co.elastic.apm.transaction",
+	})
+	event := model.APMEvent{
+		Timestamp:   time.Date(2023, 3, 1, 12, 30, 0, 123456789, time.FixedZone("CET", 3600)),
+		Transaction: &model.Transaction{ID: "abc123"},
+		Service:     model.Service{Name: "api"},
+	}
+	encoded, err := c.Encode(event)
+	require.NoError(t, err)
+
+	var attrs map[string]any
+	require.NoError(t, json.Unmarshal(encoded, &attrs))
+	assert.Equal(t, "1.0", attrs["specversion"])
+	assert.Equal(t, "abc123", attrs["id"])
+	assert.Equal(t, "/apm-server/production", attrs["source"])
+	assert.Equal(t, "co.elastic.apm.transaction", attrs["type"])
+	assert.Equal(t, "2023-03-01T11:30:00.123456789Z", attrs["time"])
+	assert.Equal(t, "application/json", attrs["datacontenttype"])
+	assert.IsType(t, map[string]any{}, attrs["data"])
+
+	var decoded model.APMEvent
+	require.NoError(t, c.Decode(encoded, &decoded))
+	assert.True(t, event.Timestamp.Equal(decoded.Timestamp))
+	decoded.Timestamp = event.Timestamp
+	assert.Equal(t, event, decoded)
+}
+
+func TestCloudEventsDefaults(t *testing.T) {
+	encoded, err := cloudevents.CloudEvents{}.Encode(model.APMEvent{})
+	require.NoError(t, err)
+	var attrs map[string]any
+	require.NoError(t, json.Unmarshal(encoded, &attrs))
+	assert.Equal(t, cloudevents.DefaultSource, attrs["source"])
+	assert.Equal(t, cloudevents.DefaultType, attrs["type"])
+	// Events without an ID get a random one, and without a timestamp have
+	// no time.
+	assert.Len(t, attrs["id"], 32)
+	assert.NotContains(t, attrs, "time")
+}
+
+func TestCloudEventsDecodeInvalid(t *testing.T) {
+	for name, in := range map[string]string{
+		"specversion": `{"specversion":"0.3","id":"1","source":"s","type":"t","data":{}}`,
+		"id":          `{"specversion":"1.0","source":"s","type":"t","data":{}}`,
+		"source":      `{"specversion":"1.0","id":"1","type":"t","data":{}}`,
+		"type":        `{"specversion":"1.0","id":"1","source":"s","data":{}}`,
+		"content":     `{"specversion":"1.0","id":"1","source":"s","type":"t","datacontenttype":"text/xml","data":{}}`,
+	} {
+		var event model.APMEvent
+		err := cloudevents.CloudEvents{}.Decode([]byte(in), &event)
+		assert.ErrorIs(t, err, cloudevents.ErrInvalidEnvelope, name)
+	}
+}
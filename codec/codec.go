@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package codec provides the interfaces and utilities shared by the event
+// codecs.
+package codec
+
+import (
+	"sync"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// Decoder decodes a []byte into a model.APMEvent
+type Decoder interface {
+	// Decode decodes an encoded model.APM Event into its struct form.
+	Decode([]byte, *model.APMEvent) error
+}
+
+// BatchEncoder encodes multiple events into a single []byte, for example, to
+// pack them in a single record.
+type BatchEncoder interface {
+	// EncodeBatch encodes all the events in the batch.
+	EncodeBatch(model.Batch) ([]byte, error)
+}
+
+// BatchDecoder decodes a []byte encoded by a BatchEncoder into a model.Batch.
+type BatchDecoder interface {
+	// DecodeBatch decodes the encoded events, replacing the contents of the
+	// batch.
+	DecodeBatch([]byte, *model.Batch) error
+}
+
+// ContentTyper is implemented by codecs which encode events in a well known
+// content type.
+type ContentTyper interface {
+	// ContentType returns the content type of the encoded events, for example
+	// "application/json".
+	ContentType() string
+}
+
+// ContentEncoder is implemented by codecs which transform the events encoded
+// by another codec, for example, compressing them, without changing their
+// content type.
+type ContentEncoder interface {
+	// ContentEncoding returns the encoding applied to the encoded events, for
+	// example "zstd".
+	ContentEncoding() string
+}
+
+// Registry maps content types to the Decoders for them. It can be used to
+// decode a stream of events encoded with different codecs, based on the
+// content type of each of them. The zero value is ready to use, and it is
+// safe for concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	decoders map[string]Decoder
+}
+
+// Register registers the Decoder for contentType, replacing any Decoder which
+// was previously registered for it.
+func (r *Registry) Register(contentType string, d Decoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.decoders == nil {
+		r.decoders = make(map[string]Decoder)
+	}
+	r.decoders[contentType] = d
+}
+
+// DecoderFor returns the Decoder registered for contentType and a bool
+// indicating whether it was found.
+func (r *Registry) DecoderFor(contentType string) (Decoder, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.decoders[contentType]
+	return d, ok
+}
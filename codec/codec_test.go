@@ -0,0 +1,64 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec"
+	"github.com/elastic/apm-queue/codec/compress"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestRegistry(t *testing.T) {
+	var registry codec.Registry
+	_, ok := registry.DecoderFor(json.ContentType)
+	assert.False(t, ok)
+
+	gzip := compress.Gzip{Codec: json.JSON{}}
+	registry.Register(json.JSON{}.ContentType(), json.JSON{})
+	registry.Register(gzip.ContentType(), gzip)
+
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	jsonEncoded, err := json.JSON{}.Encode(event)
+	require.NoError(t, err)
+	gzipEncoded, err := gzip.Encode(event)
+	require.NoError(t, err)
+
+	// Decode a mixed stream, selecting the decoder by content type.
+	for _, in := range []struct {
+		contentType string
+		value       []byte
+	}{
+		{contentType: json.ContentType, value: jsonEncoded},
+		{contentType: compress.GzipContentType, value: gzipEncoded},
+	} {
+		decoder, ok := registry.DecoderFor(in.contentType)
+		require.True(t, ok, in.contentType)
+		var decoded model.APMEvent
+		require.NoError(t, decoder.Decode(in.value, &decoded))
+		assert.Equal(t, event, decoded)
+	}
+
+	_, ok = registry.DecoderFor("application/x-protobuf")
+	assert.False(t, ok)
+}
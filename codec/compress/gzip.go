@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package compress provides codecs which compress the output of other codecs.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// Codec encodes and decodes model.APMEvent.
+type Codec interface {
+	// Encode accepts a model.APMEvent and returns the encoded representation.
+	Encode(model.APMEvent) ([]byte, error)
+	// Decode decodes an encoded model.APM Event into its struct form.
+	Decode([]byte, *model.APMEvent) error
+}
+
+// DefaultMaxDecodedSize is the default maximum size of a decompressed event.
+// Events which decompress to more are rejected, protecting the consumers from
+// decompression bombs: small payloads which expand to gigabytes.
+const DefaultMaxDecodedSize = 64 << 20
+
+// errDecodedSizeExceeded is returned when an event decompresses to more than
+// the maximum decoded size.
+var errDecodedSizeExceeded = errors.New("compress: decompressed event exceeds the maximum size")
+
+// gzipMagic is the header every gzip stream starts with (RFC 1952).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Gzip wraps a Codec, compressing the encoded events with gzip. This is
+// independent of the batch compression applied by Kafka, and is useful for
+// consumers which expect the record values to be gzip payloads.
+type Gzip struct {
+	// Codec is the wrapped codec used to encode and decode the events.
+	Codec Codec
+	// Level is the gzip compression level. If zero, gzip.DefaultCompression
+	// is used.
+	Level int
+	// MaxDecodedSize is the maximum size, in bytes, of a decompressed event.
+	// Decode fails for the events which decompress to more. If zero,
+	// DefaultMaxDecodedSize is used.
+	MaxDecodedSize int64
+}
+
+// GzipContentType is the content type of the gzip compressed events.
+const GzipContentType = "application/gzip"
+
+// ContentType returns the content type of the encoded events.
+func (g Gzip) ContentType() string {
+	return GzipContentType
+}
+
+// Encode encodes the event with the wrapped codec and compresses the result.
+func (g Gzip) Encode(in model.APMEvent) ([]byte, error) {
+	encoded, err := g.Codec.Encode(in)
+	if err != nil {
+		return nil, err
+	}
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, fmt.Errorf("compress: invalid gzip level: %w", err)
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return nil, fmt.Errorf("compress: failed compressing event: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compress: failed compressing event: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decompresses the input and decodes it with the wrapped codec. Input
+// which isn't gzip compressed, as detected by the gzip magic header, is passed
+// to the wrapped codec as is, allowing uncompressed and compressed payloads to
+// be mixed. Events which decompress to more than MaxDecodedSize are rejected.
+func (g Gzip) Decode(in []byte, out *model.APMEvent) error {
+	if !bytes.HasPrefix(in, gzipMagic) {
+		return g.Codec.Decode(in, out)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("compress: invalid gzip payload: %w", err)
+	}
+	defer r.Close()
+	limit := g.MaxDecodedSize
+	if limit <= 0 {
+		limit = DefaultMaxDecodedSize
+	}
+	// Read one byte past the limit to tell events of exactly the maximum
+	// size from the ones exceeding it.
+	decompressed, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return fmt.Errorf("compress: failed decompressing event: %w", err)
+	}
+	if int64(len(decompressed)) > limit {
+		return fmt.Errorf("%w of %d bytes", errDecodedSizeExceeded, limit)
+	}
+	return g.Codec.Decode(decompressed, out)
+}
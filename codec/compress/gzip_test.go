@@ -0,0 +1,95 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestGzipRoundTrip(t *testing.T) {
+	codec := Gzip{Codec: json.JSON{}}
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+
+	encoded, err := codec.Encode(event)
+	require.NoError(t, err)
+	assert.Equal(t, gzipMagic, encoded[:2])
+
+	var decoded model.APMEvent
+	require.NoError(t, codec.Decode(encoded, &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+func TestGzipDecodeUncompressed(t *testing.T) {
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	encoded, err := json.JSON{}.Encode(event)
+	require.NoError(t, err)
+
+	var decoded model.APMEvent
+	require.NoError(t, Gzip{Codec: json.JSON{}}.Decode(encoded, &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+func TestGzipDecodeCorrupted(t *testing.T) {
+	codec := Gzip{Codec: json.JSON{}}
+	encoded, err := codec.Encode(model.APMEvent{})
+	require.NoError(t, err)
+
+	// Truncate the payload, keeping the gzip header.
+	var decoded model.APMEvent
+	err = codec.Decode(encoded[:len(encoded)/2], &decoded)
+	assert.ErrorContains(t, err, "compress: failed decompressing event")
+
+	err = codec.Decode(append([]byte{}, gzipMagic...), &decoded)
+	assert.ErrorContains(t, err, "compress: invalid gzip payload")
+}
+
+func TestGzipInvalidLevel(t *testing.T) {
+	_, err := Gzip{Codec: json.JSON{}, Level: 42}.Encode(model.APMEvent{})
+	assert.ErrorContains(t, err, "compress: invalid gzip level")
+}
+
+func TestGzipDecodeMaxDecodedSize(t *testing.T) {
+	// A payload of a few kilobytes which decompresses to a megabyte.
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	var decoded model.APMEvent
+	err = Gzip{Codec: json.JSON{}, MaxDecodedSize: 1 << 10}.Decode(buf.Bytes(), &decoded)
+	assert.EqualError(t, err, "compress: decompressed event exceeds the maximum size of 1024 bytes")
+
+	// Events of up to the maximum size are decoded.
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	raw, err := json.JSON{}.Encode(event)
+	require.NoError(t, err)
+	codec := Gzip{Codec: json.JSON{}, MaxDecodedSize: int64(len(raw))}
+	encoded, err := codec.Encode(event)
+	require.NoError(t, err)
+	require.NoError(t, codec.Decode(encoded, &decoded))
+	assert.Equal(t, event, decoded)
+}
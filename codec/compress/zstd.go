@@ -0,0 +1,154 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/apm-data/model"
+
+	"github.com/elastic/apm-queue/codec"
+)
+
+// ZstdContentEncoding is the content encoding of the zstd compressed events.
+const ZstdContentEncoding = "zstd"
+
+var (
+	// zstdMagic is the header every zstd frame starts with (RFC 8878).
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// zstdDictMagic is the header of the dictionaries in the zstd dictionary
+	// format, such as the ones trained with "zstd --train".
+	zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+)
+
+// Zstd wraps a Codec, compressing the encoded events with zstd, optionally
+// with a dictionary. Dictionaries improve the compression ratio of small
+// payloads, which share little within themselves but much with each other,
+// such as metrics. The events must be decoded with a Zstd using the same
+// dictionary. Create it with NewZstd. It's safe for concurrent use.
+//
+// Unlike Gzip, Zstd keeps the content type of the wrapped codec, and reports
+// the compression as the content encoding, see codec.ContentEncoder.
+type Zstd struct {
+	codec   Codec
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+
+	maxDecodedSize int64
+}
+
+// NewZstd returns a Zstd wrapping codec. If dict isn't empty, it's used as
+// the compression dictionary: either a dictionary in the zstd dictionary
+// format, for example, trained with "zstd --train" on sample payloads, or
+// raw content, such as a few typical payloads, which is used as the initial
+// history of the compressor. Decoding rejects the events which decompress to
+// more than DefaultMaxDecodedSize.
+func NewZstd(codec Codec, dict []byte) (*Zstd, error) {
+	return NewZstdWithMaxDecodedSize(codec, dict, DefaultMaxDecodedSize)
+}
+
+// NewZstdWithMaxDecodedSize is like NewZstd, but rejects the events which
+// decompress to more than maxDecodedSize bytes. If maxDecodedSize is zero,
+// DefaultMaxDecodedSize is used.
+func NewZstdWithMaxDecodedSize(codec Codec, dict []byte, maxDecodedSize int64) (*Zstd, error) {
+	if maxDecodedSize < 0 {
+		return nil, errors.New("compress: max decoded size cannot be negative")
+	}
+	if maxDecodedSize == 0 {
+		maxDecodedSize = DefaultMaxDecodedSize
+	}
+	var eopts []zstd.EOption
+	var dopts []zstd.DOption
+	switch {
+	case len(dict) == 0:
+	case bytes.HasPrefix(dict, zstdDictMagic):
+		eopts = append(eopts, zstd.WithEncoderDict(dict))
+		dopts = append(dopts, zstd.WithDecoderDicts(dict))
+	default:
+		// The ID of raw dictionaries is derived from their content, so the
+		// events compressed with a different dictionary fail to decode.
+		id := crc32.ChecksumIEEE(dict) | 1
+		eopts = append(eopts, zstd.WithEncoderDictRaw(id, dict))
+		dopts = append(dopts, zstd.WithDecoderDictRaw(id, dict))
+	}
+	encoder, err := zstd.NewWriter(nil, append(eopts, zstd.WithEncoderConcurrency(1))...)
+	if err != nil {
+		return nil, fmt.Errorf("compress: invalid zstd dictionary: %w", err)
+	}
+	dopts = append(dopts,
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(uint64(maxDecodedSize)),
+	)
+	decoder, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		return nil, fmt.Errorf("compress: invalid zstd dictionary: %w", err)
+	}
+	return &Zstd{
+		codec:          codec,
+		encoder:        encoder,
+		decoder:        decoder,
+		maxDecodedSize: maxDecodedSize,
+	}, nil
+}
+
+// ContentType returns the content type of the wrapped codec, or an empty
+// string if it doesn't implement codec.ContentTyper.
+func (z *Zstd) ContentType() string {
+	if ct, ok := z.codec.(codec.ContentTyper); ok {
+		return ct.ContentType()
+	}
+	return ""
+}
+
+// ContentEncoding returns ZstdContentEncoding.
+func (z *Zstd) ContentEncoding() string {
+	return ZstdContentEncoding
+}
+
+// Encode encodes the event with the wrapped codec and compresses the result.
+func (z *Zstd) Encode(in model.APMEvent) ([]byte, error) {
+	encoded, err := z.codec.Encode(in)
+	if err != nil {
+		return nil, err
+	}
+	return z.encoder.EncodeAll(encoded, nil), nil
+}
+
+// Decode decompresses the input and decodes it with the wrapped codec. Input
+// which isn't zstd compressed, as detected by the zstd magic number, is passed
+// to the wrapped codec as is, allowing uncompressed and compressed payloads to
+// be mixed. Events which decompress to more than the maximum decoded size are
+// rejected.
+func (z *Zstd) Decode(in []byte, out *model.APMEvent) error {
+	if !bytes.HasPrefix(in, zstdMagic) {
+		return z.codec.Decode(in, out)
+	}
+	decompressed, err := z.decoder.DecodeAll(in, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return fmt.Errorf("%w of %d bytes", errDecodedSizeExceeded, z.maxDecodedSize)
+	}
+	if err != nil {
+		return fmt.Errorf("compress: failed decompressing event: %w", err)
+	}
+	return z.codec.Decode(decompressed, out)
+}
@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package compress
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func metricEvent(i int) model.APMEvent {
+	return model.APMEvent{
+		Service: model.Service{Name: "service", Environment: "production"},
+		Metricset: &model.Metricset{
+			Name:     "app",
+			Interval: "1m",
+			Samples: []model.MetricsetSample{
+				{Name: "system.cpu.total.norm.pct", Value: float64(i) / 100},
+			},
+		},
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	for _, dict := range [][]byte{nil, []byte(`{"Service":{"Name":"service"}}`)} {
+		codec, err := NewZstd(json.JSON{}, dict)
+		require.NoError(t, err)
+		// The content type is the one of the wrapped codec.
+		assert.Equal(t, json.ContentType, codec.ContentType())
+		assert.Equal(t, ZstdContentEncoding, codec.ContentEncoding())
+
+		event := metricEvent(1)
+		encoded, err := codec.Encode(event)
+		require.NoError(t, err)
+		assert.Equal(t, zstdMagic, encoded[:4])
+
+		var decoded model.APMEvent
+		require.NoError(t, codec.Decode(encoded, &decoded))
+		assert.Equal(t, event, decoded)
+	}
+}
+
+func TestZstdDictionarySize(t *testing.T) {
+	// A few typical payloads make a good raw dictionary.
+	var dict []byte
+	for i := 0; i < 3; i++ {
+		encoded, err := json.JSON{}.Encode(metricEvent(i))
+		require.NoError(t, err)
+		dict = append(dict, encoded...)
+	}
+	withDict, err := NewZstd(json.JSON{}, dict)
+	require.NoError(t, err)
+	withoutDict, err := NewZstd(json.JSON{}, nil)
+	require.NoError(t, err)
+
+	var sizeWithDict, sizeWithoutDict int
+	for i := 10; i < 20; i++ {
+		encoded, err := withDict.Encode(metricEvent(i))
+		require.NoError(t, err)
+		sizeWithDict += len(encoded)
+		encoded, err = withoutDict.Encode(metricEvent(i))
+		require.NoError(t, err)
+		sizeWithoutDict += len(encoded)
+	}
+	// The exact sizes depend on the zstd implementation, but the dictionary
+	// should at least halve them for such small payloads.
+	assert.Less(t, sizeWithDict*2, sizeWithoutDict,
+		fmt.Sprintf("with dictionary: %d, without: %d", sizeWithDict, sizeWithoutDict),
+	)
+}
+
+func TestZstdDecode(t *testing.T) {
+	codec, err := NewZstd(json.JSON{}, []byte("dictionary"))
+	require.NoError(t, err)
+	event := metricEvent(1)
+
+	// Uncompressed payloads are passed through.
+	encoded, err := json.JSON{}.Encode(event)
+	require.NoError(t, err)
+	var decoded model.APMEvent
+	require.NoError(t, codec.Decode(encoded, &decoded))
+	assert.Equal(t, event, decoded)
+
+	// Payloads compressed with a different dictionary fail to decode.
+	other, err := NewZstd(json.JSON{}, []byte("other dictionary"))
+	require.NoError(t, err)
+	encoded, err = other.Encode(event)
+	require.NoError(t, err)
+	err = codec.Decode(encoded, &decoded)
+	assert.ErrorContains(t, err, "compress: failed decompressing event")
+
+	// Dictionaries in the zstd format are validated.
+	_, err = NewZstd(json.JSON{}, append(append([]byte{}, zstdDictMagic...), 1, 2, 3))
+	assert.ErrorContains(t, err, "compress: invalid zstd dictionary")
+}
+
+func TestZstdDecodeMaxDecodedSize(t *testing.T) {
+	// A payload of a few bytes which decompresses to a megabyte.
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	bomb := encoder.EncodeAll(make([]byte, 1<<20), nil)
+
+	codec, err := NewZstdWithMaxDecodedSize(json.JSON{}, nil, 1<<10)
+	require.NoError(t, err)
+	var decoded model.APMEvent
+	err = codec.Decode(bomb, &decoded)
+	assert.EqualError(t, err, "compress: decompressed event exceeds the maximum size of 1024 bytes")
+
+	// Events of up to the maximum size are decoded.
+	event := metricEvent(1)
+	raw, err := json.JSON{}.Encode(event)
+	require.NoError(t, err)
+	codec, err = NewZstdWithMaxDecodedSize(json.JSON{}, nil, int64(len(raw)))
+	require.NoError(t, err)
+	encoded, err := codec.Encode(event)
+	require.NoError(t, err)
+	require.NoError(t, codec.Decode(encoded, &decoded))
+	assert.Equal(t, event, decoded)
+
+	_, err = NewZstdWithMaxDecodedSize(json.JSON{}, nil, -1)
+	assert.EqualError(t, err, "compress: max decoded size cannot be negative")
+}
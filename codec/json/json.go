@@ -20,15 +20,43 @@ package json
 
 import (
 	"encoding/json"
+	"reflect"
 
 	"github.com/elastic/apm-data/model"
 )
 
-// JSON wraps the standard json library.
-type JSON struct{}
+// ContentType is the content type of the JSON encoded events.
+const ContentType = "application/json"
+
+// Options holds the options for encoding events as JSON.
+type Options struct {
+	// OmitEmpty omits the zero valued fields from the encoded events, which
+	// significantly reduces their size. The encoded events are decoded to
+	// the same model.APMEvent as when the fields aren't omitted.
+	OmitEmpty bool
+}
+
+// JSON wraps the standard json library. The zero value encodes all the
+// event fields, use New to configure the encoding.
+type JSON struct {
+	omitEmpty bool
+}
+
+// New returns a JSON codec configured with opts.
+func New(opts Options) JSON {
+	return JSON{omitEmpty: opts.OmitEmpty}
+}
+
+// ContentType returns the content type of the encoded events.
+func (e JSON) ContentType() string {
+	return ContentType
+}
 
 // Encode accepts a model.APMEvent and returns the encoded JSON representation.
 func (e JSON) Encode(in model.APMEvent) ([]byte, error) {
+	if e.omitEmpty {
+		return json.Marshal(omitEmpty(reflect.ValueOf(in)))
+	}
 	return json.Marshal(in)
 }
 
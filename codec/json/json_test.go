@@ -0,0 +1,62 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package json_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestJSONOmitEmpty(t *testing.T) {
+	event := model.APMEvent{
+		Timestamp: time.Unix(1678000000, 0).UTC(),
+		Service:   model.Service{Name: "svc", Version: "1.0"},
+		Labels:    model.Labels{"a": {Value: "b"}, "c": {Values: []string{"d", ""}}},
+		Transaction: &model.Transaction{
+			ID:      "tx-1",
+			Sampled: true,
+		},
+		Metricset: &model.Metricset{
+			Samples: []model.MetricsetSample{
+				{Name: "a", Value: 1},
+				{}, // Zero valued elements are kept.
+				{Name: "b", Histogram: model.Histogram{Values: []float64{1, 2}, Counts: []int64{3, 4}}},
+			},
+		},
+		// Non-nil pointers to zero values aren't omitted.
+		Span: &model.Span{},
+	}
+
+	full, err := json.JSON{}.Encode(event)
+	require.NoError(t, err)
+	compact, err := json.New(json.Options{OmitEmpty: true}).Encode(event)
+	require.NoError(t, err)
+	assert.Less(t, len(compact), len(full)/4)
+
+	var fromFull, fromCompact model.APMEvent
+	require.NoError(t, json.JSON{}.Decode(full, &fromFull))
+	require.NoError(t, json.JSON{}.Decode(compact, &fromCompact))
+	assert.Equal(t, fromFull, fromCompact)
+	assert.Equal(t, event, fromCompact)
+}
@@ -0,0 +1,106 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package json
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+var (
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// omitEmpty returns a representation of v which encodes to the same JSON as
+// v, except that the zero valued struct fields are omitted. Since the omitted
+// fields are decoded as their zero value, the result decodes to v.
+func omitEmpty(v reflect.Value) any {
+	if !v.IsValid() {
+		return nil
+	}
+	// Types with custom encodings are encoded as they are, and so are
+	// interfaces, since their concrete types aren't known when decoding.
+	if v.Type().Implements(marshalerType) || v.Type().Implements(textMarshalerType) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return omitEmpty(v.Elem())
+	case reflect.Struct:
+		fields := make(map[string]any)
+		omitEmptyFields(v, fields)
+		return fields
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface() // Encoded as base64.
+		}
+		elems := make([]any, v.Len())
+		for i := range elems {
+			elems[i] = omitEmpty(v.Index(i))
+		}
+		return elems
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		entries := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries[iter.Key().String()] = omitEmpty(iter.Value())
+		}
+		return entries
+	}
+	return v.Interface()
+}
+
+// omitEmptyFields adds the non-zero exported fields of the struct v to fields,
+// following the encoding/json naming rules.
+func omitEmptyFields(v reflect.Value, fields map[string]any) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			// Fields of embedded structs are promoted.
+			omitEmptyFields(v.Field(i), fields)
+			continue
+		}
+		if !f.IsExported() || v.Field(i).IsZero() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = omitEmpty(v.Field(i))
+	}
+}
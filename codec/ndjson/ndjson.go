@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package ndjson provides a newline delimited JSON (NDJSON) batch
+// encoder/decoder, which encodes multiple events as a single []byte, with one
+// JSON object per line.
+//
+// Since all the events in a batch are encoded in a single []byte, the encoded
+// size grows with the batch size. When producing the encoded batches as single
+// Kafka records, the batches must be kept small enough for the records not to
+// exceed the broker's message.max.bytes (1MB by default), or they'll be
+// rejected.
+package ndjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// ContentType is the content type of the NDJSON encoded batches.
+const ContentType = "application/x-ndjson"
+
+// NDJSON encodes and decodes batches as newline delimited JSON, using the
+// same JSON representation of the events as the json codec.
+type NDJSON struct{}
+
+// ContentType returns the content type of the encoded batches.
+func (NDJSON) ContentType() string {
+	return ContentType
+}
+
+// EncodeBatch encodes each of the events in the batch as a JSON object,
+// followed by a newline. Newlines in the event fields are escaped by the JSON
+// encoding, so they never break the lines. An empty batch is encoded as an
+// empty []byte.
+func (NDJSON) EncodeBatch(batch model.Batch) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, event := range batch {
+		if err := enc.Encode(event); err != nil {
+			return nil, fmt.Errorf("ndjson: failed encoding event %d: %w", i, err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBatch decodes the events encoded by EncodeBatch, replacing the
+// contents of out.
+func (NDJSON) DecodeBatch(in []byte, out *model.Batch) error {
+	*out = (*out)[:0]
+	dec := json.NewDecoder(bytes.NewReader(in))
+	for dec.More() {
+		var event model.APMEvent
+		if err := dec.Decode(&event); err != nil {
+			return fmt.Errorf("ndjson: failed decoding event %d: %w", len(*out), err)
+		}
+		*out = append(*out, event)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package ndjson_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec"
+	"github.com/elastic/apm-queue/codec/ndjson"
+)
+
+var (
+	_ codec.BatchEncoder = ndjson.NDJSON{}
+	_ codec.BatchDecoder = ndjson.NDJSON{}
+)
+
+func TestNDJSONRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 10, 100} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			batch := make(model.Batch, size)
+			for i := range batch {
+				batch[i] = model.APMEvent{
+					Transaction: &model.Transaction{ID: fmt.Sprint(i)},
+					// Newlines are escaped, and don't break the lines.
+					Message: "line 1\nline 2\r\n",
+				}
+			}
+			encoded, err := ndjson.NDJSON{}.EncodeBatch(batch)
+			require.NoError(t, err)
+			assert.Equal(t, size, bytes.Count(encoded, []byte("\n")))
+
+			// The decoded events replace the existing ones.
+			decoded := model.Batch{{Message: "stale"}}
+			require.NoError(t, ndjson.NDJSON{}.DecodeBatch(encoded, &decoded))
+			assert.Len(t, decoded, size)
+			if size > 0 {
+				assert.Equal(t, batch, decoded)
+			}
+		})
+	}
+}
+
+func TestNDJSONDecodeInvalid(t *testing.T) {
+	var batch model.Batch
+	err := ndjson.NDJSON{}.DecodeBatch([]byte("{}\n{\n"), &batch)
+	assert.ErrorContains(t, err, "ndjson: failed decoding event 1")
+}
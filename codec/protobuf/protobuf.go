@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package protobuf provides a length-prefixed batch encoder/decoder, which
+// frames multiple protobuf encoded events in a single []byte.
+//
+// Protobuf messages aren't self-delimiting, so the events of a batch are
+// framed using the same format as protobuf's delimited messages (for example,
+// Java's writeDelimitedTo): each event is encoded as its length in bytes, as
+// an unsigned varint, followed by the encoded event.
+//
+//	batch = *( varint(len(event)) event )
+//
+// An empty batch is encoded as an empty []byte. The events themselves are
+// encoded and decoded by the codec the Delimited codec is created with, which
+// is expected to produce the protobuf representation of the events.
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec"
+)
+
+// ContentType is the content type of the length-prefixed batches.
+const ContentType = "application/x-protobuf-delimited"
+
+// ErrTruncated is returned by DecodeBatch when the encoded batch ends in the
+// middle of a length prefix or an event, for example, due to trailing bytes
+// which aren't part of the batch.
+var ErrTruncated = errors.New("protobuf: truncated batch")
+
+// Codec encodes and decodes single events.
+type Codec interface {
+	codec.Decoder
+	// Encode encodes an event into its protobuf representation.
+	Encode(model.APMEvent) ([]byte, error)
+}
+
+// Delimited encodes and decodes batches as length-prefixed events, using
+// the wrapped Codec to encode and decode the individual events.
+type Delimited struct {
+	codec Codec
+}
+
+// New returns a Delimited codec, which encodes the events with c.
+func New(c Codec) Delimited {
+	return Delimited{codec: c}
+}
+
+// ContentType returns the content type of the encoded batches.
+func (Delimited) ContentType() string {
+	return ContentType
+}
+
+// EncodeBatch encodes each of the events in the batch, prefixed by its
+// length as an unsigned varint.
+func (d Delimited) EncodeBatch(batch model.Batch) ([]byte, error) {
+	var out []byte
+	for i, event := range batch {
+		encoded, err := d.codec.Encode(event)
+		if err != nil {
+			return nil, fmt.Errorf("protobuf: failed encoding event %d: %w", i, err)
+		}
+		out = binary.AppendUvarint(out, uint64(len(encoded)))
+		out = append(out, encoded...)
+	}
+	return out, nil
+}
+
+// DecodeBatch decodes the events encoded by EncodeBatch, replacing the
+// contents of out. ErrTruncated is returned if in doesn't end exactly after
+// an event.
+func (d Delimited) DecodeBatch(in []byte, out *model.Batch) error {
+	*out = (*out)[:0]
+	for len(in) > 0 {
+		size, n := binary.Uvarint(in)
+		if n <= 0 {
+			if n == 0 {
+				return fmt.Errorf("%w: incomplete length of event %d", ErrTruncated, len(*out))
+			}
+			return fmt.Errorf("protobuf: invalid length of event %d", len(*out))
+		}
+		in = in[n:]
+		if size > uint64(len(in)) {
+			return fmt.Errorf("%w: event %d is %d bytes long, %d bytes left",
+				ErrTruncated, len(*out), size, len(in),
+			)
+		}
+		var event model.APMEvent
+		if err := d.codec.Decode(in[:size], &event); err != nil {
+			return fmt.Errorf("protobuf: failed decoding event %d: %w", len(*out), err)
+		}
+		*out = append(*out, event)
+		in = in[size:]
+	}
+	return nil
+}
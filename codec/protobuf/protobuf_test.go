@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package protobuf_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/codec/protobuf"
+)
+
+var (
+	_ codec.BatchEncoder = protobuf.Delimited{}
+	_ codec.BatchDecoder = protobuf.Delimited{}
+)
+
+// The framing doesn't depend on the encoding of the events, so they're
+// encoded as JSON in the tests.
+var delimited = protobuf.New(json.JSON{})
+
+func TestDelimitedRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 10, 1000} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			batch := make(model.Batch, size)
+			for i := range batch {
+				batch[i] = model.APMEvent{
+					Transaction: &model.Transaction{ID: fmt.Sprint(i)},
+				}
+			}
+			encoded, err := delimited.EncodeBatch(batch)
+			require.NoError(t, err)
+			if size == 0 {
+				assert.Empty(t, encoded)
+			}
+
+			// The decoded events replace the existing ones.
+			decoded := model.Batch{{Message: "stale"}}
+			require.NoError(t, delimited.DecodeBatch(encoded, &decoded))
+			assert.Len(t, decoded, size)
+			if size > 0 {
+				assert.Equal(t, batch, decoded)
+			}
+		})
+	}
+}
+
+func TestDelimitedFraming(t *testing.T) {
+	encoded, err := delimited.EncodeBatch(model.Batch{{}, {}})
+	require.NoError(t, err)
+	event, err := json.JSON{}.Encode(model.APMEvent{})
+	require.NoError(t, err)
+
+	var expected []byte
+	for i := 0; i < 2; i++ {
+		expected = binary.AppendUvarint(expected, uint64(len(event)))
+		expected = append(expected, event...)
+	}
+	assert.Equal(t, expected, encoded)
+}
+
+func TestDelimitedDecodeTrailingGarbage(t *testing.T) {
+	encoded, err := delimited.EncodeBatch(model.Batch{{Message: "a"}, {Message: "b"}})
+	require.NoError(t, err)
+
+	withSuffix := func(suffix ...byte) []byte {
+		return append(append([]byte{}, encoded...), suffix...)
+	}
+	var batch model.Batch
+	for name, in := range map[string][]byte{
+		"incomplete_length": withSuffix(0x80),
+		"incomplete_event":  withSuffix(0x10, '{'),
+		"truncated":         encoded[:len(encoded)-1],
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := delimited.DecodeBatch(in, &batch)
+			assert.ErrorIs(t, err, protobuf.ErrTruncated)
+		})
+	}
+
+	t.Run("invalid_length", func(t *testing.T) {
+		in := withSuffix(0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)
+		err := delimited.DecodeBatch(in, &batch)
+		assert.EqualError(t, err, "protobuf: invalid length of event 2")
+	})
+	t.Run("invalid_event", func(t *testing.T) {
+		in := withSuffix(0x01, '{')
+		err := delimited.DecodeBatch(in, &batch)
+		assert.ErrorContains(t, err, "protobuf: failed decoding event 2")
+		assert.False(t, errors.Is(err, protobuf.ErrTruncated))
+	})
+}
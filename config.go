@@ -0,0 +1,39 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"crypto/tls"
+
+	"github.com/twmb/franz-go/pkg/sasl"
+)
+
+// Config holds the connection settings shared by the producers and consumers
+// of an application, so they can be configured once, for example, from a
+// single configuration file. Use kafka.NewProducerFromConfig to create a
+// producer with them.
+type Config struct {
+	// Brokers is the list of Kafka brokers used to seed the client.
+	Brokers []string
+	// SASL configures the client to use SASL authorization.
+	SASL sasl.Mechanism
+	// TLS configures the client to use TLS.
+	TLS *tls.Config
+	// ClientID to use when connecting to Kafka.
+	ClientID string
+}
@@ -0,0 +1,193 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+)
+
+const (
+	// BreakerClosed is the state of a BreakerProcessor which processes the
+	// batches.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen is the state of a BreakerProcessor which fails the batches
+	// with ErrCircuitOpen, without processing them.
+	BreakerOpen
+	// BreakerHalfOpen is the state of a BreakerProcessor whose cooldown has
+	// elapsed, which processes a single probe batch to decide whether to
+	// close or open again.
+	BreakerHalfOpen
+)
+
+// ErrCircuitOpen is returned by BreakerProcessor.ProcessBatch when the
+// circuit is open, and the batch isn't processed.
+var ErrCircuitOpen = errors.New("kafka: circuit breaker is open")
+
+// BreakerState is the state of a BreakerProcessor.
+type BreakerState uint8
+
+// String returns the name of the state.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", s)
+}
+
+// BreakerConfig holds the configuration of a BreakerProcessor.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed batches which
+	// open the circuit. If <= 0, it defaults to 5.
+	FailureThreshold int
+	// Cooldown is how long the circuit stays open before a probe batch is
+	// processed. If <= 0, it defaults to 30s.
+	Cooldown time.Duration
+}
+
+// BreakerProcessor is a model.BatchProcessor which stops calling its
+// processor while it's failing, for example, when the Kafka cluster is
+// unavailable, failing fast rather than piling up batches which are bound to
+// fail.
+//
+// After FailureThreshold consecutive failed batches, the circuit opens and
+// the batches fail with ErrCircuitOpen. Once the Cooldown has elapsed, the
+// circuit half-opens, and the next batch is processed as a probe while the
+// rest keep failing with ErrCircuitOpen: if the probe succeeds the circuit
+// closes, otherwise it opens for another Cooldown.
+//
+// Batches which fail after their context is done don't count as failures,
+// since the failure is likely caused by the caller.
+type BreakerProcessor struct {
+	processor model.BatchProcessor
+	cfg       BreakerConfig
+	clock     func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreakerProcessor returns a new BreakerProcessor which wraps processor,
+// configured with cfg.
+func NewBreakerProcessor(processor model.BatchProcessor, cfg BreakerConfig) (*BreakerProcessor, error) {
+	if processor == nil {
+		return nil, errors.New("kafka: processor must be set")
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 30 * time.Second
+	}
+	return &BreakerProcessor{
+		processor: processor,
+		cfg:       cfg,
+		clock:     time.Now,
+	}, nil
+}
+
+// State returns the current state of the circuit.
+func (b *BreakerProcessor) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpenIfCooledDown()
+	return b.state
+}
+
+// ProcessBatch processes the batch with the wrapped processor, unless the
+// circuit is open, in which case it returns ErrCircuitOpen.
+func (b *BreakerProcessor) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	probe, err := b.acquire()
+	if err != nil {
+		return err
+	}
+	err = b.processor.ProcessBatch(ctx, batch)
+	b.done(probe, err == nil, err != nil && ctx.Err() != nil)
+	return err
+}
+
+// acquire returns whether the batch is processed as a probe, or
+// ErrCircuitOpen if it mustn't be processed.
+func (b *BreakerProcessor) acquire() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpenIfCooledDown()
+	switch b.state {
+	case BreakerOpen:
+		return false, ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the result of a processed batch. Batches which failed after
+// their context was done are ignored, and a probe is retried by the next
+// batch.
+func (b *BreakerProcessor) done(probe, ok, cancelled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case cancelled:
+	case ok:
+		b.state = BreakerClosed
+		b.failures = 0
+	case probe:
+		b.open()
+	case b.state == BreakerClosed:
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.open()
+		}
+	}
+}
+
+// open opens the circuit. It must be called with the lock held.
+func (b *BreakerProcessor) open() {
+	b.state = BreakerOpen
+	b.failures = 0
+	b.openedAt = b.clock()
+}
+
+// halfOpenIfCooledDown half-opens the circuit if it's open and the cooldown
+// has elapsed. It must be called with the lock held.
+func (b *BreakerProcessor) halfOpenIfCooledDown() {
+	if b.state == BreakerOpen && b.clock().Sub(b.openedAt) >= b.cfg.Cooldown {
+		b.state = BreakerHalfOpen
+	}
+}
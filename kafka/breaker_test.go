@@ -0,0 +1,147 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestNewBreakerProcessor(t *testing.T) {
+	_, err := NewBreakerProcessor(nil, BreakerConfig{})
+	assert.EqualError(t, err, "kafka: processor must be set")
+
+	b, err := NewBreakerProcessor(model.ProcessBatchFunc(
+		func(context.Context, *model.Batch) error { return nil },
+	), BreakerConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, BreakerConfig{FailureThreshold: 5, Cooldown: 30 * time.Second}, b.cfg)
+	assert.Equal(t, BreakerClosed, b.State())
+}
+
+func TestBreakerProcessor(t *testing.T) {
+	errProduce := errors.New("produce failed")
+	var (
+		calls   int
+		failing bool
+	)
+	b, err := NewBreakerProcessor(model.ProcessBatchFunc(
+		func(context.Context, *model.Batch) error {
+			calls++
+			if failing {
+				return errProduce
+			}
+			return nil
+		},
+	), BreakerConfig{FailureThreshold: 3, Cooldown: time.Minute})
+	require.NoError(t, err)
+	clock := newFakeClock(time.Now())
+	b.clock = clock.Now
+
+	ctx := context.Background()
+	batch := &model.Batch{{}}
+
+	// Successes reset the consecutive failures.
+	failing = true
+	for i := 0; i < 2; i++ {
+		assert.ErrorIs(t, b.ProcessBatch(ctx, batch), errProduce)
+	}
+	failing = false
+	require.NoError(t, b.ProcessBatch(ctx, batch))
+	assert.Equal(t, BreakerClosed, b.State())
+
+	// The circuit opens after 3 consecutive failures.
+	failing = true
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, b.ProcessBatch(ctx, batch), errProduce)
+	}
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.Equal(t, 6, calls)
+	assert.ErrorIs(t, b.ProcessBatch(ctx, batch), ErrCircuitOpen)
+	assert.Equal(t, 6, calls)
+
+	// A failed probe opens the circuit again.
+	clock.Advance(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	assert.ErrorIs(t, b.ProcessBatch(ctx, batch), errProduce)
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.Equal(t, 7, calls)
+	clock.Advance(time.Minute - time.Second)
+	assert.ErrorIs(t, b.ProcessBatch(ctx, batch), ErrCircuitOpen)
+
+	// A successful probe closes the circuit.
+	clock.Advance(time.Second)
+	failing = false
+	require.NoError(t, b.ProcessBatch(ctx, batch))
+	assert.Equal(t, BreakerClosed, b.State())
+	assert.Equal(t, 8, calls)
+}
+
+func TestBreakerProcessorSingleProbe(t *testing.T) {
+	probing := make(chan struct{})
+	release := make(chan error)
+	b, err := NewBreakerProcessor(model.ProcessBatchFunc(
+		func(context.Context, *model.Batch) error {
+			probing <- struct{}{}
+			return <-release
+		},
+	), BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	require.NoError(t, err)
+	clock := newFakeClock(time.Now())
+	b.clock = clock.Now
+
+	ctx := context.Background()
+	batch := &model.Batch{{}}
+	go func() { <-probing; release <- errors.New("failed") }()
+	assert.Error(t, b.ProcessBatch(ctx, batch))
+	assert.Equal(t, BreakerOpen, b.State())
+
+	clock.Advance(time.Minute)
+	done := make(chan error)
+	go func() { done <- b.ProcessBatch(ctx, batch) }()
+	<-probing
+	// Batches fail fast while the probe is in flight.
+	assert.ErrorIs(t, b.ProcessBatch(ctx, batch), ErrCircuitOpen)
+	release <- nil
+	require.NoError(t, <-done)
+	assert.Equal(t, BreakerClosed, b.State())
+}
+
+func TestBreakerProcessorContextCancelled(t *testing.T) {
+	b, err := NewBreakerProcessor(model.ProcessBatchFunc(
+		func(ctx context.Context, _ *model.Batch) error {
+			return ctx.Err()
+		},
+	), BreakerConfig{FailureThreshold: 1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Failures caused by the caller's context don't open the circuit.
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, b.ProcessBatch(ctx, &model.Batch{{}}), context.Canceled)
+	}
+	assert.Equal(t, BreakerClosed, b.State())
+}
@@ -22,11 +22,16 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/pkg/sasl"
 	"github.com/twmb/franz-go/plugin/kzap"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/zap"
 
 	"github.com/elastic/apm-data/model"
@@ -43,6 +48,42 @@ type Decoder interface {
 	Decode([]byte, *model.APMEvent) error
 }
 
+// SourceTopicKey, SourcePartitionKey and SourceOffsetKey are the context
+// metadata keys which hold the topic, partition and offset of the consumed
+// record when ConsumerConfig.AddSourceMetadata is set. Since the Producer
+// adds the context metadata as record headers, they're also the header keys
+// of the records produced while processing the consumed record.
+const (
+	SourceTopicKey     = "source-topic"
+	SourcePartitionKey = "source-partition"
+	SourceOffsetKey    = "source-offset"
+)
+
+// OffsetReset defines the offset at which a consumer group without committed
+// offsets starts consuming a partition.
+type OffsetReset uint8
+
+const (
+	// OffsetResetLatest starts consuming from the latest offset, only
+	// consuming the records produced after the consumer joined the group.
+	OffsetResetLatest OffsetReset = iota
+	// OffsetResetEarliest starts consuming from the earliest offset,
+	// consuming all the records retained in the partition.
+	OffsetResetEarliest
+)
+
+// IsolationLevel defines which records of transactions a consumer reads.
+type IsolationLevel uint8
+
+const (
+	// IsolationLevelReadUncommitted reads all the records, including the
+	// records of transactions which are still open, or were aborted.
+	IsolationLevelReadUncommitted IsolationLevel = iota
+	// IsolationLevelReadCommitted only reads the records of committed
+	// transactions, and the records produced outside of transactions.
+	IsolationLevelReadCommitted
+)
+
 // ConsumerConfig defines the configuration for the Kafka consumer.
 type ConsumerConfig struct {
 	// Brokers is the list of kafka brokers used to seed the Kafka client.
@@ -57,7 +98,10 @@ type ConsumerConfig struct {
 	// Version is the software version to use in the Kafka client. This is
 	// useful since it shows up in Kafka metrics and logs.
 	Version string
-	// Decoder holds an encoding.Decoder for decoding events.
+	// Decoder holds an encoding.Decoder for decoding events. It's
+	// independent of the Encoder used to produce the processed events, so a
+	// consume-transform-produce pipeline can consume and produce events with
+	// different codecs.
 	Decoder Decoder
 	// MaxPollRecords defines an upper bound to the number of records that can
 	// be polled on a single fetch. If MaxPollRecords <= 0, defaults to 100.
@@ -82,10 +126,131 @@ type ConsumerConfig struct {
 	SASL SASLMechanism
 	// TLS configures the kgo.Client to use TLS for authentication.
 	TLS *tls.Config
+	// AutoOffsetReset defines where a consumer group without committed
+	// offsets starts consuming from, for example, a newly created group.
+	// It has no effect once the group has committed offsets. If not set,
+	// it defaults to OffsetResetLatest.
+	//
+	// NOTE: this is a change in behavior. Previously, new consumer groups
+	// used the kgo default and started from the earliest offset. Set it to
+	// OffsetResetEarliest to keep consuming the records produced before a
+	// group was created.
+	AutoOffsetReset OffsetReset
+	// IsolationLevel defines whether the consumer reads the records of
+	// transactions which haven't been committed. If not set, it defaults to
+	// IsolationLevelReadUncommitted, which reads all the records.
+	//
+	// Use IsolationLevelReadCommitted to consume topics written by
+	// transactional producers, such as RunEOS, so the records of aborted
+	// transactions are skipped. Records of open transactions, and the ones
+	// after them, aren't returned until the transactions are committed or
+	// aborted, which delays consumption by up to the transaction timeout.
+	// It's ignored by RunEOS, which always reads committed records.
+	IsolationLevel IsolationLevel
+	// GroupInstanceID enables static group membership when set, identifying
+	// the consumer as a static member of the group across restarts. A
+	// consumer restarting with the same GroupInstanceID before the session
+	// times out rejoins the group without triggering a rebalance. The ID
+	// must be unique within the group.
+	//
+	// Static membership requires Kafka 2.3+, and leaving the group requires
+	// Kafka 2.4+. Closing a static member doesn't leave the group: its
+	// partitions aren't reassigned until the session times out.
+	GroupInstanceID string
+	// ProcessTimeout bounds the time the Processor has to process a batch.
+	// When set, ProcessBatch is called with a context which is cancelled
+	// once ProcessTimeout elapses, and a batch which times out is retried
+	// up to ProcessTimeoutRetries times. Batches which still time out are
+	// handled like any other processing error according to the Delivery:
+	// skipped with AtMostOnceDeliveryType, or not committed with
+	// AtLeastOnceDeliveryType. The Processor must honor the context
+	// cancellation for the timeout to take effect.
+	//
+	// Heartbeats are sent in the background, so slow processing doesn't
+	// cause the session to time out. However, rebalances are blocked until
+	// the polled records are handed to the partition consumers, so
+	// ProcessTimeout * (ProcessTimeoutRetries + 1) * MaxPollRecords should
+	// be kept below rebalance.timeout.ms, or the consumer may be forced out
+	// of the group. If ProcessTimeout <= 0, processing isn't bounded.
+	ProcessTimeout time.Duration
+	// ProcessTimeoutRetries is the number of times a batch which timed out
+	// is retried. It has no effect unless ProcessTimeout is set.
+	ProcessTimeoutRetries int
+	// DropExpired drops the records which have expired according to their
+	// ExpiresAtHeader (see ProducerConfig.RecordTTL) without processing them.
+	// Dropped records are considered processed, and are committed.
+	DropExpired bool
+	// HeaderAllowlist, if not nil, holds the record header keys which are
+	// restored into the context metadata passed to the Processor, see
+	// queuecontext.MetadataFromContext. The other headers are dropped. If
+	// nil, all the headers are restored, which is the default. The baggage
+	// is only restored into the context if the allowlist holds
+	// BaggageHeader.
+	HeaderAllowlist []string
+	// AddSourceMetadata adds the topic, partition and offset of the consumed
+	// records to the context metadata passed to the Processor, with the
+	// SourceTopicKey, SourcePartitionKey and SourceOffsetKey keys,
+	// regardless of the HeaderAllowlist. In a reprocessing pipeline, the
+	// records produced with the context have them as headers, pointing to
+	// the record they were produced from. Records which already have them,
+	// for example, after multiple hops, get them overwritten with the
+	// coordinates of the last consumed record.
+	AddSourceMetadata bool
+	// CommitCallback, if set, is called with the offsets of the consumed
+	// records instead of committing them to Kafka, so they can be stored
+	// elsewhere, for example, in the same database transaction as the side
+	// effects of processing the records. The offsets are keyed by topic and
+	// partition, and are the offsets of the next records to consume, like
+	// the offsets committed to Kafka.
+	//
+	// With AtLeastOnceDeliveryType, the callback is called after the
+	// records are processed, so the records whose offsets fail to be stored,
+	// or which are processed right before the consumer crashes, are
+	// processed again: each record is processed at least once. With
+	// AtMostOnceDeliveryType, it's called as soon as the records are polled,
+	// and they're only processed if it succeeds.
+	//
+	// It's ignored by RunEOS, which commits the offsets in the transactions.
+	CommitCallback func(ctx context.Context, offsets map[string]map[int32]int64) error
+	// LoadOffsets, if set, is called with the partitions assigned to the
+	// consumer, keyed by topic, and returns the offsets to start consuming
+	// them from, typically the ones stored by CommitCallback. The partitions
+	// which are missing from the returned offsets are consumed from their
+	// offsets committed to Kafka, if any, or from AutoOffsetReset. An error
+	// makes the consumer leave the group. It's ignored by RunEOS.
+	LoadOffsets func(ctx context.Context, partitions map[string][]int32) (map[string]map[int32]int64, error)
+	// TransactionalID is the transactional ID used by RunEOS to produce the
+	// records and commit the consumed offsets within transactions. It must be
+	// unique for each RunEOS instance, and stable across restarts. It's
+	// ignored by the Consumer.
+	TransactionalID string
+	// MeterProvider is used to create the consumer metrics. If nil, no
+	// metrics are recorded. It's ignored by RunEOS. The following metrics
+	// are recorded:
+	//
+	//   - consumer.records.redelivered: a counter of the consumed records,
+	//     by topic, whose offsets had already been committed by the
+	//     consumer, which indicates that they're processed more than once,
+	//     for example, when a rebalance reassigns a partition before its
+	//     processed records are committed. The metric is a heuristic: the
+	//     consumer only knows the offsets it committed itself since it was
+	//     created, so the records re-delivered after a restart, or after
+	//     being committed by another member of the group, aren't counted.
+	MeterProvider metric.MeterProvider
 }
 
 // Validate ensures the configuration is valid, otherwise, returns an error.
 func (cfg ConsumerConfig) Validate() error {
+	errs := cfg.validate()
+	if cfg.Processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// validate returns the errors in the configuration shared by the Consumer and
+// RunEOS.
+func (cfg ConsumerConfig) validate() []error {
 	var errs []error
 	if len(cfg.Brokers) == 0 {
 		errs = append(errs, errors.New("kafka: at least one broker must be set"))
@@ -102,10 +267,16 @@ func (cfg ConsumerConfig) Validate() error {
 	if cfg.Logger == nil {
 		errs = append(errs, errors.New("kafka: logger must be set"))
 	}
-	if cfg.Processor == nil {
-		errs = append(errs, errors.New("kafka: processor must be set"))
+	if cfg.ProcessTimeoutRetries < 0 {
+		errs = append(errs, errors.New("kafka: process timeout retries cannot be negative"))
 	}
-	return errors.Join(errs...)
+	if cfg.AutoOffsetReset > OffsetResetEarliest {
+		errs = append(errs, fmt.Errorf("kafka: unknown auto offset reset %d", cfg.AutoOffsetReset))
+	}
+	if cfg.IsolationLevel > IsolationLevelReadCommitted {
+		errs = append(errs, fmt.Errorf("kafka: unknown isolation level %d", cfg.IsolationLevel))
+	}
+	return errs
 }
 
 // Consumer wraps a Kafka consumer and the consumption implementation details.
@@ -123,18 +294,32 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("kafka: invalid consumer config: %w", err)
 	}
+	metrics, err := newConsumerMetrics(cfg.MeterProvider)
+	if err != nil {
+		return nil, err
+	}
 	consumer := &consumer{
-		consumers: make(map[topicPartition]partitionConsumer),
-		processor: cfg.Processor,
-		logger:    cfg.Logger.Named("partition"),
-		decoder:   cfg.Decoder,
-		delivery:  cfg.Delivery,
+		consumers:   make(map[topicPartition]partitionConsumer),
+		processor:   cfg.Processor,
+		logger:      cfg.Logger.Named("partition"),
+		decoder:     cfg.Decoder,
+		delivery:    cfg.Delivery,
+		timeout:     cfg.ProcessTimeout,
+		retries:     cfg.ProcessTimeoutRetries,
+		dropExpired: cfg.DropExpired,
+		sourceMeta:  cfg.AddSourceMetadata,
+		commit:      cfg.CommitCallback,
 	}
-	opts := []kgo.Opt{
-		kgo.SeedBrokers(cfg.Brokers...),
-		kgo.ConsumerGroup(cfg.GroupID),
-		kgo.ConsumeTopics(cfg.Topics...),
-		kgo.WithLogger(kzap.New(cfg.Logger.Named("kafka"))),
+	if cfg.MeterProvider != nil {
+		consumer.redelivery = newRedeliveryTracker(metrics.recordsRedelivered)
+	}
+	if cfg.HeaderAllowlist != nil {
+		consumer.headerAllowlist = make(map[string]struct{}, len(cfg.HeaderAllowlist))
+		for _, k := range cfg.HeaderAllowlist {
+			consumer.headerAllowlist[k] = struct{}{}
+		}
+	}
+	opts := append(cfg.clientOpts(),
 		// If a rebalance happens while the client is polling, the consumed
 		// records may belong to a partition which has been reassigned to a
 		// different consumer int he group. To avoid this scenario, Polls will
@@ -148,6 +333,63 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 		kgo.OnPartitionsAssigned(consumer.assigned),
 		kgo.OnPartitionsLost(consumer.lost),
 		kgo.OnPartitionsRevoked(consumer.lost),
+	)
+	if cfg.LoadOffsets != nil {
+		opts = append(opts, kgo.AdjustFetchOffsetsFn(loadOffsetsFn(cfg.LoadOffsets)))
+	}
+	if cfg.MaxPollRecords <= 0 {
+		cfg.MaxPollRecords = 100
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed creating kafka consumer: %w", err)
+	}
+	// Issue a metadata refresh request on construction, so the broker list is
+	// populated.
+	client.ForceMetadataRefresh()
+	return &Consumer{
+		cfg:      cfg,
+		client:   client,
+		consumer: consumer,
+	}, nil
+}
+
+// loadOffsetsFn returns a kgo.AdjustFetchOffsetsFn function which replaces the
+// fetched offsets with the ones returned by load.
+func loadOffsetsFn(
+	load func(context.Context, map[string][]int32) (map[string]map[int32]int64, error),
+) func(context.Context, map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+	return func(ctx context.Context, offsets map[string]map[int32]kgo.Offset) (map[string]map[int32]kgo.Offset, error) {
+		partitions := make(map[string][]int32, len(offsets))
+		for topic, po := range offsets {
+			for partition := range po {
+				partitions[topic] = append(partitions[topic], partition)
+			}
+		}
+		loaded, err := load(ctx, partitions)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: failed loading offsets: %w", err)
+		}
+		for topic, po := range loaded {
+			for partition, offset := range po {
+				if _, ok := offsets[topic][partition]; !ok {
+					continue
+				}
+				// Clear the epoch, since the offset doesn't come from Kafka.
+				offsets[topic][partition] = kgo.NewOffset().At(offset).WithEpoch(-1)
+			}
+		}
+		return offsets, nil
+	}
+}
+
+// clientOpts returns the kgo.Client options shared by the Consumer and RunEOS.
+func (cfg ConsumerConfig) clientOpts() []kgo.Opt {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.ConsumerGroup(cfg.GroupID),
+		kgo.ConsumeTopics(cfg.Topics...),
+		kgo.WithLogger(kzap.New(cfg.Logger.Named("kafka"))),
 	}
 	if cfg.ClientID != "" {
 		opts = append(opts, kgo.ClientID(cfg.ClientID))
@@ -163,21 +405,17 @@ func NewConsumer(cfg ConsumerConfig) (*Consumer, error) {
 	if cfg.SASL != nil {
 		opts = append(opts, kgo.SASL(cfg.SASL))
 	}
-	if cfg.MaxPollRecords <= 0 {
-		cfg.MaxPollRecords = 100
+	if cfg.GroupInstanceID != "" {
+		opts = append(opts, kgo.InstanceID(cfg.GroupInstanceID))
 	}
-	client, err := kgo.NewClient(opts...)
-	if err != nil {
-		return nil, fmt.Errorf("kafka: failed creating kafka consumer: %w", err)
+	if cfg.IsolationLevel == IsolationLevelReadCommitted {
+		opts = append(opts, kgo.FetchIsolationLevel(kgo.ReadCommitted()))
 	}
-	// Issue a metadata refresh request on construction, so the broker list is
-	// populated.
-	client.ForceMetadataRefresh()
-	return &Consumer{
-		cfg:      cfg,
-		client:   client,
-		consumer: consumer,
-	}, nil
+	resetOffset := kgo.NewOffset().AtEnd()
+	if cfg.AutoOffsetReset == OffsetResetEarliest {
+		resetOffset = kgo.NewOffset().AtStart()
+	}
+	return append(opts, kgo.ConsumeResetOffset(resetOffset))
 }
 
 // Close closes the consumer.
@@ -200,6 +438,47 @@ func (c *Consumer) Run(ctx context.Context) error {
 	}
 }
 
+// commitFetched commits the offsets of the fetched records, with the
+// cfg.CommitCallback if set.
+func (c *Consumer) commitFetched(ctx context.Context, fetches kgo.Fetches) error {
+	if c.cfg.CommitCallback == nil {
+		if err := c.client.CommitUncommittedOffsets(ctx); err != nil {
+			return err
+		}
+		c.trackCommitted(fetches)
+		return nil
+	}
+	offsets := make(map[string]map[int32]int64)
+	fetches.EachPartition(func(ftp kgo.FetchTopicPartition) {
+		if len(ftp.Records) == 0 {
+			return
+		}
+		if offsets[ftp.Topic] == nil {
+			offsets[ftp.Topic] = make(map[int32]int64)
+		}
+		offsets[ftp.Topic][ftp.Partition] = ftp.Records[len(ftp.Records)-1].Offset + 1
+	})
+	if len(offsets) == 0 {
+		return nil
+	}
+	if err := c.cfg.CommitCallback(ctx, offsets); err != nil {
+		return err
+	}
+	c.trackCommitted(fetches)
+	return nil
+}
+
+// trackCommitted records the offsets of the fetched records as committed.
+func (c *Consumer) trackCommitted(fetches kgo.Fetches) {
+	fetches.EachPartition(func(ftp kgo.FetchTopicPartition) {
+		if len(ftp.Records) == 0 {
+			return
+		}
+		last := ftp.Records[len(ftp.Records)-1]
+		c.consumer.redelivery.commit(last.Topic, last.Partition, last.Offset+1)
+	})
+}
+
 // fetch polls the Kafka broker for new records up to cfg.MaxPollRecords.
 // Any errors returned by fetch should be considered fatal.
 func (c *Consumer) fetch(ctx context.Context) error {
@@ -215,12 +494,16 @@ func (c *Consumer) fetch(ctx context.Context) error {
 	if errors.Is(fetches.Err0(), context.Canceled) {
 		return fmt.Errorf("context canceled: %w", fetches.Err0())
 	}
+	// Check the records for re-deliveries before their offsets are committed.
+	fetches.EachPartition(func(ftp kgo.FetchTopicPartition) {
+		c.consumer.redelivery.observe(ftp.Records)
+	})
 	switch c.cfg.Delivery {
 	case apmqueue.AtLeastOnceDeliveryType:
 		// Committing the processed records happens on each partition consumer.
 	case apmqueue.AtMostOnceDeliveryType:
 		// Commit the fetched record offsets as soon as we've polled them.
-		if err := c.client.CommitUncommittedOffsets(ctx); err != nil {
+		if err := c.commitFetched(ctx, fetches); err != nil {
 			// If the commit fails, then return immediately and any uncommitted
 			// records will be re-delivered in time. Otherwise, records may be
 			// processed twice.
@@ -271,16 +554,81 @@ func (c *Consumer) Healthy() error {
 	return nil
 }
 
+// Lag returns the consumer group lag for each of the consumed topics, the sum
+// of the lag of the topic's partitions. See PartitionLag for the lag of the
+// individual partitions.
+func (c *Consumer) Lag(ctx context.Context) (map[string]int64, error) {
+	partitionLag, err := c.PartitionLag(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lag := make(map[string]int64, len(partitionLag))
+	for topic, partitions := range partitionLag {
+		var total int64
+		for _, l := range partitions {
+			total += l
+		}
+		lag[topic] = total
+	}
+	return lag, nil
+}
+
+// PartitionLag returns the consumer group lag for each of the consumed topic
+// partitions, calculated as the difference between the partition's end offset
+// and the last offset committed by the consumer group. Partitions without a
+// committed offset report their end offset as the lag.
+func (c *Consumer) PartitionLag(ctx context.Context) (map[string]map[int32]int64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// The admin client must not be closed, since it closes the underlying
+	// client.
+	admin := kadm.NewClient(c.client)
+	committed, err := admin.FetchOffsetsForTopics(ctx, c.cfg.GroupID, c.cfg.Topics...)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed fetching committed offsets: %w", err)
+	}
+	end, err := admin.ListEndOffsets(ctx, c.cfg.Topics...)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed listing end offsets: %w", err)
+	}
+	if err := end.Error(); err != nil {
+		return nil, fmt.Errorf("kafka: failed listing end offsets: %w", err)
+	}
+	lag := make(map[string]map[int32]int64)
+	end.Each(func(o kadm.ListedOffset) {
+		partitions, ok := lag[o.Topic]
+		if !ok {
+			partitions = make(map[int32]int64)
+			lag[o.Topic] = partitions
+		}
+		partitions[o.Partition] = o.Offset
+		if commit, ok := committed.Lookup(o.Topic, o.Partition); ok && commit.At >= 0 {
+			partitions[o.Partition] = o.Offset - commit.At
+		}
+	})
+	return lag, nil
+}
+
 // consumer wraps partitionConsumers and exposes the necessary callbacks
 // to use when partitions are reassigned.
 type consumer struct {
-	mu        sync.Mutex
-	wg        sync.WaitGroup
-	consumers map[topicPartition]partitionConsumer
-	processor model.BatchProcessor
-	logger    *zap.Logger
-	decoder   Decoder
-	delivery  apmqueue.DeliveryType
+	mu          sync.Mutex
+	wg          sync.WaitGroup
+	consumers   map[topicPartition]partitionConsumer
+	processor   model.BatchProcessor
+	logger      *zap.Logger
+	decoder     Decoder
+	delivery    apmqueue.DeliveryType
+	timeout     time.Duration
+	retries     int
+	dropExpired bool
+	sourceMeta  bool
+	commit      func(context.Context, map[string]map[int32]int64) error
+	// headerAllowlist holds cfg.HeaderAllowlist as a set, nil if not set.
+	headerAllowlist map[string]struct{}
+	// redelivery tracks the committed offsets, nil without a MeterProvider.
+	redelivery *redeliveryTracker
 }
 
 type topicPartition struct {
@@ -297,12 +645,19 @@ func (c *consumer) assigned(_ context.Context, client *kgo.Client, assigned map[
 		for _, partition := range partitions {
 			c.wg.Add(1)
 			pc := partitionConsumer{
-				records:   make(chan []*kgo.Record),
-				processor: c.processor,
-				logger:    c.logger,
-				decoder:   c.decoder,
-				client:    client,
-				delivery:  c.delivery,
+				records:         make(chan []*kgo.Record),
+				processor:       c.processor,
+				logger:          c.logger,
+				decoder:         c.decoder,
+				client:          client,
+				delivery:        c.delivery,
+				timeout:         c.timeout,
+				retries:         c.retries,
+				dropExpired:     c.dropExpired,
+				sourceMeta:      c.sourceMeta,
+				commit:          c.commit,
+				headerAllowlist: c.headerAllowlist,
+				redelivery:      c.redelivery,
 			}
 			go func(topic string, partition int32) {
 				defer c.wg.Done()
@@ -333,12 +688,24 @@ func (c *consumer) lost(_ context.Context, _ *kgo.Client, lost map[string][]int3
 }
 
 type partitionConsumer struct {
-	client    *kgo.Client
-	records   chan []*kgo.Record
-	processor model.BatchProcessor
-	logger    *zap.Logger
-	decoder   Decoder
-	delivery  apmqueue.DeliveryType
+	client      *kgo.Client
+	records     chan []*kgo.Record
+	processor   model.BatchProcessor
+	logger      *zap.Logger
+	decoder     Decoder
+	delivery    apmqueue.DeliveryType
+	timeout     time.Duration
+	retries     int
+	dropExpired bool
+	// sourceMeta adds the coordinates of the records to the metadata.
+	sourceMeta bool
+	// commit, if set, replaces committing the offsets to Kafka.
+	commit func(context.Context, map[string]map[int32]int64) error
+	// headerAllowlist holds the header keys restored into the context
+	// metadata, nil if all of them are restored.
+	headerAllowlist map[string]struct{}
+	// redelivery tracks the committed offsets, nil without a MeterProvider.
+	redelivery *redeliveryTracker
 }
 
 // consume processed the records from a topic and partition. Calling consume
@@ -354,6 +721,21 @@ func (pc partitionConsumer) consume(topic string, partition int32) {
 		last := -1
 	recordLoop:
 		for i, msg := range records {
+			if pc.dropExpired && RecordExpired(msg, time.Now()) {
+				logger.Debug("dropping expired record",
+					zap.Int64("offset", msg.Offset),
+				)
+				last = i
+				continue
+			}
+			if marker, ok := RecordMarker(msg); ok {
+				logger.Debug("skipping control marker record",
+					zap.String("marker", marker),
+					zap.Int64("offset", msg.Offset),
+				)
+				last = i
+				continue
+			}
 			meta := make(map[string]string)
 			for _, h := range msg.Headers {
 				meta[h.Key] = string(h.Value)
@@ -370,9 +752,35 @@ func (pc partitionConsumer) consume(topic string, partition int32) {
 				// may cause the same error. Discard the event for now.
 				continue
 			}
-			ctx := queuecontext.WithMetadata(context.Background(), meta)
+			if pc.headerAllowlist != nil {
+				for k := range meta {
+					if _, ok := pc.headerAllowlist[k]; !ok {
+						delete(meta, k)
+					}
+				}
+			}
+			ctx := context.Background()
+			// Restore the propagated baggage (if any), rather than adding
+			// it to the metadata.
+			if v, ok := meta[BaggageHeader]; ok {
+				delete(meta, BaggageHeader)
+				if b, err := baggage.Parse(v); err == nil {
+					ctx = baggage.ContextWithBaggage(ctx, b)
+				} else {
+					logger.Warn("unable to parse baggage header",
+						zap.Error(err),
+						zap.Int64("offset", msg.Offset),
+					)
+				}
+			}
+			if pc.sourceMeta {
+				meta[SourceTopicKey] = msg.Topic
+				meta[SourcePartitionKey] = strconv.FormatInt(int64(msg.Partition), 10)
+				meta[SourceOffsetKey] = strconv.FormatInt(msg.Offset, 10)
+			}
+			ctx = queuecontext.WithMetadata(ctx, meta)
 			batch := model.Batch{event}
-			if err := pc.processor.ProcessBatch(ctx, &batch); err != nil {
+			if err := pc.process(ctx, &batch, logger.With(zap.Int64("offset", msg.Offset))); err != nil {
 				logger.Error("unable to process event",
 					zap.Error(err),
 					zap.Int64("offset", msg.Offset),
@@ -396,7 +804,7 @@ func (pc partitionConsumer) consume(topic string, partition int32) {
 		// with AtLeastOnceDeliveryType.
 		if pc.delivery == apmqueue.AtLeastOnceDeliveryType && last >= 0 {
 			lastRecord := records[last]
-			err := pc.client.CommitRecords(context.Background(), lastRecord)
+			err := pc.commitRecord(context.Background(), lastRecord)
 			if err != nil {
 				logger.Error("unable to commit records",
 					zap.Error(err),
@@ -410,3 +818,47 @@ func (pc partitionConsumer) consume(topic string, partition int32) {
 		}
 	}
 }
+
+// commitRecord commits the offset of the record, with pc.commit if set.
+func (pc partitionConsumer) commitRecord(ctx context.Context, r *kgo.Record) error {
+	var err error
+	if pc.commit != nil {
+		err = pc.commit(ctx, map[string]map[int32]int64{
+			r.Topic: {r.Partition: r.Offset + 1},
+		})
+	} else {
+		err = pc.client.CommitRecords(ctx, r)
+	}
+	if err == nil {
+		pc.redelivery.commit(r.Topic, r.Partition, r.Offset+1)
+	}
+	return err
+}
+
+// process processes the batch, retrying it when it times out.
+func (pc partitionConsumer) process(ctx context.Context, batch *model.Batch, logger *zap.Logger) error {
+	if pc.timeout <= 0 {
+		return pc.processor.ProcessBatch(ctx, batch)
+	}
+	var err error
+	for attempt := 0; attempt <= pc.retries; attempt++ {
+		var timedOut bool
+		if timedOut, err = pc.processWithTimeout(ctx, batch); !timedOut {
+			return err
+		}
+		logger.Warn("event processing timed out",
+			zap.Duration("timeout", pc.timeout),
+			zap.Int("attempt", attempt+1),
+		)
+	}
+	return err
+}
+
+// processWithTimeout processes the batch with a context which is cancelled
+// after pc.timeout, and reports whether the processing timed out.
+func (pc partitionConsumer) processWithTimeout(ctx context.Context, batch *model.Batch) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, pc.timeout)
+	defer cancel()
+	err := pc.processor.ProcessBatch(ctx, batch)
+	return err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded), err
+}
@@ -18,12 +18,729 @@
 package kafka
 
 import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/baggage"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/queuecontext"
 )
 
 func TestNewConsumer(t *testing.T) {
 	_, err := NewConsumer(ConsumerConfig{})
 	assert.Error(t, err)
 }
+
+func TestNewConsumerGroupInstanceID(t *testing.T) {
+	cfg := ConsumerConfig{
+		Brokers:   []string{"127.0.0.1:1"},
+		Topics:    []string{"topic"},
+		GroupID:   "group",
+		Decoder:   json.JSON{},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+	}
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "", consumer.client.OptValue(kgo.InstanceID))
+	assert.NoError(t, consumer.Close())
+
+	cfg.GroupInstanceID = "consumer-1"
+	consumer, err = NewConsumer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "consumer-1", consumer.client.OptValue(kgo.InstanceID))
+	assert.NoError(t, consumer.Close())
+}
+
+func TestConsumerLag(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+
+	var processed atomic.Int64
+	release := make(chan struct{})
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:  brokers,
+		Topics:   []string{topic},
+		GroupID:  "group",
+		Decoder:  json.JSON{},
+		Logger:   zap.NewNop(),
+		Delivery: apmqueue.AtLeastOnceDeliveryType,
+		// Consume the records produced before the consumer started.
+		AutoOffsetReset: OffsetResetEarliest,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			// Pause the consumer after the first two records.
+			if processed.Add(1) > 2 {
+				<-release
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			res := client.ProduceSync(ctx, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+			require.NoError(t, res.FirstErr())
+		}
+	}
+	totalLag := func() int64 {
+		lag, err := consumer.Lag(ctx)
+		require.NoError(t, err)
+		partitionLag, err := consumer.PartitionLag(ctx)
+		require.NoError(t, err)
+		var total int64
+		for _, l := range partitionLag[topic] {
+			total += l
+		}
+		// The lag may change between the calls while consuming.
+		if total != lag[topic] {
+			return -1
+		}
+		return lag[topic]
+	}
+
+	produce(2)
+	assert.Equal(t, int64(2), totalLag())
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		close(release)
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	assert.Eventually(t, func() bool { return totalLag() == 0 },
+		5*time.Second, 50*time.Millisecond,
+	)
+	produce(3)
+	assert.Eventually(t, func() bool { return totalLag() == 3 },
+		5*time.Second, 50*time.Millisecond,
+	)
+}
+
+func TestConsumerRestoresBaggage(t *testing.T) {
+	for name, tc := range map[string]struct {
+		allowlist []string
+		restored  bool
+	}{
+		"no allowlist":     {restored: true},
+		"allowed":          {allowlist: []string{"a", BaggageHeader}, restored: true},
+		"not in allowlist": {allowlist: []string{"a"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testConsumerRestoresBaggage(t, tc.allowlist, tc.restored)
+		})
+	}
+}
+
+func testConsumerRestoresBaggage(t *testing.T, allowlist []string, restored bool) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+
+	processed := make(chan context.Context, 1)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers: brokers,
+		Topics:  []string{topic},
+		GroupID: "group",
+		Decoder: json.JSON{},
+		Logger:  zap.NewNop(),
+		// Consume the record produced before the consumer started.
+		AutoOffsetReset: OffsetResetEarliest,
+		HeaderAllowlist: allowlist,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			processed <- ctx
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res := client.ProduceSync(ctx, &kgo.Record{
+		Topic: topic,
+		Value: []byte(`{}`),
+		Headers: []kgo.RecordHeader{
+			{Key: "a", Value: []byte("b")},
+			{Key: BaggageHeader, Value: []byte("tenant=acme")},
+		},
+	})
+	require.NoError(t, res.FirstErr())
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	select {
+	case pctx := <-processed:
+		if restored {
+			assert.Equal(t, "acme", baggage.FromContext(pctx).Member("tenant").Value())
+		} else {
+			assert.Zero(t, baggage.FromContext(pctx).Len())
+		}
+		meta, ok := queuecontext.MetadataFromContext(pctx)
+		require.True(t, ok)
+		assert.Equal(t, map[string]string{"a": "b"}, meta)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+}
+
+func TestConsumerHeaderAllowlist(t *testing.T) {
+	topic := "default-topic"
+	_, brokers := newClusterWithTopics(t, topic)
+
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	processed := make(chan context.Context, 1)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:         brokers,
+		Topics:          []string{topic},
+		GroupID:         "group",
+		Decoder:         json.JSON{},
+		Logger:          zap.NewNop(),
+		AutoOffsetReset: OffsetResetEarliest,
+		HeaderAllowlist: []string{"a"},
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			processed <- ctx
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, producer.ProcessEvent(queuecontext.WithMetadata(ctx,
+		map[string]string{"a": "b", "trace": "large blob"},
+	), model.APMEvent{}))
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	select {
+	case pctx := <-processed:
+		meta, ok := queuecontext.MetadataFromContext(pctx)
+		require.True(t, ok)
+		assert.Equal(t, map[string]string{"a": "b"}, meta)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+}
+
+func TestConsumerAddSourceMetadata(t *testing.T) {
+	in, out := "in-topic", "out-topic"
+	client, brokers := newClusterWithTopics(t, in, out)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(out)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:           brokers,
+		Topics:            []string{in},
+		GroupID:           "group",
+		Decoder:           json.JSON{},
+		Logger:            zap.NewNop(),
+		AutoOffsetReset:   OffsetResetEarliest,
+		AddSourceMetadata: true,
+		// The source metadata is added regardless of the allowlist.
+		HeaderAllowlist: []string{},
+		Processor:       producer,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var source *kgo.Record
+	for i := 0; i < 3; i++ {
+		res := client.ProduceSync(ctx, &kgo.Record{Topic: in, Value: []byte(`{}`)})
+		require.NoError(t, res.FirstErr())
+		source = res[0].Record
+	}
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	client.AddConsumeTopics(out)
+	var records []*kgo.Record
+	for len(records) < 3 {
+		fetches := client.PollRecords(ctx, 3)
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	var found bool
+	for _, record := range records {
+		headers := make(map[string]string)
+		for _, h := range record.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		assert.Equal(t, in, headers[SourceTopicKey])
+		if headers[SourcePartitionKey] == strconv.Itoa(int(source.Partition)) &&
+			headers[SourceOffsetKey] == strconv.FormatInt(source.Offset, 10) {
+			found = true
+		}
+	}
+	assert.True(t, found, "no record produced from the last source record")
+}
+
+func TestConsumerCommitCallback(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The next offset to consume from each partition.
+	expected := make(map[string]map[int32]int64)
+	for i := 0; i < 5; i++ {
+		res := client.ProduceSync(ctx, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+		require.NoError(t, res.FirstErr())
+		if expected[topic] == nil {
+			expected[topic] = make(map[int32]int64)
+		}
+		r := res[0].Record
+		expected[topic][r.Partition] = r.Offset + 1
+	}
+
+	var mu sync.Mutex
+	committed := make(map[string]map[int32]int64)
+	var processed atomic.Int64
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:         brokers,
+		Topics:          []string{topic},
+		GroupID:         "group",
+		Decoder:         json.JSON{},
+		Logger:          zap.NewNop(),
+		AutoOffsetReset: OffsetResetEarliest,
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed.Add(1)
+			return nil
+		}),
+		CommitCallback: func(_ context.Context, offsets map[string]map[int32]int64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for topic, po := range offsets {
+				if committed[topic] == nil {
+					committed[topic] = make(map[int32]int64)
+				}
+				for partition, offset := range po {
+					committed[topic][partition] = offset
+				}
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return assert.ObjectsAreEqual(expected, committed)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(5), processed.Load())
+
+	// The offsets weren't committed to Kafka.
+	offsets, err := kadm.NewClient(client).FetchOffsets(ctx, "group")
+	require.NoError(t, err)
+	assert.Empty(t, offsets.Offsets())
+}
+
+func TestLoadOffsetsFn(t *testing.T) {
+	var loadedPartitions map[string][]int32
+	adjust := loadOffsetsFn(func(_ context.Context, partitions map[string][]int32) (map[string]map[int32]int64, error) {
+		loadedPartitions = partitions
+		return map[string]map[int32]int64{
+			"a": {0: 10},
+			// Offsets of partitions which aren't assigned are ignored.
+			"b": {1: 20},
+		}, nil
+	})
+	committed := kgo.NewOffset().At(5)
+	offsets, err := adjust(context.Background(), map[string]map[int32]kgo.Offset{
+		"a": {0: committed, 1: committed},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]int32{"a": {0, 1}}, sortedPartitions(loadedPartitions))
+	assert.Equal(t, map[string]map[int32]kgo.Offset{
+		"a": {
+			0: kgo.NewOffset().At(10).WithEpoch(-1),
+			// Partitions without loaded offsets keep the committed ones.
+			1: committed,
+		},
+	}, offsets)
+
+	adjust = loadOffsetsFn(func(context.Context, map[string][]int32) (map[string]map[int32]int64, error) {
+		return nil, errors.New("database unavailable")
+	})
+	_, err = adjust(context.Background(), map[string]map[int32]kgo.Offset{})
+	assert.EqualError(t, err, "kafka: failed loading offsets: database unavailable")
+}
+
+func sortedPartitions(partitions map[string][]int32) map[string][]int32 {
+	for _, p := range partitions {
+		sort.Slice(p, func(i, j int) bool { return p[i] < p[j] })
+	}
+	return partitions
+}
+
+func TestConsumerAutoOffsetReset(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		res := client.ProduceSync(ctx, &kgo.Record{Topic: topic, Value: []byte(`{}`)})
+		require.NoError(t, res.FirstErr())
+	}
+
+	var processed atomic.Int64
+	newConsumer := func(group string, reset OffsetReset) *Consumer {
+		consumer, err := NewConsumer(ConsumerConfig{
+			Brokers:         brokers,
+			Topics:          []string{topic},
+			GroupID:         group,
+			Decoder:         json.JSON{},
+			Logger:          zap.NewNop(),
+			AutoOffsetReset: reset,
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				processed.Add(1)
+				return nil
+			}),
+		})
+		require.NoError(t, err)
+		return consumer
+	}
+	// The zero value starts from the latest offset.
+	var unset OffsetReset
+	for _, reset := range []OffsetReset{unset, OffsetResetLatest} {
+		latest := newConsumer("latest-group", reset)
+		assert.Equal(t, kgo.NewOffset().AtEnd(), latest.client.OptValue(kgo.ConsumeResetOffset))
+		assert.NoError(t, latest.Close())
+	}
+
+	consumer := newConsumer("earliest-group", OffsetResetEarliest)
+	assert.Equal(t, kgo.NewOffset().AtStart(), consumer.client.OptValue(kgo.ConsumeResetOffset))
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+	// A fresh group reads the records produced before it was created.
+	assert.Eventually(t, func() bool { return processed.Load() == 3 },
+		5*time.Second, 50*time.Millisecond,
+	)
+}
+
+func TestConsumerIsolationLevel(t *testing.T) {
+	cfg := ConsumerConfig{
+		Brokers:   []string{"127.0.0.1:1"},
+		Topics:    []string{"topic"},
+		GroupID:   "group",
+		Decoder:   json.JSON{},
+		Logger:    zap.NewNop(),
+		Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }),
+	}
+	consumer, err := NewConsumer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, int8(0), consumer.client.OptValue(kgo.FetchIsolationLevel))
+	require.NoError(t, consumer.Close())
+
+	cfg.IsolationLevel = IsolationLevelReadCommitted
+	consumer, err = NewConsumer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, int8(1), consumer.client.OptValue(kgo.FetchIsolationLevel))
+	require.NoError(t, consumer.Close())
+
+	cfg.IsolationLevel = 2
+	_, err = NewConsumer(cfg)
+	assert.ErrorContains(t, err, "kafka: unknown isolation level 2")
+}
+
+func TestConsumerReadCommitted(t *testing.T) {
+	topic := "default-topic"
+	_, brokers := newClusterWithTopics(t, topic)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.TransactionalID("isolation"),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+	produce := func(id string, commit kgo.TransactionEndTry) {
+		require.NoError(t, client.BeginTransaction())
+		value, err := json.JSON{}.Encode(model.APMEvent{Transaction: &model.Transaction{ID: id}})
+		require.NoError(t, err)
+		require.NoError(t, client.ProduceSync(ctx, &kgo.Record{Topic: topic, Value: value}).FirstErr())
+		require.NoError(t, client.EndTransaction(ctx, commit))
+	}
+	produce("aborted", kgo.TryAbort)
+	// The committed transaction marks the end of the records to consume.
+	produce("committed", kgo.TryCommit)
+
+	var mu sync.Mutex
+	var processed []string
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:         brokers,
+		Topics:          []string{topic},
+		GroupID:         "group",
+		Decoder:         json.JSON{},
+		Logger:          zap.NewNop(),
+		AutoOffsetReset: OffsetResetEarliest,
+		IsolationLevel:  IsolationLevelReadCommitted,
+		Processor: model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, event := range *b {
+				processed = append(processed, event.Transaction.ID)
+			}
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	// The records of the aborted transaction aren't consumed.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"committed"}, processed)
+}
+
+func TestConsumerProcessTimeout(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	processed := make(chan string, 10)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:               brokers,
+		Topics:                []string{topic},
+		GroupID:               "group",
+		Decoder:               json.JSON{},
+		Logger:                zap.NewNop(),
+		AutoOffsetReset:       OffsetResetEarliest,
+		ProcessTimeout:        50 * time.Millisecond,
+		ProcessTimeoutRetries: 1,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			id := (*b)[0].Transaction.ID
+			mu.Lock()
+			attempts[id]++
+			mu.Unlock()
+			if id == "slow" {
+				// Hang until the processing times out.
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			processed <- id
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, id := range []string{"slow", "fast"} {
+		value, err := json.JSON{}.Encode(model.APMEvent{
+			Transaction: &model.Transaction{ID: id},
+		})
+		require.NoError(t, err)
+		res := client.ProduceSync(ctx, &kgo.Record{Topic: topic, Value: value})
+		require.NoError(t, res.FirstErr())
+	}
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	// The slow event is skipped after being retried once, and processing
+	// continues with the next event.
+	select {
+	case id := <-processed:
+		assert.Equal(t, "fast", id)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"slow": 2, "fast": 1}, attempts)
+}
+
+func TestConsumerDropExpired(t *testing.T) {
+	topic := "default-topic"
+	_, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		RecordTTL: func(event model.APMEvent) time.Duration {
+			if event.Transaction.ID == "stale" {
+				return time.Minute
+			}
+			return time.Hour
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Produce the events as of 30 minutes ago, which expires the stale one.
+	setClock(producer, func() time.Time { return time.Now().Add(-30 * time.Minute) })
+	require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{
+		{Transaction: &model.Transaction{ID: "stale"}},
+		{Transaction: &model.Transaction{ID: "fresh"}},
+	}))
+
+	processed := make(chan string, 2)
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:         brokers,
+		Topics:          []string{topic},
+		GroupID:         "group",
+		Decoder:         json.JSON{},
+		Logger:          zap.NewNop(),
+		AutoOffsetReset: OffsetResetEarliest,
+		DropExpired:     true,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			processed <- (*b)[0].Transaction.ID
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	select {
+	case id := <-processed:
+		assert.Equal(t, "fresh", id)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the record to be processed")
+	}
+	select {
+	case id := <-processed:
+		t.Fatalf("unexpected record processed: %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
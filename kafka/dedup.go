@@ -0,0 +1,96 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupCache holds the idempotency keys seen within a time window, up to a
+// maximum number of keys. When full, the least recently seen keys are evicted
+// first, even if they're still within the window.
+type dedupCache struct {
+	window  time.Duration
+	maxKeys int
+
+	mu   sync.Mutex
+	keys map[string]*list.Element
+	// order holds the dedupEntry for each key, ordered by the time they were
+	// last seen, the oldest first.
+	order *list.List
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newDedupCache(window time.Duration, maxKeys int) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		maxKeys: maxKeys,
+		keys:    make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// contains returns true if key has been seen within the window ending at now.
+func (c *dedupCache) contains(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictExpired(now)
+	_, ok := c.keys[key]
+	return ok
+}
+
+// add records the keys as seen at now.
+func (c *dedupCache) add(keys []string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictExpired(now)
+	for _, key := range keys {
+		if elem, ok := c.keys[key]; ok {
+			elem.Value.(*dedupEntry).seen = now
+			c.order.MoveToBack(elem)
+			continue
+		}
+		c.keys[key] = c.order.PushBack(&dedupEntry{key: key, seen: now})
+	}
+	for c.order.Len() > c.maxKeys {
+		c.remove(c.order.Front())
+	}
+}
+
+// evictExpired removes the keys which were last seen before the window ending
+// at now. It must be called with the lock held.
+func (c *dedupCache) evictExpired(now time.Time) {
+	for elem := c.order.Front(); elem != nil; elem = c.order.Front() {
+		if now.Sub(elem.Value.(*dedupEntry).seen) < c.window {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+// remove removes elem from the cache. It must be called with the lock held.
+func (c *dedupCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.keys, elem.Value.(*dedupEntry).key)
+}
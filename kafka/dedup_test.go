@@ -0,0 +1,44 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupCacheMaxKeys(t *testing.T) {
+	c := newDedupCache(time.Minute, 2)
+	now := time.Now()
+	c.add([]string{"a", "b"}, now)
+	// Seeing "a" again makes "b" the least recently seen key.
+	c.add([]string{"a"}, now.Add(time.Second))
+	c.add([]string{"c"}, now.Add(2*time.Second))
+
+	now = now.Add(3 * time.Second)
+	assert.True(t, c.contains("a", now))
+	assert.False(t, c.contains("b", now))
+	assert.True(t, c.contains("c", now))
+
+	// "a" expires first, since it was seen before "c".
+	now = now.Add(time.Minute - 2*time.Second)
+	assert.False(t, c.contains("a", now))
+	assert.True(t, c.contains("c", now))
+}
@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"unicode/utf8"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+const (
+	// DLQOriginalTopicHeader is the record header key which holds the topic
+	// of the record a dead-lettered record was created from, see
+	// DeadLetterRecord.
+	DLQOriginalTopicHeader = "dlq-original-topic"
+	// DLQErrorHeader is the record header key which holds the error which
+	// caused a record to be dead-lettered, truncated to MaxDLQErrorLength
+	// bytes, see DeadLetterRecord.
+	DLQErrorHeader = "dlq-error"
+)
+
+// MaxDLQErrorLength is the maximum length in bytes of the error message held
+// in the DLQErrorHeader.
+const MaxDLQErrorLength = 1024
+
+// DeadLetterRecord returns a copy of the record to be produced to the dead
+// letter queue topic, with the DLQOriginalTopicHeader and DLQErrorHeader
+// headers set to the topic of the record and the error which caused it to be
+// dead-lettered, so operators can triage the dead letter queue. The headers
+// replace the ones of a record which was already dead-lettered. The rest of
+// the headers, the key and the value are kept.
+//
+// There's no built-in dead letter queue: the record is meant to be produced
+// with Producer.ProduceRecords, for example, by a consumer for the records it
+// fails to process. For the records which fail to be produced, the
+// ErrorHandler can build the dead letter records, but mustn't produce them
+// itself: it must not block, and it runs while Close and Shutdown fail the
+// buffered records, when the producer rejects new records. Hand the records
+// off to a separate goroutine instead, for example, through a buffered
+// channel, which produces them, preferably with a different producer.
+func DeadLetterRecord(r *kgo.Record, topic apmqueue.Topic, err error) kgo.Record {
+	headers := make([]kgo.RecordHeader, 0, len(r.Headers)+2)
+	for _, h := range r.Headers {
+		if h.Key != DLQOriginalTopicHeader && h.Key != DLQErrorHeader {
+			headers = append(headers, h)
+		}
+	}
+	var msg string
+	if err != nil {
+		msg = truncateUTF8(err.Error(), MaxDLQErrorLength)
+	}
+	headers = append(headers,
+		kgo.RecordHeader{Key: DLQOriginalTopicHeader, Value: []byte(r.Topic)},
+		kgo.RecordHeader{Key: DLQErrorHeader, Value: []byte(msg)},
+	)
+	return kgo.Record{
+		Topic:   string(topic),
+		Key:     r.Key,
+		Value:   r.Value,
+		Headers: headers,
+	}
+}
+
+// truncateUTF8 truncates s to at most n bytes, without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for len(s) > 0 {
+		if r, size := utf8.DecodeLastRuneInString(s); r != utf8.RuneError || size != 1 {
+			break
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
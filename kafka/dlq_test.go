@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestDeadLetterRecord(t *testing.T) {
+	original := &kgo.Record{
+		Topic:   "events",
+		Key:     []byte("key"),
+		Value:   []byte("value"),
+		Headers: []kgo.RecordHeader{{Key: "a", Value: []byte("b")}},
+	}
+	err := errors.New(strings.Repeat("x", MaxDLQErrorLength+100))
+	dlq := DeadLetterRecord(original, "events-dlq", err)
+	assert.Equal(t, kgo.Record{
+		Topic: "events-dlq",
+		Key:   []byte("key"),
+		Value: []byte("value"),
+		Headers: []kgo.RecordHeader{
+			{Key: "a", Value: []byte("b")},
+			{Key: DLQOriginalTopicHeader, Value: []byte("events")},
+			{Key: DLQErrorHeader, Value: []byte(strings.Repeat("x", MaxDLQErrorLength))},
+		},
+	}, dlq)
+	// The original record isn't modified.
+	assert.Equal(t, []kgo.RecordHeader{{Key: "a", Value: []byte("b")}}, original.Headers)
+
+	// Dead-lettering a dead-lettered record replaces the headers.
+	again := DeadLetterRecord(&dlq, "events-dlq-2", errors.New("failed again"))
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "a", Value: []byte("b")},
+		{Key: DLQOriginalTopicHeader, Value: []byte("events-dlq")},
+		{Key: DLQErrorHeader, Value: []byte("failed again")},
+	}, again.Headers)
+}
+
+func TestDeadLetterRecordTruncatesRunes(t *testing.T) {
+	// The last rune doesn't fit, and isn't split.
+	msg := strings.Repeat("x", MaxDLQErrorLength-1) + "é"
+	dlq := DeadLetterRecord(&kgo.Record{Topic: "events"}, "dlq", errors.New(msg))
+	value := dlq.Headers[len(dlq.Headers)-1].Value
+	assert.Equal(t, MaxDLQErrorLength-1, len(value))
+	assert.True(t, utf8.Valid(value))
+}
@@ -0,0 +1,145 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+// drainPollInterval is the interval at which Shutdown checks the age of the
+// pending records when ProducerConfig.DrainMaxAge is set.
+const drainPollInterval = 10 * time.Millisecond
+
+// drainTracker tracks the time at which the pending records were passed to
+// the clients, so Shutdown can tell when only records older than
+// ProducerConfig.DrainMaxAge are left.
+type drainTracker struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]time.Time
+}
+
+func newDrainTracker() *drainTracker {
+	return &drainTracker{pending: make(map[uint64]time.Time)}
+}
+
+// add tracks a record passed to a client at now, returning its id.
+func (t *drainTracker) add(now time.Time) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := t.next
+	t.next++
+	t.pending[id] = now
+	return id
+}
+
+// remove stops tracking the record with the id, once produced or failed.
+func (t *drainTracker) remove(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, id)
+}
+
+// newest returns the number of pending records, and the time at which the
+// newest of them was passed to a client.
+func (t *drainTracker) newest() (int, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var newest time.Time
+	for _, added := range t.pending {
+		if added.After(newest) {
+			newest = added
+		}
+	}
+	return len(t.pending), newest
+}
+
+// flush waits until the records buffered by the clients have been produced,
+// or ctx is done. When cfg.DrainMaxAge is set, it stops waiting as soon as
+// all the pending records are older than it, abandoning them.
+func (p *Producer) flush(ctx context.Context) []error {
+	clients := make([]*kgo.Client, 0, 1+len(p.ackClients))
+	clients = append(clients, p.client)
+	for _, client := range p.ackClients {
+		clients = append(clients, client)
+	}
+	if p.drain == nil {
+		var errs []error
+		for _, client := range clients {
+			if err := client.Flush(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("kafka: failed flushing records: %w", err))
+			}
+		}
+		return errs
+	}
+
+	flushCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	flushErrs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	wg.Add(len(clients))
+	for i, client := range clients {
+		go func(i int, client *kgo.Client) {
+			defer wg.Done()
+			flushErrs[i] = client.Flush(flushCtx)
+		}(i, client)
+	}
+	flushed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(flushed)
+	}()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case <-flushed:
+			break wait
+		case <-ticker.C:
+			n, newest := p.drain.newest()
+			if n > 0 && p.clock().Sub(newest) >= p.cfg.DrainMaxAge {
+				p.cfg.Logger.Warn("abandoning pending records older than the drain max age",
+					zap.Int("records", n),
+					zap.Duration("drain_max_age", p.cfg.DrainMaxAge),
+				)
+				break wait
+			}
+		}
+	}
+	cancel()
+	<-flushed
+
+	var errs []error
+	for _, err := range flushErrs {
+		// The flush is canceled once only old records are left, which
+		// isn't an error, unless ctx is done too.
+		if err != nil && (ctx.Err() != nil || !errors.Is(err, context.Canceled)) {
+			errs = append(errs, fmt.Errorf("kafka: failed flushing records: %w", err))
+		}
+	}
+	return errs
+}
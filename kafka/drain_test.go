@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerShutdownDrainMaxAge(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		DrainMaxAge: time.Minute,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Simulate an old record stuck in the client, which never completes.
+	producer.drain.add(time.Now().Add(-time.Hour))
+	batch := model.Batch{{Transaction: &model.Transaction{ID: "fresh"}}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.NoError(t, producer.Shutdown(ctx))
+
+	client.AddConsumeTopics(topic)
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+	var event model.APMEvent
+	require.NoError(t, json.JSON{}.Decode(records[0].Value, &event))
+	assert.Equal(t, "fresh", event.Transaction.ID)
+}
+
+func TestProducerShutdownDrainMaxAgeAbandons(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the records are stuck.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		DrainMaxAge: time.Minute,
+	})
+	require.NoError(t, err)
+	clock := newFakeClock(time.Now())
+	setClock(producer, clock.Now)
+
+	ctx := context.Background()
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+	clock.Advance(2 * time.Minute)
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+
+	done := make(chan error, 1)
+	go func() { done <- producer.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown completed before the fresh record is old: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "kafka: 2 records failed to be produced during shutdown")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the shutdown to abandon the records")
+	}
+}
+
+func TestProducerDrainMaxAgeConfig(t *testing.T) {
+	err := ProducerConfig{DrainMaxAge: -time.Second}.Validate()
+	assert.ErrorContains(t, err, "kafka: drain max age cannot be negative")
+}
@@ -0,0 +1,185 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+
+	saslplain "github.com/elastic/apm-queue/kafka/sasl/plain"
+)
+
+// Environment variables read by ConfigFromEnv.
+const (
+	// EnvBrokers holds a comma-separated list of (host:port) broker addresses.
+	EnvBrokers = "KAFKA_BROKERS"
+	// EnvClientID holds the client ID.
+	EnvClientID = "KAFKA_CLIENT_ID"
+	// EnvVersion holds the software version.
+	EnvVersion = "KAFKA_VERSION"
+	// EnvSASLMechanism holds the SASL mechanism. One of PLAIN, SCRAM-SHA-256
+	// or SCRAM-SHA-512. SASL is disabled when unset.
+	EnvSASLMechanism = "KAFKA_SASL_MECHANISM"
+	// EnvSASLUsername holds the SASL username.
+	EnvSASLUsername = "KAFKA_SASL_USERNAME"
+	// EnvSASLPassword holds the SASL password.
+	EnvSASLPassword = "KAFKA_SASL_PASSWORD"
+	// EnvTLSEnabled enables TLS when set to a true boolean value.
+	EnvTLSEnabled = "KAFKA_TLS_ENABLED"
+	// EnvTLSInsecureSkipVerify disables the server certificate verification
+	// when set to a true boolean value.
+	EnvTLSInsecureSkipVerify = "KAFKA_TLS_INSECURE_SKIP_VERIFY"
+	// EnvTLSCAFile holds the path to a PEM encoded CA certificate file used
+	// to verify the server certificates.
+	EnvTLSCAFile = "KAFKA_TLS_CA_FILE"
+	// EnvCompression holds a comma-separated list of compression codecs, in
+	// order of preference. One of none, gzip, snappy, lz4 or zstd.
+	EnvCompression = "KAFKA_COMPRESSION"
+)
+
+// ConfigFromEnv returns a ProducerConfig populated from the environment
+// variables documented in the Env* constants. Only the connection settings
+// are populated; fields which can't be expressed as environment variables,
+// such as the Encoder, TopicRouter or Logger, must be set by the caller.
+//
+// Setting any of the TLS environment variables other than EnvTLSEnabled
+// implicitly enables TLS.
+func ConfigFromEnv() (ProducerConfig, error) {
+	var cfg ProducerConfig
+	var errs []error
+	if v := os.Getenv(EnvBrokers); v != "" {
+		for _, broker := range strings.Split(v, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				cfg.Brokers = append(cfg.Brokers, broker)
+			}
+		}
+	}
+	if len(cfg.Brokers) == 0 {
+		errs = append(errs, fmt.Errorf("kafka: %s must be set", EnvBrokers))
+	}
+	cfg.ClientID = os.Getenv(EnvClientID)
+	cfg.Version = os.Getenv(EnvVersion)
+
+	if mechanism := os.Getenv(EnvSASLMechanism); mechanism != "" {
+		user := os.Getenv(EnvSASLUsername)
+		pass := os.Getenv(EnvSASLPassword)
+		if user == "" || pass == "" {
+			errs = append(errs, fmt.Errorf("kafka: %s and %s must be set when %s is set",
+				EnvSASLUsername, EnvSASLPassword, EnvSASLMechanism,
+			))
+		}
+		switch strings.ToUpper(mechanism) {
+		case "PLAIN":
+			cfg.SASL = saslplain.New(saslplain.Plain{User: user, Pass: pass})
+		case "SCRAM-SHA-256":
+			cfg.SASL = scram.Sha256(func(context.Context) (scram.Auth, error) {
+				return scram.Auth{User: user, Pass: pass}, nil
+			})
+		case "SCRAM-SHA-512":
+			cfg.SASL = scram.Sha512(func(context.Context) (scram.Auth, error) {
+				return scram.Auth{User: user, Pass: pass}, nil
+			})
+		default:
+			errs = append(errs, fmt.Errorf("kafka: unsupported %s %q", EnvSASLMechanism, mechanism))
+		}
+	}
+
+	tlsEnabled, err := envBool(EnvTLSEnabled)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	insecure, err := envBool(EnvTLSInsecureSkipVerify)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	caFile := os.Getenv(EnvTLSCAFile)
+	if tlsEnabled || insecure || caFile != "" {
+		cfg.TLS = &tls.Config{InsecureSkipVerify: insecure}
+		if caFile != "" {
+			pool, err := loadCertPool(caFile)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			cfg.TLS.RootCAs = pool
+		}
+	}
+
+	if v := os.Getenv(EnvCompression); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			codec, err := compressionCodec(strings.TrimSpace(name))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			cfg.CompressionCodec = append(cfg.CompressionCodec, codec)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return ProducerConfig{}, err
+	}
+	return cfg, nil
+}
+
+func envBool(key string) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("kafka: invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed reading %s: %w", EnvTLSCAFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("kafka: no valid certificates found in %s %q", EnvTLSCAFile, path)
+	}
+	return pool, nil
+}
+
+func compressionCodec(name string) (kgo.CompressionCodec, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return kgo.NoCompression(), nil
+	case "gzip":
+		return kgo.GzipCompression(), nil
+	case "snappy":
+		return kgo.SnappyCompression(), nil
+	case "lz4":
+		return kgo.Lz4Compression(), nil
+	case "zstd":
+		return kgo.ZstdCompression(), nil
+	}
+	return kgo.CompressionCodec{}, fmt.Errorf("kafka: unsupported %s %q", EnvCompression, name)
+}
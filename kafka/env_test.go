@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv(EnvBrokers, "broker-1:9092, broker-2:9092")
+	t.Setenv(EnvClientID, "client")
+	t.Setenv(EnvVersion, "1.2.3")
+	t.Setenv(EnvSASLMechanism, "SCRAM-SHA-512")
+	t.Setenv(EnvSASLUsername, "user")
+	t.Setenv(EnvSASLPassword, "pass")
+	t.Setenv(EnvTLSInsecureSkipVerify, "true")
+	t.Setenv(EnvCompression, "zstd,gzip")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"broker-1:9092", "broker-2:9092"}, cfg.Brokers)
+	assert.Equal(t, "client", cfg.ClientID)
+	assert.Equal(t, "1.2.3", cfg.Version)
+	require.NotNil(t, cfg.SASL)
+	assert.Equal(t, "SCRAM-SHA-512", cfg.SASL.Name())
+	require.NotNil(t, cfg.TLS)
+	assert.True(t, cfg.TLS.InsecureSkipVerify)
+	assert.Equal(t, []kgo.CompressionCodec{
+		kgo.ZstdCompression(), kgo.GzipCompression(),
+	}, cfg.CompressionCodec)
+	assert.Nil(t, cfg.Encoder)
+	assert.Nil(t, cfg.TopicRouter)
+	assert.Nil(t, cfg.Logger)
+}
+
+func TestConfigFromEnvMinimal(t *testing.T) {
+	t.Setenv(EnvBrokers, "localhost:9092")
+
+	cfg, err := ConfigFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, ProducerConfig{Brokers: []string{"localhost:9092"}}, cfg)
+}
+
+func TestConfigFromEnvInvalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		env    map[string]string
+		errMsg string
+	}{
+		"no brokers": {
+			errMsg: "kafka: KAFKA_BROKERS must be set",
+		},
+		"unsupported sasl mechanism": {
+			env: map[string]string{
+				EnvSASLMechanism: "GSSAPI",
+				EnvSASLUsername:  "user",
+				EnvSASLPassword:  "pass",
+			},
+			errMsg: `kafka: unsupported KAFKA_SASL_MECHANISM "GSSAPI"`,
+		},
+		"sasl missing password": {
+			env: map[string]string{
+				EnvSASLMechanism: "PLAIN",
+				EnvSASLUsername:  "user",
+			},
+			errMsg: "kafka: KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD must be set when KAFKA_SASL_MECHANISM is set",
+		},
+		"invalid tls bool": {
+			env:    map[string]string{EnvTLSEnabled: "yes please"},
+			errMsg: `kafka: invalid KAFKA_TLS_ENABLED "yes please"`,
+		},
+		"missing ca file": {
+			env:    map[string]string{EnvTLSCAFile: "/does/not/exist.pem"},
+			errMsg: "kafka: failed reading KAFKA_TLS_CA_FILE",
+		},
+		"unsupported compression": {
+			env:    map[string]string{EnvCompression: "gzip,brotli"},
+			errMsg: `kafka: unsupported KAFKA_COMPRESSION "brotli"`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := tc.env[EnvBrokers]; !ok && name != "no brokers" {
+				t.Setenv(EnvBrokers, "localhost:9092")
+			}
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			_, err := ConfigFromEnv()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.errMsg)
+		})
+	}
+}
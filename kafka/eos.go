@@ -0,0 +1,170 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// RunEOS consumes the records of cfg.Topics as part of the cfg.GroupID
+// consumer group, transforms the decoded events with transform, and produces
+// the transformed events with producer, until ctx is done or an error occurs.
+//
+// Each polled batch of records is processed in a Kafka transaction using
+// cfg.TransactionalID, which atomically produces the transformed events and
+// commits the offsets of the consumed records, providing exactly-once
+// semantics: if RunEOS stops or crashes before the transaction commits, the
+// transaction is aborted, and the records are consumed again. A partition
+// rebalance also aborts the ongoing transaction. The transformed records are
+// only visible to consumers reading committed records.
+//
+// The guarantee is limited to the records read from and written to Kafka: any
+// side effects of transform may happen more than once, and records which fail
+// to be decoded are skipped. The Producer is only used to build the records,
+// applying its TopicRouter, Encoder and the rest of its configuration, which
+// are produced by a dedicated transactional client, so its Sync, Spooler and
+// DurabilityByTopic options, among others, have no effect. The Processor,
+// Delivery, ProcessTimeout and HeaderAllowlist options of cfg are ignored.
+//
+// Transactions require Kafka 0.11+, and Kafka 2.5+ is recommended.
+func RunEOS(ctx context.Context, cfg ConsumerConfig, producer *Producer, transform func(model.Batch) model.Batch) error {
+	return runEOS(ctx, cfg, producer, transform, nil)
+}
+
+// runEOS implements RunEOS. beforeCommit, if not nil, is called after the
+// records of a transaction have been produced, before committing it. If it
+// returns an error, runEOS returns it without ending the transaction, which
+// allows tests to simulate a crash.
+func runEOS(ctx context.Context,
+	cfg ConsumerConfig,
+	producer *Producer,
+	transform func(model.Batch) model.Batch,
+	beforeCommit func() error,
+) error {
+	errs := cfg.validate()
+	if cfg.TransactionalID == "" {
+		errs = append(errs, errors.New("kafka: transactional ID must be set"))
+	}
+	if producer == nil {
+		errs = append(errs, errors.New("kafka: producer must be set"))
+	}
+	if transform == nil {
+		errs = append(errs, errors.New("kafka: transform must be set"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("kafka: invalid consumer config: %w", err)
+	}
+	if cfg.MaxPollRecords <= 0 {
+		cfg.MaxPollRecords = 100
+	}
+	sess, err := kgo.NewGroupTransactSession(append(cfg.clientOpts(),
+		kgo.TransactionalID(cfg.TransactionalID),
+		// Only consume the records of committed transactions, and wait for
+		// the offsets of pending transactions to be committed.
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+		kgo.RequireStableFetchOffsets(),
+	)...)
+	if err != nil {
+		return fmt.Errorf("kafka: failed creating transact session: %w", err)
+	}
+	defer sess.Close()
+
+	logger := cfg.Logger.Named("eos")
+	for {
+		fetches := sess.PollRecords(ctx, cfg.MaxPollRecords)
+		if fetches.IsClientClosed() {
+			return fmt.Errorf("client is closed: %w", context.Canceled)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fetches.EachError(func(t string, p int32, err error) {
+			logger.Error("consumer fetches returned error",
+				zap.Error(err), zap.String("topic", t), zap.Int32("partition", p),
+			)
+		})
+		if fetches.NumRecords() == 0 {
+			continue
+		}
+
+		batch := make(model.Batch, 0, fetches.NumRecords())
+		fetches.EachRecord(func(r *kgo.Record) {
+			if cfg.DropExpired && RecordExpired(r, time.Now()) {
+				return
+			}
+			var event model.APMEvent
+			if err := cfg.Decoder.Decode(r.Value, &event); err != nil {
+				logger.Error("unable to decode message.Value into model.APMEvent",
+					zap.Error(err),
+					zap.String("topic", r.Topic),
+					zap.Int32("partition", r.Partition),
+					zap.Int64("offset", r.Offset),
+				)
+				return
+			}
+			batch = append(batch, event)
+		})
+		if err := sess.Begin(); err != nil {
+			return fmt.Errorf("kafka: failed beginning transaction: %w", err)
+		}
+		if err := produceTransformed(ctx, sess, producer, transform(batch)); err != nil {
+			if _, endErr := sess.End(ctx, kgo.TryAbort); endErr != nil {
+				err = errors.Join(err, fmt.Errorf("kafka: failed aborting transaction: %w", endErr))
+			}
+			return err
+		}
+		if beforeCommit != nil {
+			if err := beforeCommit(); err != nil {
+				return err
+			}
+		}
+		committed, err := sess.End(ctx, kgo.TryCommit)
+		if err != nil {
+			return fmt.Errorf("kafka: failed committing transaction: %w", err)
+		}
+		if !committed {
+			// The partitions were rebalanced, so the transaction was aborted,
+			// and the records will be consumed again.
+			logger.Info("transaction aborted due to a rebalance")
+		}
+	}
+}
+
+// produceTransformed produces the records built by producer for batch within
+// the ongoing transaction of sess.
+func produceTransformed(ctx context.Context, sess *kgo.GroupTransactSession, producer *Producer, batch model.Batch) error {
+	records, err := producer.BuildRecords(ctx, &batch)
+	if err != nil {
+		return fmt.Errorf("kafka: failed building records: %w", err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := sess.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		return fmt.Errorf("kafka: failed producing records: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestRunEOSInvalidConfig(t *testing.T) {
+	err := RunEOS(context.Background(), ConsumerConfig{}, nil, nil)
+	assert.ErrorContains(t, err, "kafka: transactional ID must be set")
+	assert.ErrorContains(t, err, "kafka: producer must be set")
+	assert.ErrorContains(t, err, "kafka: transform must be set")
+	assert.NotContains(t, err.Error(), "processor")
+}
+
+func TestRunEOSCrashBeforeCommit(t *testing.T) {
+	in, out := "in-topic", "out-topic"
+	client, brokers := newClusterWithTopics(t, in, out)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ids := []string{"1", "2", "3"}
+	for _, id := range ids {
+		value, err := json.JSON{}.Encode(model.APMEvent{
+			Transaction: &model.Transaction{ID: id},
+		})
+		require.NoError(t, err)
+		require.NoError(t, client.ProduceSync(ctx, &kgo.Record{
+			Topic: in, Value: value,
+		}).FirstErr())
+	}
+
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(out)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	cfg := ConsumerConfig{
+		Brokers:         brokers,
+		Topics:          []string{in},
+		GroupID:         "eos",
+		Decoder:         json.JSON{},
+		Logger:          zap.NewNop(),
+		AutoOffsetReset: OffsetResetEarliest,
+		TransactionalID: "eos-1",
+	}
+	transform := func(batch model.Batch) model.Batch {
+		for i := range batch {
+			batch[i].Transaction.Name = "transformed"
+		}
+		return batch
+	}
+
+	// Crash after producing the transformed records, before committing them
+	// along with the consumed offsets.
+	errCrash := errors.New("crash")
+	assert.ErrorIs(t, runEOS(ctx, cfg, producer, transform, func() error {
+		return errCrash
+	}), errCrash)
+
+	// Restarting with the same transactional ID aborts the pending
+	// transaction, and consumes the records again.
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- RunEOS(runCtx, cfg, producer, transform) }()
+	defer func() {
+		runCancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	}()
+
+	reader, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumeTopics(out),
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+	)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	var events []model.APMEvent
+	for len(events) < len(ids) {
+		fetches := reader.PollRecords(ctx, len(ids))
+		require.NoError(t, fetches.Err())
+		fetches.EachRecord(func(r *kgo.Record) {
+			var event model.APMEvent
+			require.NoError(t, json.JSON{}.Decode(r.Value, &event))
+			events = append(events, event)
+		})
+	}
+	// No duplicates are read from the aborted transaction.
+	pollCtx, pollCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer pollCancel()
+	assert.Zero(t, reader.PollRecords(pollCtx, 1).NumRecords())
+
+	var got []string
+	for _, event := range events {
+		assert.Equal(t, "transformed", event.Transaction.Name)
+		got = append(got, event.Transaction.ID)
+	}
+	assert.ElementsMatch(t, ids, got)
+}
@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	// ErrorClassFatal is the class of the errors which won't succeed if the
+	// record is produced again, for example, authorization errors or records
+	// exceeding the maximum size accepted by the brokers.
+	ErrorClassFatal ErrorClass = iota
+	// ErrorClassRetryable is the class of the transient errors, which may
+	// succeed if the record is produced again, for example, when a partition
+	// leader election is in progress or the request timed out.
+	ErrorClassRetryable
+	// ErrorClassThrottled is the class of the errors caused by the brokers
+	// or the producer applying backpressure. The record may be produced
+	// again after backing off.
+	ErrorClassThrottled
+)
+
+// ErrorClass classifies the errors which cause records to fail to be
+// produced, see ClassifyProduceError.
+type ErrorClass uint8
+
+// String returns the name of the error class.
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassFatal:
+		return "fatal"
+	case ErrorClassRetryable:
+		return "retryable"
+	case ErrorClassThrottled:
+		return "throttled"
+	}
+	return "unknown"
+}
+
+// ClassifyProduceError returns the class of an error which caused a record to
+// fail to be produced. The errors are classified as follows:
+//
+//   - ErrorClassThrottled: kerr.ThrottlingQuotaExceeded, and kgo.ErrMaxBuffered.
+//   - ErrorClassRetryable: the kerr errors which Kafka considers retriable,
+//     such as kerr.NotLeaderForPartition or kerr.RequestTimedOut, records
+//     which timed out or exhausted their retries (kgo.ErrRecordTimeout and
+//     kgo.ErrRecordRetries), and context.DeadlineExceeded.
+//   - ErrorClassFatal: any other error, such as the kerr errors which aren't
+//     retriable, like kerr.TopicAuthorizationFailed or kerr.MessageTooLarge,
+//     kgo.ErrClientClosed, and context.Canceled.
+func ClassifyProduceError(err error) ErrorClass {
+	switch {
+	case errors.Is(err, kerr.ThrottlingQuotaExceeded),
+		errors.Is(err, kgo.ErrMaxBuffered):
+		return ErrorClassThrottled
+	case errors.Is(err, kgo.ErrRecordTimeout),
+		errors.Is(err, kgo.ErrRecordRetries),
+		errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassRetryable
+	}
+	var kerrErr *kerr.Error
+	if errors.As(err, &kerrErr) && kerrErr.Retriable {
+		return ErrorClassRetryable
+	}
+	return ErrorClassFatal
+}
@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestClassifyProduceError(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{err: kerr.ThrottlingQuotaExceeded, expected: ErrorClassThrottled},
+		{err: kgo.ErrMaxBuffered, expected: ErrorClassThrottled},
+		{err: kerr.NotLeaderForPartition, expected: ErrorClassRetryable},
+		{err: kerr.LeaderNotAvailable, expected: ErrorClassRetryable},
+		{err: kerr.RequestTimedOut, expected: ErrorClassRetryable},
+		{err: kgo.ErrRecordTimeout, expected: ErrorClassRetryable},
+		{err: kgo.ErrRecordRetries, expected: ErrorClassRetryable},
+		{err: context.DeadlineExceeded, expected: ErrorClassRetryable},
+		{err: kerr.TopicAuthorizationFailed, expected: ErrorClassFatal},
+		{err: kerr.MessageTooLarge, expected: ErrorClassFatal},
+		{err: kerr.InvalidRecord, expected: ErrorClassFatal},
+		{err: kgo.ErrClientClosed, expected: ErrorClassFatal},
+		{err: context.Canceled, expected: ErrorClassFatal},
+		{err: errors.New("unknown"), expected: ErrorClassFatal},
+		// Wrapped errors are classified too.
+		{err: fmt.Errorf("failed: %w", kerr.NotLeaderForPartition), expected: ErrorClassRetryable},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			assert.Equal(t, tc.expected, ClassifyProduceError(tc.err))
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// ProduceFuture is the result of producing a record with ProcessBatchAsync,
+// which is available once the record is produced, or fails to be. It's safe
+// for concurrent use: Wait may be called from multiple goroutines, and any
+// number of times.
+type ProduceFuture struct {
+	result *produceResult
+}
+
+// produceResult holds the outcome of producing a record, which is set before
+// done is closed.
+type produceResult struct {
+	done      chan struct{}
+	partition int32
+	offset    int64
+	err       error
+}
+
+// failedFuture returns a ProduceFuture which has already failed with err.
+func failedFuture(err error) ProduceFuture {
+	result := &produceResult{done: make(chan struct{}), partition: -1, offset: -1, err: err}
+	close(result.done)
+	return ProduceFuture{result: result}
+}
+
+// Wait blocks until the record is produced, and returns the partition and the
+// offset it was produced to, or the error producing it. If ctx is done first,
+// Wait returns ctx.Err(), but the record may still be produced: Wait can be
+// called again to get its result.
+func (f ProduceFuture) Wait(ctx context.Context) (partition int32, offset int64, err error) {
+	select {
+	case <-f.result.done:
+		return f.result.partition, f.result.offset, f.result.err
+	case <-ctx.Done():
+		return -1, -1, ctx.Err()
+	}
+}
+
+// ProcessBatchAsync publishes the events in batch like ProcessBatch, but
+// returns a ProduceFuture for each produced record instead of waiting for
+// them, regardless of Sync and AdaptiveSyncThreshold, so the caller can wait
+// for the records it's interested in. The futures are in the order of the
+// records: events which are dropped have none, and events routed to multiple
+// topics have one per topic.
+//
+// If the batch can't be produced, for example, because the producer is closed
+// or building a record fails, no record is produced, and a single future
+// failing with the error is returned.
+//
+// The futures are resolved by the produce callbacks, right before the failed
+// records are logged and handled. Closing the producer fails the records
+// which are still buffered, and all the futures are resolved once Close or
+// Shutdown return.
+func (p *Producer) ProcessBatchAsync(ctx context.Context, batch *model.Batch) []ProduceFuture {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return []ProduceFuture{failedFuture(err)}
+	}
+	defer p.recordActivity()
+	p.recordBatchEvents(batch)
+	records, err := p.prepareBatch(ctx, batch)
+	if err != nil {
+		return []ProduceFuture{failedFuture(err)}
+	}
+	// The futures are waited on instead of wg.
+	var wg sync.WaitGroup
+	wg.Add(len(records))
+	futures := make([]ProduceFuture, 0, len(records))
+	for _, record := range records {
+		result := &produceResult{done: make(chan struct{})}
+		futures = append(futures, ProduceFuture{result: result})
+		callback := p.produceCallback(&wg)
+		p.recordSize(record)
+		p.produce(ctx, record, func(r *kgo.Record, err error) {
+			// Resolve the future before the callback marks the record as
+			// no longer in flight, which Close waits for.
+			result.partition, result.offset, result.err = r.Partition, r.Offset, err
+			close(result.done)
+			callback(r, err)
+		})
+	}
+	return futures
+}
@@ -0,0 +1,127 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerProcessBatchAsync(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var batch model.Batch
+	for i := 0; i < 3; i++ {
+		batch = append(batch, model.APMEvent{
+			Transaction: &model.Transaction{ID: fmt.Sprint(i)},
+		})
+	}
+	futures := producer.ProcessBatchAsync(ctx, &batch)
+	require.Len(t, futures, len(batch))
+
+	// Wait for the futures out of order, and more than once.
+	type position struct {
+		partition int32
+		offset    int64
+	}
+	produced := make(map[position]string)
+	for _, i := range []int{2, 0, 1, 2} {
+		partition, offset, err := futures[i].Wait(ctx)
+		require.NoError(t, err)
+		produced[position{partition, offset}] = fmt.Sprint(i)
+	}
+	require.Len(t, produced, len(batch))
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	for _, r := range records {
+		var event model.APMEvent
+		require.NoError(t, json.JSON{}.Decode(r.Value, &event))
+		assert.Equal(t, produced[position{r.Partition, r.Offset}], event.Transaction.ID)
+	}
+}
+
+func TestProducerProcessBatchAsyncFailed(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the records are buffered until
+		// the producer is closed.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+
+	batch := model.Batch{{}, {}}
+	futures := producer.ProcessBatchAsync(context.Background(), &batch)
+	require.Len(t, futures, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = futures[0].Wait(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Closing the producer fails the buffered records, and resolves all the
+	// futures before Close returns.
+	producer.Close()
+	for _, f := range futures {
+		select {
+		case <-f.result.done:
+		default:
+			t.Fatal("future not resolved once Close returned")
+		}
+		assert.ErrorIs(t, f.result.err, kgo.ErrClientClosed)
+	}
+
+	// Once closed, a single failed future is returned.
+	futures = producer.ProcessBatchAsync(context.Background(), &batch)
+	require.Len(t, futures, 1)
+	_, _, err = futures[0].Wait(context.Background())
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package keyrouter provides helpers to build the record key router of the
+// Kafka producer, see kafka.ProducerConfig.KeyRouter.
+package keyrouter
+
+import (
+	"strings"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// Separator is the separator of the fields joined by Composite.
+const Separator = "|"
+
+// Field extracts a field from an event, used as part of a record key.
+type Field func(model.APMEvent) string
+
+// Composite returns a key router which joins the fields extracted from the
+// event with Separator, for example, "<service-name>|<environment>". Since
+// the fields are joined as is, fields holding the separator may make the keys
+// of distinct events collide.
+//
+// Nil fields and fields extracted as empty strings are kept as empty parts of
+// the key, so each field keeps its position in it. When all the fields are
+// empty, an empty key is returned, so the record has no key.
+func Composite(fields ...Field) func(model.APMEvent) string {
+	return func(event model.APMEvent) string {
+		empty := true
+		parts := make([]string, len(fields))
+		for i, field := range fields {
+			if field == nil {
+				continue
+			}
+			if parts[i] = field(event); parts[i] != "" {
+				empty = false
+			}
+		}
+		if empty {
+			return ""
+		}
+		return strings.Join(parts, Separator)
+	}
+}
+
+// ServiceName extracts the service name of the event.
+func ServiceName(event model.APMEvent) string {
+	return event.Service.Name
+}
+
+// ServiceEnvironment extracts the service environment of the event.
+func ServiceEnvironment(event model.APMEvent) string {
+	return event.Service.Environment
+}
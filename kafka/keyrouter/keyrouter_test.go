@@ -0,0 +1,60 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package keyrouter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestComposite(t *testing.T) {
+	router := Composite(ServiceName, nil, ServiceEnvironment)
+	assert.Equal(t, "api||production", router(model.APMEvent{
+		Service: model.Service{Name: "api", Environment: "production"},
+	}))
+	assert.Equal(t, "||production", router(model.APMEvent{
+		Service: model.Service{Environment: "production"},
+	}))
+	assert.Equal(t, "", router(model.APMEvent{}))
+	assert.Equal(t, "", Composite()(model.APMEvent{}))
+}
+
+func TestCompositeSharesPartition(t *testing.T) {
+	router := Composite(ServiceName, ServiceEnvironment)
+	events := []model.APMEvent{
+		{Service: model.Service{Name: "api", Environment: "production"}, Transaction: &model.Transaction{ID: "1"}},
+		{Service: model.Service{Name: "api", Environment: "production"}, Span: &model.Span{ID: "2"}},
+		{Service: model.Service{Name: "api", Environment: "staging"}},
+	}
+	// Like the producer's default partitioner, the sticky key partitioner
+	// hashes the keys of the records with murmur2.
+	partitioner := kgo.StickyKeyPartitioner(nil).ForTopic("topic")
+	partitions := make([]int, len(events))
+	for i, event := range events {
+		partitions[i] = partitioner.Partition(&kgo.Record{
+			Key: []byte(router(event)),
+		}, 100)
+	}
+	assert.Equal(t, partitions[0], partitions[1])
+	assert.Equal(t, "api|production", router(events[0]))
+	assert.Equal(t, "api|staging", router(events[2]))
+}
@@ -0,0 +1,59 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// ControlMarkerHeader is the record header key which holds the marker of the
+// control marker records created by MarkerRecord.
+const ControlMarkerHeader = "control-marker"
+
+// MarkerRecord returns a control marker record for the topic, to be produced
+// with Producer.ProduceRecords alongside the data records, for example, to
+// signal the end of a batch of records to a stream processor. The record has
+// no key nor value, and holds the marker in the ControlMarkerHeader, which
+// consumers can check with RecordMarker. The Consumer skips marker records.
+//
+// Kafka control records, such as the transaction markers, are only written by
+// the brokers: the attributes of the produced records are set by the Kafka
+// client (see kgo.RecordAttrs), so a record header is the closest mechanism
+// which is supported for producers. Like any record, a marker is produced to
+// a single partition.
+func MarkerRecord(topic apmqueue.Topic, marker string) kgo.Record {
+	return kgo.Record{
+		Topic: string(topic),
+		Headers: []kgo.RecordHeader{
+			{Key: ControlMarkerHeader, Value: []byte(marker)},
+		},
+	}
+}
+
+// RecordMarker returns the marker of the record and true if it's a control
+// marker record, see MarkerRecord.
+func RecordMarker(r *kgo.Record) (string, bool) {
+	for _, h := range r.Headers {
+		if h.Key == ControlMarkerHeader {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestRecordMarker(t *testing.T) {
+	record := MarkerRecord("topic", "end-of-batch")
+	assert.Equal(t, "topic", record.Topic)
+	assert.Nil(t, record.Key)
+	assert.Nil(t, record.Value)
+	marker, ok := RecordMarker(&record)
+	assert.True(t, ok)
+	assert.Equal(t, "end-of-batch", marker)
+
+	_, ok = RecordMarker(&kgo.Record{Headers: []kgo.RecordHeader{{Key: "a"}}})
+	assert.False(t, ok)
+}
+
+func TestProducerProduceMarker(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batch := model.Batch{{Transaction: &model.Transaction{ID: "1"}}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.NoError(t, producer.ProduceRecords(ctx, []kgo.Record{
+		MarkerRecord(apmqueue.Topic(topic), "end-of-batch"),
+	}))
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < 2 {
+		fetches := client.PollRecords(ctx, 2)
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	var markers []string
+	var data int
+	for _, r := range records {
+		if marker, ok := RecordMarker(r); ok {
+			markers = append(markers, marker)
+			assert.Nil(t, r.Value)
+			continue
+		}
+		data++
+	}
+	assert.Equal(t, []string{"end-of-batch"}, markers)
+	assert.Equal(t, 1, data)
+}
@@ -0,0 +1,152 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+)
+
+// instrumentationName is the name of the meter used by the package.
+const instrumentationName = "github.com/elastic/apm-queue/kafka"
+
+// produceBlockedThreshold is the duration after which a Produce call is
+// considered to have blocked. Produce only blocks when the client's buffer
+// is full (see ProducerConfig.MaxBufferedRecords), otherwise it returns as
+// soon as the record is buffered.
+const produceBlockedThreshold = 5 * time.Millisecond
+
+// The reasons for which the Producer drops events, recorded as the reason
+// attribute of the producer.events.dropped metric.
+const (
+	// dropReasonRouted is used for events which are routed to no topics.
+	dropReasonRouted = "routed-to-drop"
+	// dropReasonExpired is used for events which expired before being
+	// produced, according to the RecordTTL.
+	dropReasonExpired = "expired"
+	// dropReasonEmpty is used for events which are encoded as empty values.
+	dropReasonEmpty = "empty"
+	// dropReasonDuplicate is used for events whose idempotency key was seen
+	// within the ProducerConfig.DedupWindow.
+	dropReasonDuplicate = "duplicate"
+	// dropReasonEncodeError is used for events which failed to be encoded,
+	// when ProducerConfig.SkipEncodeErrors is set.
+	dropReasonEncodeError = "encode-error"
+)
+
+// producerMetrics holds the instruments used by the Producer.
+type producerMetrics struct {
+	// produceBlocked counts the records which blocked for longer than
+	// produceBlockedThreshold before being buffered.
+	produceBlocked instrument.Int64Counter
+	// eventsDropped counts the events which were skipped by the producer,
+	// by reason.
+	eventsDropped instrument.Int64Counter
+	// eventsRouted counts the events routed to a topic, by topic.
+	eventsRouted instrument.Int64Counter
+	// recordSize records the size of the values of the produced records,
+	// by topic, compressed if the Encoder compresses them.
+	recordSize instrument.Int64Histogram
+	// batchEvents records the number of events of the processed batches.
+	batchEvents instrument.Int64Histogram
+	// throttleTime records the time the brokers throttled the producer for,
+	// by broker.
+	throttleTime instrument.Int64Histogram
+}
+
+func newProducerMetrics(mp metric.MeterProvider) (producerMetrics, error) {
+	if mp == nil {
+		mp = metric.NewNoopMeterProvider()
+	}
+	meter := mp.Meter(instrumentationName)
+	produceBlocked, err := meter.Int64Counter("producer.produce.blocked",
+		instrument.WithDescription("The number of records which blocked waiting for space in the producer buffer"),
+		instrument.WithUnit("1"),
+	)
+	if err != nil {
+		return producerMetrics{}, fmt.Errorf("kafka: failed creating producer metrics: %w", err)
+	}
+	eventsDropped, err := meter.Int64Counter("producer.events.dropped",
+		instrument.WithDescription("The number of events which were not produced, by reason"),
+		instrument.WithUnit("1"),
+	)
+	if err != nil {
+		return producerMetrics{}, fmt.Errorf("kafka: failed creating producer metrics: %w", err)
+	}
+	eventsRouted, err := meter.Int64Counter("producer.events.routed",
+		instrument.WithDescription("The number of events routed to a topic, by topic"),
+		instrument.WithUnit("1"),
+	)
+	if err != nil {
+		return producerMetrics{}, fmt.Errorf("kafka: failed creating producer metrics: %w", err)
+	}
+	recordSize, err := meter.Int64Histogram("producer.record.size",
+		instrument.WithDescription("The size of the encoded values of the produced records"),
+		instrument.WithUnit("By"),
+	)
+	if err != nil {
+		return producerMetrics{}, fmt.Errorf("kafka: failed creating producer metrics: %w", err)
+	}
+	batchEvents, err := meter.Int64Histogram("producer.batch.events",
+		instrument.WithDescription("The number of events in the batches passed to the producer"),
+		instrument.WithUnit("1"),
+	)
+	if err != nil {
+		return producerMetrics{}, fmt.Errorf("kafka: failed creating producer metrics: %w", err)
+	}
+	throttleTime, err := meter.Int64Histogram("producer.broker.throttle",
+		instrument.WithDescription("The time the brokers throttled the producer for, for example, when a quota is exceeded"),
+		instrument.WithUnit("ms"),
+	)
+	if err != nil {
+		return producerMetrics{}, fmt.Errorf("kafka: failed creating producer metrics: %w", err)
+	}
+	return producerMetrics{
+		produceBlocked: produceBlocked,
+		eventsDropped:  eventsDropped,
+		eventsRouted:   eventsRouted,
+		recordSize:     recordSize,
+		batchEvents:    batchEvents,
+		throttleTime:   throttleTime,
+	}, nil
+}
+
+// consumerMetrics holds the instruments used by the Consumer.
+type consumerMetrics struct {
+	// recordsRedelivered counts the consumed records whose offsets were
+	// already committed by the consumer, by topic.
+	recordsRedelivered instrument.Int64Counter
+}
+
+func newConsumerMetrics(mp metric.MeterProvider) (consumerMetrics, error) {
+	if mp == nil {
+		mp = metric.NewNoopMeterProvider()
+	}
+	meter := mp.Meter(instrumentationName)
+	recordsRedelivered, err := meter.Int64Counter("consumer.records.redelivered",
+		instrument.WithDescription("The number of records consumed again after their offsets were committed"),
+		instrument.WithUnit("1"),
+	)
+	if err != nil {
+		return consumerMetrics{}, fmt.Errorf("kafka: failed creating consumer metrics: %w", err)
+	}
+	return consumerMetrics{recordsRedelivered: recordsRedelivered}, nil
+}
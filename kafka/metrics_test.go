@@ -0,0 +1,331 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/compress"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerMetricsProduceBlocked(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the buffered records are never
+		// produced, and the buffer stays full.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		MaxBufferedRecords: 1,
+		MeterProvider:      sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	// The first record fills the buffer.
+	require.NoError(t, producer.ProcessEvent(context.Background(), model.APMEvent{}))
+	assert.NotContains(t, collectMetrics(t, reader), "producer.produce.blocked")
+
+	// The second record blocks until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "producer.produce.blocked")
+	sum, ok := metrics["producer.produce.blocked"].(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(1), sum.DataPoints[0].Value)
+	assert.Equal(t,
+		attribute.NewSet(attribute.String("topic", "topic")),
+		sum.DataPoints[0].Attributes,
+	)
+}
+
+func TestProducerMetricsEventsDropped(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		MultiTopicRouter: func(event model.APMEvent) []apmqueue.Topic {
+			if event.Span != nil {
+				return nil
+			}
+			return []apmqueue.Topic{"topic"}
+		},
+		RecordTTL: func(event model.APMEvent) time.Duration {
+			if event.Transaction != nil {
+				return -time.Second
+			}
+			return time.Minute
+		},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{
+		{Span: &model.Span{}},
+		{Span: &model.Span{}},
+		{Transaction: &model.Transaction{}},
+		{},
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "producer.events.dropped")
+	sum, ok := metrics["producer.events.dropped"].(metricdata.Sum[int64])
+	require.True(t, ok)
+	dropped := make(map[attribute.Set]int64)
+	for _, dp := range sum.DataPoints {
+		dropped[dp.Attributes] = dp.Value
+	}
+	assert.Equal(t, map[attribute.Set]int64{
+		attribute.NewSet(attribute.String("reason", "routed-to-drop")): 2,
+		attribute.NewSet(attribute.String("reason", "expired")):        1,
+	}, dropped)
+}
+
+func TestProducerMetricsEncodeErrors(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:          []string{"127.0.0.1:1"},
+		Logger:           zap.NewNop(),
+		Encoder:          spanFailingEncoder{},
+		SkipEncodeErrors: true,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{
+		{Span: &model.Span{}},
+		{Transaction: &model.Transaction{}},
+		{Span: &model.Span{}},
+	}
+	records, err := producer.BuildRecords(context.Background(), &batch)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "producer.events.dropped")
+	sum, ok := metrics["producer.events.dropped"].(metricdata.Sum[int64])
+	require.True(t, ok)
+	require.Len(t, sum.DataPoints, 1)
+	assert.Equal(t, int64(2), sum.DataPoints[0].Value)
+	assert.Equal(t,
+		attribute.NewSet(attribute.String("reason", "encode-error")),
+		sum.DataPoints[0].Attributes,
+	)
+}
+
+func TestProducerMetricsEventsRouted(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the records fail to be
+		// produced.
+		Brokers: []string{"127.0.0.1:1"},
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		MultiTopicRouter: func(event model.APMEvent) []apmqueue.Topic {
+			switch {
+			case event.Span != nil:
+				return []apmqueue.Topic{"spans", "all"}
+			case event.Transaction != nil:
+				return []apmqueue.Topic{"transactions", "all"}
+			}
+			return nil
+		},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{
+		{Span: &model.Span{}},
+		{Span: &model.Span{}},
+		{Transaction: &model.Transaction{}},
+		{},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, producer.ProcessBatch(ctx, &batch), context.DeadlineExceeded)
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "producer.events.routed")
+	sum, ok := metrics["producer.events.routed"].(metricdata.Sum[int64])
+	require.True(t, ok)
+	routed := make(map[attribute.Set]int64)
+	for _, dp := range sum.DataPoints {
+		routed[dp.Attributes] = dp.Value
+	}
+	assert.Equal(t, map[attribute.Set]int64{
+		attribute.NewSet(attribute.String("topic", "spans")):        2,
+		attribute.NewSet(attribute.String("topic", "transactions")): 1,
+		attribute.NewSet(attribute.String("topic", "all")):          3,
+	}, routed)
+}
+
+func TestProducerMetricsBatchEvents(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+
+	for _, size := range []int{1, 3, 3, 10} {
+		batch := make(model.Batch, size)
+		require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	}
+	// The batches rejected by a closed producer aren't recorded.
+	require.NoError(t, producer.Close())
+	batch := make(model.Batch, 4)
+	assert.ErrorIs(t, producer.ProcessBatch(context.Background(), &batch), ErrProducerClosed)
+	producer.ProcessBatchAsync(context.Background(), &batch)
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "producer.batch.events")
+	histogram, ok := metrics["producer.batch.events"].(metricdata.Histogram)
+	require.True(t, ok)
+	require.Len(t, histogram.DataPoints, 1)
+	dp := histogram.DataPoints[0]
+	assert.Equal(t, uint64(4), dp.Count)
+	assert.Equal(t, float64(17), dp.Sum)
+	// The default bucket boundaries are 0, 5, 10, 25, ...
+	assert.Equal(t, []uint64{0, 3, 1, 0}, dp.BucketCounts[:4])
+}
+
+func TestProducerMetricsRecordSize(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		MultiTopicRouter: func(event model.APMEvent) []apmqueue.Topic {
+			if event.Span != nil {
+				return []apmqueue.Topic{"spans"}
+			}
+			return []apmqueue.Topic{"transactions", "all"}
+		},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{
+		{Span: &model.Span{ID: "1"}},
+		{Span: &model.Span{ID: "2"}},
+		{Transaction: &model.Transaction{ID: "3"}},
+	}
+	var sizes []int64
+	for _, event := range batch {
+		encoded, err := json.JSON{}.Encode(event)
+		require.NoError(t, err)
+		sizes = append(sizes, int64(len(encoded)))
+	}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "producer.record.size")
+	histogram, ok := metrics["producer.record.size"].(metricdata.Histogram)
+	require.True(t, ok)
+	type stats struct{ count, sum int64 }
+	byTopic := make(map[attribute.Set]stats)
+	for _, dp := range histogram.DataPoints {
+		byTopic[dp.Attributes] = stats{count: int64(dp.Count), sum: int64(dp.Sum)}
+	}
+	assert.Equal(t, map[attribute.Set]stats{
+		attribute.NewSet(attribute.String("topic", "spans")):        {count: 2, sum: sizes[0] + sizes[1]},
+		attribute.NewSet(attribute.String("topic", "transactions")): {count: 1, sum: sizes[2]},
+		attribute.NewSet(attribute.String("topic", "all")):          {count: 1, sum: sizes[2]},
+	}, byTopic)
+}
+
+func TestProducerMetricsRecordSizeCompressed(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	var validated int64
+	encoder, err := compress.NewZstd(json.JSON{}, []byte("span transaction"))
+	require.NoError(t, err)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: encoder,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		OutputValidator: func(value []byte) error {
+			validated += int64(len(value))
+			return nil
+		},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{{Span: &model.Span{ID: "1"}}, {Span: &model.Span{ID: "2"}}}
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+
+	// The size of the compressed values is recorded, as the OutputValidator
+	// sees them.
+	metrics := collectMetrics(t, reader)
+	histogram, ok := metrics["producer.record.size"].(metricdata.Histogram)
+	require.True(t, ok)
+	require.Len(t, histogram.DataPoints, 1)
+	assert.Equal(t, uint64(2), histogram.DataPoints[0].Count)
+	assert.Equal(t, float64(validated), histogram.DataPoints[0].Sum)
+}
+
+// collectMetrics collects the metrics from reader, keyed by name.
+func collectMetrics(t testing.TB, reader sdkmetric.Reader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	metrics := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m.Data
+		}
+	}
+	return metrics
+}
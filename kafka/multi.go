@@ -0,0 +1,119 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/elastic/apm-data/model"
+)
+
+const (
+	// MirrorAllSuccess considers a batch successfully produced only when all
+	// the producers succeed.
+	MirrorAllSuccess MirrorPolicy = iota
+	// MirrorAnySuccess considers a batch successfully produced when at least
+	// one of the producers succeeds.
+	MirrorAnySuccess
+)
+
+// MirrorPolicy determines when MultiProducer.ProcessBatch is successful.
+//
+// The policy only applies to the errors returned synchronously by the
+// producers. A producer which isn't configured with ProducerConfig.Sync
+// returns once the records are buffered, and reports the records which fail
+// to be produced later to its own ErrorHandler, so they aren't taken into
+// account. Use synchronous producers for the policy to cover the produce
+// results.
+type MirrorPolicy uint8
+
+// MultiProducer is a model.BatchProcessor which produces every batch to all
+// of its Producers. It can be used to mirror the same events to independent
+// Kafka clusters, for example, a primary and an archive cluster.
+type MultiProducer struct {
+	policy    MirrorPolicy
+	producers []*Producer
+}
+
+// NewMultiProducer returns a new MultiProducer which produces to all the
+// given producers, using policy to determine whether ProcessBatch succeeds.
+func NewMultiProducer(policy MirrorPolicy, producers ...*Producer) (*MultiProducer, error) {
+	if len(producers) == 0 {
+		return nil, errors.New("kafka: at least one producer must be set")
+	}
+	switch policy {
+	case MirrorAllSuccess, MirrorAnySuccess:
+	default:
+		return nil, fmt.Errorf("kafka: unknown mirror policy %d", policy)
+	}
+	return &MultiProducer{policy: policy, producers: producers}, nil
+}
+
+// ProcessBatch produces the batch to all producers concurrently. The returned
+// error joins the errors of all the producers which failed, and is nil when
+// the configured MirrorPolicy is satisfied. The asynchronous produce errors
+// of the producers aren't included, see MirrorPolicy.
+func (m *MultiProducer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	return m.each(func(p *Producer) error { return p.ProcessBatch(ctx, batch) })
+}
+
+// Healthy returns an error if any of the producers isn't healthy, according
+// to the configured MirrorPolicy.
+func (m *MultiProducer) Healthy() error {
+	return m.each(func(p *Producer) error { return p.Healthy() })
+}
+
+// Close closes all the producers.
+func (m *MultiProducer) Close() error {
+	var errs []error
+	for i, p := range m.producers {
+		if err := p.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("producer %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiProducer) each(fn func(*Producer) error) error {
+	errs := make([]error, len(m.producers))
+	var wg sync.WaitGroup
+	for i, p := range m.producers {
+		wg.Add(1)
+		go func(i int, p *Producer) {
+			defer wg.Done()
+			if err := fn(p); err != nil {
+				errs[i] = fmt.Errorf("producer %d: %w", i, err)
+			}
+		}(i, p)
+	}
+	wg.Wait()
+
+	var failed int
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == 0 || (m.policy == MirrorAnySuccess && failed < len(errs)) {
+		return nil
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestMultiProducer(t *testing.T) {
+	topic := "default-topic"
+	primary, primaryBrokers := newClusterWithTopics(t, topic)
+	archive, archiveBrokers := newClusterWithTopics(t, topic)
+
+	newProducer := func(brokers []string) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: brokers,
+			Sync:    true,
+			Logger:  zap.NewNop(),
+			Encoder: json.JSON{},
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return apmqueue.Topic(topic)
+			},
+		})
+		require.NoError(t, err)
+		return producer
+	}
+	mp, err := NewMultiProducer(MirrorAllSuccess,
+		newProducer(primaryBrokers), newProducer(archiveBrokers),
+	)
+	require.NoError(t, err)
+	defer mp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{ID: "2"}},
+	}
+	require.NoError(t, mp.ProcessBatch(ctx, &batch))
+
+	for _, client := range []*kgo.Client{primary, archive} {
+		client.AddConsumeTopics(topic)
+		var records []*kgo.Record
+		for len(records) < len(batch) {
+			fetches := client.PollRecords(ctx, len(batch))
+			require.NoError(t, fetches.Err())
+			records = append(records, fetches.Records()...)
+		}
+		assert.Len(t, records, len(batch))
+	}
+}
+
+func TestMultiProducerPolicy(t *testing.T) {
+	topic := "default-topic"
+	_, brokers := newClusterWithTopics(t, topic)
+	newProducer := func(encoder Encoder) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: brokers,
+			Sync:    true,
+			Logger:  zap.NewNop(),
+			Encoder: encoder,
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return apmqueue.Topic(topic)
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	ok := newProducer(json.JSON{})
+	failing := newProducer(failingEncoder{})
+
+	batch := model.Batch{{}}
+	all, err := NewMultiProducer(MirrorAllSuccess, ok, failing)
+	require.NoError(t, err)
+	err = all.ProcessBatch(context.Background(), &batch)
+	assert.ErrorIs(t, err, errEncode)
+	assert.ErrorContains(t, err, "producer 1:")
+
+	any, err := NewMultiProducer(MirrorAnySuccess, ok, failing)
+	require.NoError(t, err)
+	assert.NoError(t, any.ProcessBatch(context.Background(), &batch))
+
+	none, err := NewMultiProducer(MirrorAnySuccess, failing, failing)
+	require.NoError(t, err)
+	assert.ErrorIs(t, none.ProcessBatch(context.Background(), &batch), errEncode)
+}
+
+var errEncode = errors.New("encode failed")
+
+type failingEncoder struct{}
+
+func (failingEncoder) Encode(model.APMEvent) ([]byte, error) {
+	return nil, errEncode
+}
@@ -0,0 +1,156 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// ErrTooFewPartitions is returned by ProcessBatch when a topic has fewer
+// partitions than required by ProducerConfig.EnsureMinPartitions, and
+// ProducerConfig.CreatePartitions isn't set.
+var ErrTooFewPartitions = errors.New("kafka: topic has too few partitions")
+
+// ensureMinPartitions ensures the topics of the records which are set in
+// cfg.EnsureMinPartitions have at least the minimum number of partitions, the
+// first time records are produced to them. Concurrent calls wait for the check
+// of a topic in progress, and get its result. Topics which fail to be checked
+// are checked again on the next call.
+func (p *Producer) ensureMinPartitions(ctx context.Context, records []*kgo.Record) error {
+	seen := make(map[apmqueue.Topic]struct{})
+	var errs []error
+	for _, r := range records {
+		topic := apmqueue.Topic(r.Topic)
+		if _, ok := p.cfg.EnsureMinPartitions[topic]; !ok {
+			continue
+		}
+		if _, ok := seen[topic]; ok {
+			continue
+		}
+		seen[topic] = struct{}{}
+		if err := p.partitionChecks.do(ctx, topic, func() error {
+			return p.ensureTopicPartitions(ctx, topic)
+		}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// partitionChecks tracks the checks of the partitions of the topics, so each
+// topic is checked by a single caller at a time until the check succeeds.
+type partitionChecks struct {
+	mu     sync.Mutex
+	checks map[apmqueue.Topic]*partitionCheck
+}
+
+// partitionCheck is the check of the partitions of a topic. err is set before
+// done is closed.
+type partitionCheck struct {
+	done chan struct{}
+	err  error
+}
+
+func newPartitionChecks() *partitionChecks {
+	return &partitionChecks{checks: make(map[apmqueue.Topic]*partitionCheck)}
+}
+
+// do calls check for the topic, unless it succeeded already. If the topic is
+// being checked by another caller, do waits for that check and returns its
+// result instead, or the context error if ctx is done first. Failed checks
+// are forgotten, so the next call checks the topic again.
+func (c *partitionChecks) do(ctx context.Context, topic apmqueue.Topic, check func() error) error {
+	c.mu.Lock()
+	if pc, ok := c.checks[topic]; ok {
+		c.mu.Unlock()
+		select {
+		case <-pc.done:
+			return pc.err
+		case <-ctx.Done():
+			return fmt.Errorf("kafka: failed waiting for the partitions of topic %s to be checked: %w",
+				topic, ctx.Err(),
+			)
+		}
+	}
+	pc := &partitionCheck{done: make(chan struct{})}
+	c.checks[topic] = pc
+	c.mu.Unlock()
+
+	pc.err = check()
+	if pc.err != nil {
+		c.mu.Lock()
+		delete(c.checks, topic)
+		c.mu.Unlock()
+	}
+	close(pc.done)
+	return pc.err
+}
+
+// ensureTopicPartitions checks the number of partitions of the topic, adding
+// partitions to reach the minimum when cfg.CreatePartitions is set.
+func (p *Producer) ensureTopicPartitions(ctx context.Context, topic apmqueue.Topic) error {
+	minPartitions := p.cfg.EnsureMinPartitions[topic]
+	// The admin client must not be closed, since it closes the underlying
+	// client.
+	admin := kadm.NewClient(p.client)
+	details, err := admin.ListTopics(ctx, string(topic))
+	if err != nil {
+		return fmt.Errorf("kafka: failed listing topic %s: %w", topic, err)
+	}
+	detail, ok := details[string(topic)]
+	if !ok {
+		return fmt.Errorf("kafka: failed listing topic %s: topic not found", topic)
+	}
+	if detail.Err != nil {
+		return fmt.Errorf("kafka: failed listing topic %s: %w", topic, detail.Err)
+	}
+	partitions := int32(len(detail.Partitions))
+	if partitions >= minPartitions {
+		return nil
+	}
+	if !p.cfg.CreatePartitions {
+		return fmt.Errorf("%w: %s has %d partitions, %d required",
+			ErrTooFewPartitions, topic, partitions, minPartitions,
+		)
+	}
+	responses, err := admin.UpdatePartitions(ctx, int(minPartitions), string(topic))
+	if err == nil {
+		err = responses[string(topic)].Err
+	}
+	if err != nil {
+		return fmt.Errorf("kafka: failed creating partitions for topic %s: %w", topic, err)
+	}
+	// Refresh the metadata, so the records are partitioned over the new
+	// partitions too.
+	p.clientFor(string(topic)).ForceMetadataRefresh()
+	p.cfg.Logger.Info("created partitions to reach the minimum",
+		zap.String("topic", string(topic)),
+		zap.Int32("partitions", partitions),
+		zap.Int32("min_partitions", minPartitions),
+	)
+	return nil
+}
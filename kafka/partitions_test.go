@@ -0,0 +1,170 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerEnsureMinPartitions(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	newProducer := func(create bool) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: brokers,
+			Sync:    true,
+			Logger:  zap.NewNop(),
+			Encoder: json.JSON{},
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return apmqueue.Topic(topic)
+			},
+			KeyRouter: func(event model.APMEvent) string {
+				return event.Transaction.ID
+			},
+			EnsureMinPartitions: map[apmqueue.Topic]int32{
+				apmqueue.Topic(topic): 4,
+			},
+			CreatePartitions: create,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batch := model.Batch{{Transaction: &model.Transaction{ID: "1"}}}
+	// The topic is created with 2 partitions.
+	err := newProducer(false).ProcessBatch(ctx, &batch)
+	assert.ErrorIs(t, err, ErrTooFewPartitions)
+	assert.EqualError(t, err, "kafka: topic has too few partitions: default-topic has 2 partitions, 4 required")
+
+	producer := newProducer(true)
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	details, err := kadm.NewClient(client).ListTopics(ctx, topic)
+	require.NoError(t, err)
+	assert.Len(t, details[topic].Partitions, 4)
+
+	// The records are partitioned over the new partitions too.
+	batch = batch[:0]
+	for i := 0; i < 20; i++ {
+		batch = append(batch, model.APMEvent{Transaction: &model.Transaction{ID: fmt.Sprint(i)}})
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	client.AddConsumeTopics(topic)
+	partitions := make(map[int32]bool)
+	for n := 0; n < len(batch)+1; {
+		fetches := client.PollRecords(ctx, len(batch)+1)
+		require.NoError(t, fetches.Err())
+		fetches.EachRecord(func(r *kgo.Record) {
+			partitions[r.Partition] = true
+			n++
+		})
+	}
+	assert.True(t, partitions[2] || partitions[3], "no records in the new partitions")
+}
+
+func TestProducerEnsureMinPartitionsConfig(t *testing.T) {
+	err := ProducerConfig{
+		EnsureMinPartitions: map[apmqueue.Topic]int32{"topic": 0},
+	}.Validate()
+	assert.ErrorContains(t, err, "kafka: min partitions must be positive for topic topic")
+}
+
+func TestPartitionChecks(t *testing.T) {
+	checks := newPartitionChecks()
+	ctx := context.Background()
+
+	// Concurrent callers wait for the check in progress, and get its result.
+	errCheck := errors.New("check failed")
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = checks.do(ctx, "topic", func() error {
+				calls.Add(1)
+				close(started)
+				<-release
+				return errCheck
+			})
+		}(i)
+		if i == 0 {
+			<-started
+		}
+	}
+	// Give the other callers time to start waiting.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+	for _, err := range errs {
+		assert.ErrorIs(t, err, errCheck)
+	}
+
+	// The failed check is forgotten, and the topic is checked again.
+	require.NoError(t, checks.do(ctx, "topic", func() error {
+		calls.Add(1)
+		return nil
+	}))
+	assert.Equal(t, int32(2), calls.Load())
+	// The topic isn't checked again once the check succeeded.
+	require.NoError(t, checks.do(ctx, "topic", func() error {
+		t.Fatal("unexpected check")
+		return nil
+	}))
+
+	// Waiting callers return when their context is done.
+	started = make(chan struct{})
+	release = make(chan struct{})
+	defer close(release)
+	go checks.do(ctx, "other", func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := checks.do(cancelled, "other", func() error {
+		t.Fatal("unexpected check")
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,121 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+	"github.com/elastic/apm-queue/codec/protobuf"
+)
+
+// TestPipelineCodecs consumes JSON encoded events, transforms them, and
+// produces them with a different codec, verifying the consumer's Decoder and
+// the producer's Encoder are independent.
+func TestPipelineCodecs(t *testing.T) {
+	in, out := "in-topic", "out-topic"
+	client, brokers := newClusterWithTopics(t, in, out)
+
+	// The apm-data model has no protobuf representation of the events, so
+	// the output events are framed with the protobuf delimited codec, holding
+	// their JSON encoding.
+	outCodec := protobuf.New(json.JSON{})
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: delimitedEncoder{outCodec},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(out)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	consumer, err := NewConsumer(ConsumerConfig{
+		Brokers:         brokers,
+		Topics:          []string{in},
+		GroupID:         "pipeline",
+		Decoder:         json.JSON{},
+		Logger:          zap.NewNop(),
+		AutoOffsetReset: OffsetResetEarliest,
+		Processor: model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			for i := range *b {
+				(*b)[i].Message = "transformed"
+			}
+			return producer.ProcessBatch(ctx, b)
+		}),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	value, err := json.JSON{}.Encode(model.APMEvent{
+		Transaction: &model.Transaction{ID: "1"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, client.ProduceSync(ctx, &kgo.Record{
+		Topic: in, Value: value,
+	}).FirstErr())
+
+	runCtx, runCancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(runCtx)
+	}()
+	defer func() {
+		runCancel()
+		<-done
+		assert.NoError(t, consumer.Close())
+	}()
+
+	client.AddConsumeTopics(out)
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+
+	// The output records aren't JSON, and are decoded by the output codec.
+	assert.False(t, stdjson.Valid(records[0].Value))
+	var batch model.Batch
+	require.NoError(t, outCodec.DecodeBatch(records[0].Value, &batch))
+	assert.Equal(t, model.Batch{{
+		Transaction: &model.Transaction{ID: "1"},
+		Message:     "transformed",
+	}}, batch)
+}
+
+// delimitedEncoder encodes each event as a single event delimited batch.
+type delimitedEncoder struct {
+	protobuf.Delimited
+}
+
+func (e delimitedEncoder) Encode(event model.APMEvent) ([]byte, error) {
+	return e.EncodeBatch(model.Batch{event})
+}
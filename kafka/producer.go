@@ -22,16 +22,31 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/pkg/sasl"
 	"github.com/twmb/franz-go/plugin/kzap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
 
 	"github.com/elastic/apm-data/model"
 	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
@@ -41,10 +56,152 @@ type Encoder interface {
 	Encode(model.APMEvent) ([]byte, error)
 }
 
+// ErrProducerClosed is returned by the Producer when it has been closed.
+var ErrProducerClosed = errors.New("kafka: producer closed")
+
+// Errors returned by ProducerConfig.Validate. Since Validate may return
+// multiple errors joined together, use errors.Is to check for them.
+var (
+	// ErrNoBrokers is returned when no brokers have been set.
+	ErrNoBrokers = errors.New("kafka: brokers cannot be empty")
+	// ErrNilLogger is returned when the logger isn't set.
+	ErrNilLogger = errors.New("kafka: logger cannot be nil")
+	// ErrNilEncoder is returned when the encoder isn't set.
+	ErrNilEncoder = errors.New("kafka: encoder cannot be nil")
+	// ErrNoTopicRouter is returned when neither the topic router nor the
+	// multi topic router are set.
+	ErrNoTopicRouter = errors.New("kafka: topic router must be set")
+	// ErrTopicNotAllowed is returned by ProcessBatch when the TopicRouter
+	// returns a topic which isn't in ProducerConfig.AllowedTopics.
+	ErrTopicNotAllowed = errors.New("kafka: topic not allowed")
+	// ErrTooManyTopics is returned by ProcessBatch when an event is routed
+	// to a new topic after ProducerConfig.MaxDistinctTopics topics have been
+	// routed to.
+	ErrTooManyTopics = errors.New("kafka: too many distinct topics")
+	// ErrNoKeyRouter is returned when ProducerConfig.Changelog is set
+	// without a KeyRouter.
+	ErrNoKeyRouter = errors.New("kafka: key router must be set in changelog mode")
+)
+
+// ContentTypeHeader is the record header key which holds the content type of
+// the record value when ProducerConfig.EmitContentTypeHeader is set.
+const ContentTypeHeader = "content-type"
+
+// ContentEncodingHeader is the record header key which holds the content
+// encoding of the record value, such as "zstd", when
+// ProducerConfig.EmitContentTypeHeader is set and the Encoder implements
+// codec.ContentEncoder.
+const ContentEncodingHeader = "content-encoding"
+
+// ProducerVersionHeader and ProducerClientIDHeader are the record header keys
+// which hold the producer's ProducerConfig.Version and ProducerConfig.ClientID
+// when ProducerConfig.EmitProducerVersionHeader is set.
+const (
+	ProducerVersionHeader  = "producer-version"
+	ProducerClientIDHeader = "producer-client-id"
+)
+
+// SchemaVersionHeader is the record header key which holds the producer's
+// ProducerConfig.SchemaVersion, when set.
+const SchemaVersionHeader = "schema-version"
+
+// CorrelationIDHeader is the record header key which holds the correlation ID
+// read from the context metadata when ProducerConfig.CorrelationIDKey is set.
+const CorrelationIDHeader = "correlation-id"
+
+// ExpiresAtHeader is the record header key which holds the time at which the
+// record expires, as the number of milliseconds since the Unix epoch, when
+// ProducerConfig.RecordTTL is set.
+const ExpiresAtHeader = "expires_at"
+
+// BaggageHeader is the record header key which holds the W3C baggage when
+// ProducerConfig.PropagateBaggage is set.
+const BaggageHeader = "baggage"
+
+// maxBaggageBytes is the maximum length of the baggage header value, as
+// recommended by the W3C Baggage specification.
+const maxBaggageBytes = 8192
+
+// IdempotencyKeyHeader is the record header key which holds the idempotency
+// key returned by ProducerConfig.IdempotencyKey.
+const IdempotencyKeyHeader = "idempotency-key"
+
+// RecordIDHeader is the record header key which holds the record ID returned
+// by ProducerConfig.RecordIDGenerator.
+const RecordIDHeader = "record-id"
+
+// SpanLinkHeader is the record header key which holds the span link returned
+// by ProducerConfig.SpanLinkExtractor.
+const SpanLinkHeader = "span-link"
+
+// CompatPartitionerJavaMurmur2 is the ProducerConfig.CompatPartitioner mode
+// which partitions the records like the Java client's default partitioner.
+const CompatPartitionerJavaMurmur2 = "java-murmur2"
+
 // RecordMutator mutates the record associated with the model.APMEvent.
 // If the RecordMutator returns an error, it is considered fatal.
+//
+// RecordMutators are applied before the event is encoded. If a RecordMutator
+// sets a non-nil record.Value, the configured Encoder is skipped for that
+// record and the value set by the mutator is produced as is.
 type RecordMutator func(model.APMEvent, *kgo.Record) error
 
+// NamedRecordMutator is a RecordMutator with a name, which is reported by
+// Producer.MutatorNames to identify it, see ProducerConfig.NamedMutators.
+type NamedRecordMutator interface {
+	// Name returns the name of the mutator.
+	Name() string
+	// Mutate mutates the record, like a RecordMutator.
+	Mutate(model.APMEvent, *kgo.Record) error
+}
+
+// NameMutator returns a NamedRecordMutator with the given name, which mutates
+// the records with rm.
+func NameMutator(name string, rm RecordMutator) NamedRecordMutator {
+	return namedMutator{name: name, mutate: rm}
+}
+
+type namedMutator struct {
+	name   string
+	mutate RecordMutator
+}
+
+func (m namedMutator) Name() string { return m.name }
+
+func (m namedMutator) Mutate(event model.APMEvent, record *kgo.Record) error {
+	return m.mutate(event, record)
+}
+
+const (
+	// AllISRAcks waits for all the in-sync replicas to acknowledge a record.
+	// This is the default.
+	AllISRAcks RequiredAcks = -1
+	// NoAcks doesn't wait for any acknowledgement.
+	NoAcks RequiredAcks = 0
+	// LeaderAck waits only for the partition leader to acknowledge a record.
+	LeaderAck RequiredAcks = 1
+)
+
+// RequiredAcks is the number of acknowledgements the brokers must send before
+// a record is considered produced.
+type RequiredAcks int8
+
+func (a RequiredAcks) kgoAcks() (kgo.Acks, error) {
+	switch a {
+	case AllISRAcks:
+		return kgo.AllISRAcks(), nil
+	case NoAcks:
+		return kgo.NoAck(), nil
+	case LeaderAck:
+		return kgo.LeaderAck(), nil
+	}
+	return kgo.Acks{}, fmt.Errorf("kafka: unknown required acks %d", a)
+}
+
+// HeaderMutator returns a record header derived from the model.APMEvent. The
+// header is only added to the record when ok is true.
+type HeaderMutator func(model.APMEvent) (key string, value []byte, ok bool)
+
 // ProducerConfig holds configuration for publishing events to Kafka.
 type ProducerConfig struct {
 	// Brokers holds a slice of (host:port) addresses of the Kafka brokers
@@ -63,40 +220,576 @@ type ProducerConfig struct {
 
 	// Encoder holds an encoding.Encoder for encoding events.
 	Encoder Encoder
+	// SkipEncodeErrors, if true, makes the producer skip the events which
+	// fail to be encoded, logging the error and counting them in the
+	// producer.events.dropped metric, and produce the rest of the batch.
+	// By default, an encode error fails ProcessBatch and nothing is produced.
+	//
+	// The producer has no dead letter queue, so the skipped events are lost.
+	// To keep them, leave SkipEncodeErrors unset and handle the error
+	// returned by ProcessBatch, for example, by producing the batch with a
+	// fallback Encoder.
+	SkipEncodeErrors bool
+	// OutputValidator, if set, is called with the value of each record
+	// encoded by the Encoder, for example, to validate it against a JSON
+	// schema agreed with strict consumers. A validation error is handled
+	// like an encode error: it fails ProcessBatch, or skips the event when
+	// SkipEncodeErrors is set. The values set by the Mutators aren't
+	// validated.
+	//
+	// The validator is called for every record, in the ProcessBatch call
+	// path, so its cost adds to the produce latency. Validating against a
+	// schema typically costs more than encoding the event, which makes it
+	// better suited to development and testing environments.
+	OutputValidator func([]byte) error
 
 	// Sync can be used to indicate whether production should be synchronous.
+	// When set, ProcessBatch waits for the records to be produced, or returns
+	// the context error as soon as its context is done.
 	Sync bool
+	// AdaptiveSyncThreshold, if > 0, makes ProcessBatch synchronous only for
+	// the batches with fewer events than the threshold, which benefit from
+	// the low latency and the immediate errors, while larger batches are
+	// produced asynchronously, for throughput. Since ProcessBatch doesn't
+	// wait for the records of the larger batches, their produce errors are
+	// only reported to the ErrorHandler, and logged. It can't be set
+	// together with Sync.
+	AdaptiveSyncThreshold int
 
 	// TopicRouter returns the topic where an event should be produced.
 	TopicRouter apmqueue.TopicRouter
+	// RecordTTL, if set, returns the time to live of the record produced
+	// for an event. Records with a positive TTL have the ExpiresAtHeader set
+	// to the current time plus the TTL, which consumers can honor to discard
+	// stale records, see RecordExpired and ConsumerConfig.DropExpired.
+	// Events with a negative TTL have already expired, and aren't produced.
+	//
+	// The expiration time is computed with the producer's clock and checked
+	// with the consumer's, so clock skew between them shortens or extends
+	// the effective TTL.
+	RecordTTL func(model.APMEvent) time.Duration
+	// MultiTopicRouter, if set, is used instead of the TopicRouter, and
+	// returns all the topics where an event should be produced. The event is
+	// encoded once, and a copy of the record is produced to each topic; the
+	// Mutators and HeaderMutators are applied once too, with the record's
+	// Topic set to the first topic. Events for which no topics are returned
+	// aren't produced.
+	MultiTopicRouter func(model.APMEvent) []apmqueue.Topic
+	// AllowedTopics, if set, holds the topics which the TopicRouter may
+	// return. ProcessBatch returns ErrTopicNotAllowed when an event is
+	// routed to any other topic, without producing it. When using the
+	// MultiTopicRouter, the errors for all the disallowed topics are joined.
+	AllowedTopics *apmqueue.TopicSet
+	// MaxDistinctTopics, if > 0, limits the number of distinct topics the
+	// events are routed to during the lifetime of the producer, as a safety
+	// valve against routing bugs creating an unbounded number of topics.
+	// Once the limit is reached, ProcessBatch returns ErrTooManyTopics when
+	// an event is routed to a topic which wasn't routed to before, without
+	// producing the batch, while the known topics can still be produced to.
+	MaxDistinctTopics int
 
 	// Mutators holds the list of RecordMutator applied to all the records sent
 	// by the producer. If any errors are returned, the producer will not
 	// produce and return the error in ProcessBatch.
 	Mutators []RecordMutator
+	// NamedMutators holds the list of NamedRecordMutator applied to all the
+	// records sent by the producer, right after the Mutators, like them.
+	// Their names are reported by Producer.MutatorNames, which allows
+	// confirming the mutators a producer was configured with.
+	NamedMutators []NamedRecordMutator
+	// HeaderMutators holds the list of HeaderMutator applied to all the
+	// records sent by the producer, adding headers computed from the event
+	// fields, for example, the service name. They're applied before Mutators.
+	HeaderMutators []HeaderMutator
+	// FinalizeRecord, if set, is called with the fully populated record right
+	// before it's produced, after the Mutators are applied and the event is
+	// encoded, so the record's Value is set. An error aborts ProcessBatch
+	// like the Mutators' errors do. With the MultiTopicRouter, it's called
+	// once, before the record is copied to the other topics.
+	FinalizeRecord func(model.APMEvent, *kgo.Record) error
 	// SASL configures the kgo.Client to use SASL authorization.
 	SASL sasl.Mechanism
 	// TLS configures the kgo.Client to use TLS for authentication.
 	TLS *tls.Config
+	// TLSConfigProvider, if set, is used instead of TLS, and returns the TLS
+	// configuration used to open each new connection to the brokers. This
+	// allows rotating certificates without recreating the producer: new
+	// connections use the rotated certificates, while the existing ones keep
+	// using the certificates they were opened with until they're closed,
+	// for example, once idle for ConnIdleTimeout. It can't be set together
+	// with TLS.
+	//
+	// When only the client certificate rotates, setting the
+	// GetClientCertificate callback of the TLS config is an alternative.
+	TLSConfigProvider func() *tls.Config
+	// MinTLSVersion is the minimum TLS version enforced on the configuration
+	// set in TLS, or returned by TLSConfigProvider, which are cloned rather
+	// than modified. The MinVersion of the configuration is kept when it's
+	// higher. If zero, it defaults to TLS 1.2 (tls.VersionTLS12), so configs
+	// which don't set a MinVersion don't allow TLS 1.0 and 1.1.
+	MinTLSVersion uint16
+	// RejectInsecureCipherSuites removes the insecure cipher suites (see
+	// tls.InsecureCipherSuites) from the CipherSuites of the TLS
+	// configuration. It has no effect when no CipherSuites are set, since
+	// Go only uses secure cipher suites by default. NewProducer fails if
+	// the TLS config only holds insecure cipher suites, as do the
+	// connections using one returned by TLSConfigProvider.
+	RejectInsecureCipherSuites bool
 	// CompressionCodec specifies a list of compression codecs.
 	// See kgo.ProducerBatchCompression for more details.
+	//
+	// Neither the Kafka client nor the Kafka protocol support compressing
+	// the record batches with a zstd dictionary, which improves the
+	// compression ratio of small records, such as metrics. To use one,
+	// compress the record values individually instead, by setting the
+	// Encoder to a compress.Zstd created with the dictionary. The consumers
+	// must decode the values with a compress.Zstd using the same dictionary.
+	// Since the values are compressed already, the batch compression is
+	// disabled when the Encoder implements codec.ContentEncoder, and
+	// CompressionCodec can only be set to kgo.NoCompression.
 	CompressionCodec []kgo.CompressionCodec
+	// Linger is how long the records of a partition wait for more records
+	// before being sent in a produce request, trading latency for larger,
+	// better compressed, batches. If 0, lingering is disabled, which is the
+	// kgo default. See kgo.ProducerLinger for more details.
+	Linger time.Duration
+	// ReconnectBackoff returns how long to wait before retrying a failed
+	// request or reconnecting to a broker, given the number of consecutive
+	// failed attempts (starting at 1). If nil, it defaults to an exponential
+	// backoff starting at 250ms and capped at 5s, with ±25% jitter applied
+	// to avoid multiple producers reconnecting in lockstep.
+	// See kgo.RetryBackoffFn for more details.
+	ReconnectBackoff func(attempts int) time.Duration
+
+	// IdempotencyKey, if set, is used to derive a deterministic key from each
+	// event, which is set as the IdempotencyKeyHeader record header. Consumers
+	// can use it to deduplicate records which have been produced more than
+	// once, for example when upstream retries a batch.
+	//
+	// This is unrelated to Kafka's idempotent producer, which only prevents
+	// duplicates caused by the Kafka client retrying a produce request, and
+	// can't detect the same event being passed to ProcessBatch twice.
+	IdempotencyKey func(model.APMEvent) string
+	// IdempotencyKeyAsRecordKey sets the key returned by IdempotencyKey as
+	// the record key, in addition to the header. Since the record key is used
+	// for partitioning, records with the same key land in the same partition.
+	IdempotencyKeyAsRecordKey bool
+	// RecordIDGenerator, if set, is called once per record built from the
+	// events passed to ProcessBatch to generate a unique ID, for example, a
+	// UUID, which is set as the RecordIDHeader record header. Events routed
+	// to multiple topics get a different ID for each of their records. The
+	// header is added after the FinalizeRecord function is called, and isn't
+	// added to the records returned by BuildRecords.
+	//
+	// The IDs are generated every time the records are built, so an event
+	// passed to ProcessBatch again, for example, when upstream retries a
+	// batch, gets a new ID. For idempotent processing across retries, derive
+	// the ID from the event instead, see IdempotencyKey.
+	RecordIDGenerator func() string
+	// KeyRouter, if set, returns the record key of each event, for example,
+	// the ID of the entity the event describes. Since the record key is used
+	// for partitioning, records with the same key land in the same partition.
+	// It can't be set together with IdempotencyKeyAsRecordKey. The keyrouter
+	// package provides helpers to build key routers, such as keys composed of
+	// multiple event fields.
+	KeyRouter func(model.APMEvent) string
+	// Changelog enables the changelog mode, used to produce the state of
+	// entities to log compacted topics, where only the latest record of each
+	// key is retained. KeyRouter must be set, and returns the entity ID of
+	// each event. In changelog mode:
+	//
+	//   - ProcessBatch fails when the KeyRouter returns an empty key, since
+	//     log compacted topics reject records without a key.
+	//   - The DurabilityByTopic overrides must use AllISRAcks, like with
+	//     PreserveOrder, so the versions of an entity are written in the
+	//     order they're produced in, and the latest version is the one
+	//     retained by compaction.
+	//
+	// Entities are deleted with ProduceEventTombstone.
+	Changelog bool
+	// SpanLinkExtractor, if set, returns the span link of each event, which
+	// is set as the SpanLinkHeader record header, so downstream consumers
+	// can correlate the records with the traces the events belong to, even
+	// when a batch mixes events of multiple traces. No header is set when
+	// it returns an empty string. TraceSpanLink returns links formatted as
+	// "<trace-id>-<span-id>", and is a good default.
+	SpanLinkExtractor func(model.APMEvent) string
+	// DedupWindow, if greater than zero, drops the events whose key, as
+	// returned by IdempotencyKey, has been seen by the producer within the
+	// window, reducing the duplicates produced when upstream retries. Keys
+	// are seen once the records of their batch have been built, even if
+	// they later fail to be produced. IdempotencyKey must be set.
+	//
+	// Deduplication is best-effort: the keys are only known to the producer
+	// instance which saw them, and are lost when the producer is restarted.
+	// The memory used is bounded by DedupMaxKeys, and keys are evicted
+	// before their window elapses once the limit is reached.
+	DedupWindow time.Duration
+	// DedupMaxKeys is the maximum number of keys held for deduplication.
+	// If <= 0, it defaults to 100000. Only used when DedupWindow is set.
+	DedupMaxKeys int
+
+	// IdleTimeout, if greater than zero, closes the producer after no
+	// ProcessBatch calls have been made for the configured duration, freeing
+	// the connections to the brokers. The idle time is counted from the time
+	// the last call returned. The buffered records are flushed before the
+	// producer is closed, like in Shutdown, for up to 30 seconds. Once closed,
+	// ProcessBatch returns ErrProducerClosed; the producer isn't re-opened.
+	IdleTimeout time.Duration
+
+	// DrainMaxAge, if greater than zero, bounds the age of the records which
+	// Shutdown waits for: once all the records which haven't been produced
+	// yet were passed to the Kafka client longer than DrainMaxAge ago, for
+	// example, because they're stuck on an unavailable partition, Shutdown
+	// stops waiting, and closes the producer. This prevents old stuck
+	// records from blocking the shutdown, while still flushing the fresh
+	// ones, so Shutdown waits at most DrainMaxAge after the last record was
+	// produced.
+	//
+	// The abandoned records fail to be produced, and are lost unless a
+	// Spooler is set. They're reported in the error returned by Shutdown.
+	// Tracking the age of the records adds a small cost to each record.
+	DrainMaxAge time.Duration
+
+	// Spooler, if set, stores the records which fail to be produced, instead
+	// of dropping them. The spooled records can be produced again by calling
+	// Producer.Replay once the brokers are reachable.
+	//
+	// The records which fail with a fatal error (see ErrorClassFatal), such
+	// as kerr.MessageTooLarge or kerr.TopicAuthorizationFailed, aren't
+	// spooled, since producing them again would fail too. The records which
+	// fail because the producer is closed (kgo.ErrClientClosed) or the
+	// context is cancelled are spooled, since the error isn't caused by the
+	// record.
+	Spooler Spooler
+
+	// ErrorHandler, if set, is called for each record which fails to be
+	// produced, with the error and its class, see ClassifyProduceError. It
+	// is called from the Kafka client's goroutines, and must not block. To
+	// produce the failed records elsewhere, such as to a dead letter queue,
+	// hand them off to a separate goroutine, see DeadLetterRecord.
+	ErrorHandler func(record *kgo.Record, err error, class ErrorClass)
+
+	// DurabilityByTopic overrides the RequiredAcks for the records produced
+	// to the specified topics. Records produced to any other topic require
+	// AllISRAcks.
+	//
+	// Since franz-go configures the acks per client, a separate client is
+	// created for each distinct RequiredAcks, each with its own connections
+	// to the brokers and produce buffers. Keep the number of distinct values
+	// small. Idempotent writes are disabled for the clients not using
+	// AllISRAcks, since Kafka requires it.
+	DurabilityByTopic map[apmqueue.Topic]RequiredAcks
+
+	// PreserveOrder validates that the configuration guarantees that records
+	// with the same key are written to their partition in the order they're
+	// produced in, even when produce requests are retried. It doesn't change
+	// the configuration of the Kafka client: the order is kept by idempotent
+	// writes, which the client uses for the records produced with
+	// AllISRAcks, the default. The client numbers the records of idempotent
+	// writes, so the brokers reject the records written out of order, and
+	// retries them in order. Since the clients of the DurabilityByTopic
+	// overrides using other acks have idempotent writes disabled, the
+	// overrides must use AllISRAcks. The order of records produced by
+	// concurrent ProcessBatch calls is undefined.
+	//
+	// Keeping the order costs throughput: every produce request waits for
+	// all the in-sync replicas, and a failed produce request holds back the
+	// requests of its partitions sent after it until it's retried, since
+	// they're rejected while the records before them are missing.
+	PreserveOrder bool
+
+	// PinnedPartitions pins the records produced to the specified topics to
+	// a single partition, regardless of their key, so they're written in the
+	// order they're produced in. This is useful for low volume topics which
+	// require a global order, such as control topics. Records produced to
+	// any other topic are partitioned as usual. Combine with PreserveOrder
+	// to keep the order when produce requests are retried.
+	//
+	// Since a single partition is written to, the throughput of a pinned
+	// topic is limited to that of a single partition, and its consumption
+	// can't be spread across multiple consumers. Records pinned to a
+	// partition which doesn't exist fail to be produced.
+	PinnedPartitions map[apmqueue.Topic]int32
+
+	// EnsureMinPartitions holds the minimum number of partitions of the
+	// specified topics, for example, to guarantee the parallelism of their
+	// consumers. The first time ProcessBatch produces to one of the topics,
+	// its number of partitions is checked using the admin API, and
+	// ProcessBatch returns ErrTooFewPartitions without producing the batch
+	// when the topic has fewer partitions, unless CreatePartitions is set.
+	// The topics which fail to be checked are checked again on the next
+	// ProcessBatch call, and the records produced with ProduceRecords and
+	// the tombstones aren't checked.
+	//
+	// Describing the topics requires the Describe ACL on them.
+	EnsureMinPartitions map[apmqueue.Topic]int32
+	// CreatePartitions adds partitions to the topics in EnsureMinPartitions
+	// which have fewer than the minimum, instead of failing ProcessBatch.
+	// It requires the Alter ACL on the topics. Adding partitions changes the
+	// partition of the records with a given key, breaking their order across
+	// the change. Since partitions can't be removed from a topic, topics
+	// with more partitions than the minimum are left as they are.
+	CreatePartitions bool
+
+	// CompatPartitioner, if set, partitions the records like the named
+	// client, so the records with a given key are produced to the same
+	// partition as when they were produced with it, for example, when
+	// migrating producers to this package. The supported modes are:
+	//
+	//   - CompatPartitionerJavaMurmur2 ("java-murmur2"): hashes the keys with
+	//     murmur2, like the Java client's default partitioner. Records without
+	//     a key stick to a random partition until a batch is full.
+	//
+	// If not set, the records with a key are hashed with murmur2 too, while
+	// the records without a key are spread uniformly by their size.
+	CompatPartitioner string
+
+	// EmitContentTypeHeader adds the ContentTypeHeader record header to all
+	// the records, set to the content type of the Encoder. This allows
+	// consumers of topics with records encoded by different codecs to select
+	// the decoder, see codec.Registry. The Encoder must implement the
+	// codec.ContentTyper interface. If the Encoder also implements
+	// codec.ContentEncoder, such as compress.Zstd, the ContentEncodingHeader
+	// record header is added too, set to its content encoding, while the
+	// content type is the one of the compressed payload.
+	EmitContentTypeHeader bool
+
+	// PropagateBaggage adds the OpenTelemetry baggage stored in the context
+	// passed to ProcessBatch as the BaggageHeader record header, encoded in
+	// the W3C Baggage format. Baggage exceeding 8192 bytes isn't propagated.
+	// The Consumer restores the baggage into the processing context.
+	PropagateBaggage bool
+
+	// EmitProducerVersionHeader adds the ProducerVersionHeader record header
+	// to all the records, set to Version, and the ProducerClientIDHeader set
+	// to ClientID when it isn't empty. This allows correlating records to the
+	// producer which wrote them. Version must be set.
+	EmitProducerVersionHeader bool
+
+	// SchemaVersion, if set, is added as the SchemaVersionHeader record
+	// header to all the records, identifying the version of the event schema
+	// the records were encoded with. Consumers can use it to pick a decoder
+	// compatible with the version, which allows the schema to evolve.
+	SchemaVersion string
+
+	// MetadataKeys, if not nil, holds the keys of the context metadata which
+	// are added as record headers, the rest of the metadata is dropped. If
+	// nil, all the metadata is added.
+	MetadataKeys []string
+	// CorrelationIDKey, if set, is the key of the context metadata which holds
+	// the correlation ID of the request. When present, its value is added as
+	// the CorrelationIDHeader record header, regardless of MetadataKeys.
+	CorrelationIDKey string
+	// HeaderEncoder, if set, converts the context metadata into record
+	// headers, replacing the default of a header per metadata key holding
+	// the value as is. For example, it can pack the metadata into a single
+	// binary encoded header. It's called once per batch with the metadata
+	// filtered by MetadataKeys, and the headers it returns are shared by
+	// all the records of the batch, so they must not be modified. It isn't
+	// called when the context holds no metadata.
+	HeaderEncoder func(map[string]string) []kgo.RecordHeader
+	// DefaultHeaders holds headers added to all the records, for example,
+	// to stamp the datacenter or cluster where the producer runs. The context
+	// metadata added as headers takes precedence: a default header is not
+	// added when the metadata holds the same key.
+	DefaultHeaders map[string]string
+	// TimestampMetadataKey, if set, is the key of the context metadata which
+	// holds the timestamp of the records produced by ProcessBatch, either as
+	// an RFC3339 time or as milliseconds since the Unix epoch, for example,
+	// the original time of replayed events. When the key isn't in the
+	// metadata, the records' timestamp is the event Timestamp, or the
+	// produce time if the event has none. Values which fail to be parsed are
+	// ignored as if the key wasn't set, and logged as a warning.
+	TimestampMetadataKey string
+
+	// MaxBufferedRecords sets the maximum number of records the producer
+	// buffers before ProcessBatch blocks waiting for buffered records to be
+	// produced. If <= 0, it defaults to 10000.
+	// See kgo.MaxBufferedRecords for more details.
+	MaxBufferedRecords int
+
+	// BrokerMaxWriteBytes bounds the size of the produce requests sent to a
+	// broker, and should be set to the brokers' socket.request.max.bytes
+	// when it's lower than its default, to avoid the brokers rejecting the
+	// requests. If zero, it defaults to 100MiB. It must be between 1KiB and
+	// 1GiB, and can't be lower than the maximum size of a record batch, which
+	// defaults to 1000012 bytes (see kgo.ProducerBatchMaxBytes), since every
+	// produce request holds at least one batch.
+	// See kgo.BrokerMaxWriteBytes for more details.
+	BrokerMaxWriteBytes int32
+
+	// MeterProvider is used to create the producer metrics. If nil, no
+	// metrics are recorded. The following metrics are recorded:
+	//
+	//   - producer.produce.blocked: a counter of the records, by topic,
+	//     which blocked for more than a few milliseconds waiting for space in
+	//     the producer buffer. Since the buffer only fills up when records
+	//     are produced faster than the brokers accept them, a growing count
+	//     indicates that MaxBufferedRecords is too low, or that the brokers
+	//     are applying backpressure.
+	//   - producer.events.dropped: a counter of the events which weren't
+	//     produced, by reason: "routed-to-drop" for the events for which the
+	//     MultiTopicRouter returns no topics, "expired" for the events with a
+	//     negative RecordTTL, "empty" for the events encoded as an empty
+	//     value, "duplicate" for the events dropped by the DedupWindow, and
+	//     "encode-error" for the events skipped with SkipEncodeErrors.
+	//   - producer.events.routed: a counter of the events routed to a topic,
+	//     by topic. Events routed to multiple topics are counted once per
+	//     topic. Unlike the records produced, the events are counted as soon
+	//     as they're routed, before being produced, so the events which are
+	//     later dropped (see producer.events.dropped), or fail to be produced,
+	//     are counted too. Events routed to no topics aren't counted.
+	//   - producer.record.size: a histogram of the size in bytes of the
+	//     encoded values of the records produced by ProcessBatch, by topic.
+	//     Compare it with the topics' max.message.bytes to right-size them.
+	//     When the Encoder compresses the values, such as compress.Zstd, the
+	//     compressed size is recorded.
+	//   - producer.batch.events: a histogram of the number of events in the
+	//     batches passed to ProcessBatch and ProcessBatchAsync, recorded
+	//     before the events are deduplicated or dropped, which helps tuning
+	//     the batching upstream of the producer.
+	//   - producer.broker.throttle: a histogram of the time in milliseconds
+	//     the brokers throttled the producer for, by broker node ID, which
+	//     shows when quotas are exceeded. The metric is informational: the
+	//     Kafka client already waits for the throttle to elapse before
+	//     sending more requests to the throttling broker.
+	MeterProvider metric.MeterProvider
+
+	// RequestTimeoutOverhead is added to the timeout of the requests which
+	// have one, such as produce requests, and is used as the timeout of the
+	// ones which don't. Higher values avoid spurious retries on high latency
+	// networks. If zero, it defaults to 10s. It must be between 1s and 15m.
+	// See kgo.RequestTimeoutOverhead for more details.
+	RequestTimeoutOverhead time.Duration
+	// ConnIdleTimeout is the time after which idle connections to the brokers
+	// are closed. If zero, it defaults to 20s. It must be between 1s and 15m.
+	// See kgo.ConnIdleTimeout for more details.
+	ConnIdleTimeout time.Duration
+	// DialTimeout is the timeout for opening connections to the brokers. If
+	// zero, it defaults to 10s. See kgo.DialTimeout for more details.
+	DialTimeout time.Duration
+
+	// WaitForMetadata, if greater than zero, makes NewProducer wait up to
+	// the configured duration for a broker to be reachable, returning an
+	// error if none is. By default, NewProducer returns immediately, and the
+	// records produced before the brokers are reachable are buffered.
+	WaitForMetadata time.Duration
+
+	// LogRetries logs an event each time a batch of records fails to be
+	// produced to a partition and is retried by the Kafka client, with the
+	// broker, topic, partition, error, and the attempt number, counted since
+	// the last batch successfully produced to the partition. The events are
+	// logged at the info level, which helps diagnosing flaky brokers. The
+	// retries are detected from the messages logged by the Kafka client, so
+	// they're only logged when the Logger has the info level enabled.
+	LogRetries bool
+	// LogThrottling logs an event each time a broker throttles the producer,
+	// for example, when a produce quota is exceeded, with the broker and the
+	// throttle interval. The events are logged at the info level. Like the
+	// producer.broker.throttle metric, the events are informational.
+	LogThrottling bool
 }
 
 // Validate checks that cfg is valid, and returns an error otherwise.
 func (cfg ProducerConfig) Validate() error {
 	var err []error
 	if len(cfg.Brokers) == 0 {
-		err = append(err, errors.New("kafka: brokers cannot be empty"))
+		err = append(err, ErrNoBrokers)
 	}
 	if cfg.Logger == nil {
-		err = append(err, errors.New("kafka: logger cannot be nil"))
+		err = append(err, ErrNilLogger)
 	}
 	if cfg.Encoder == nil {
-		err = append(err, errors.New("kafka: encoder cannot be nil"))
+		err = append(err, ErrNilEncoder)
+	}
+	if cfg.TopicRouter == nil && cfg.MultiTopicRouter == nil {
+		err = append(err, ErrNoTopicRouter)
+	}
+	if cfg.AdaptiveSyncThreshold < 0 {
+		err = append(err, errors.New("kafka: adaptive sync threshold cannot be negative"))
+	}
+	if cfg.Sync && cfg.AdaptiveSyncThreshold > 0 {
+		err = append(err, errors.New("kafka: sync and adaptive sync threshold cannot be set together"))
+	}
+	if cfg.IdleTimeout < 0 {
+		err = append(err, errors.New("kafka: idle timeout cannot be negative"))
+	}
+	if cfg.RequestTimeoutOverhead < 0 {
+		err = append(err, errors.New("kafka: request timeout overhead cannot be negative"))
+	}
+	if cfg.ConnIdleTimeout < 0 {
+		err = append(err, errors.New("kafka: conn idle timeout cannot be negative"))
+	}
+	if cfg.DialTimeout < 0 {
+		err = append(err, errors.New("kafka: dial timeout cannot be negative"))
+	}
+	if cfg.DrainMaxAge < 0 {
+		err = append(err, errors.New("kafka: drain max age cannot be negative"))
+	}
+	if cfg.DedupWindow < 0 {
+		err = append(err, errors.New("kafka: dedup window cannot be negative"))
+	}
+	if cfg.Changelog && cfg.KeyRouter == nil {
+		err = append(err, ErrNoKeyRouter)
 	}
-	if cfg.TopicRouter == nil {
-		err = append(err, errors.New("kafka: topic router must be set"))
+	if cfg.KeyRouter != nil && cfg.IdempotencyKeyAsRecordKey {
+		err = append(err, errors.New("kafka: key router and idempotency key as record key cannot be set together"))
+	}
+	if cfg.DedupWindow > 0 && cfg.IdempotencyKey == nil {
+		err = append(err, errors.New("kafka: idempotency key must be set to deduplicate records"))
+	}
+	if cfg.TLS != nil && cfg.TLSConfigProvider != nil {
+		err = append(err, errors.New("kafka: TLS and TLS config provider cannot be set together"))
+	}
+	if cfg.MinTLSVersion != 0 {
+		if e := validTLSVersion(cfg.MinTLSVersion); e != nil {
+			err = append(err, e)
+		}
+	}
+	if cfg.MaxDistinctTopics < 0 {
+		err = append(err, errors.New("kafka: max distinct topics cannot be negative"))
+	}
+	if cfg.Linger < 0 {
+		err = append(err, errors.New("kafka: linger cannot be negative"))
+	}
+	if cfg.BrokerMaxWriteBytes < 0 {
+		err = append(err, errors.New("kafka: broker max write bytes cannot be negative"))
+	}
+	if cfg.WaitForMetadata < 0 {
+		err = append(err, errors.New("kafka: wait for metadata cannot be negative"))
+	}
+	if cfg.EmitProducerVersionHeader && cfg.Version == "" {
+		err = append(err, errors.New("kafka: version must be set when emitting the producer version header"))
+	}
+	if _, ok := cfg.Encoder.(codec.ContentEncoder); ok && cfg.batchCompressed() {
+		err = append(err, errors.New("kafka: batch compression cannot be combined with an encoder which compresses the values"))
+	}
+	if ct, ok := cfg.Encoder.(codec.ContentTyper); cfg.EmitContentTypeHeader && (!ok || ct.ContentType() == "") {
+		err = append(err, errors.New("kafka: encoder must implement codec.ContentTyper to emit the content type header"))
+	}
+	for topic, acks := range cfg.DurabilityByTopic {
+		if _, e := acks.kgoAcks(); e != nil {
+			err = append(err, fmt.Errorf("%w for topic %s", e, topic))
+		}
+		if (cfg.PreserveOrder || cfg.Changelog) && acks != AllISRAcks {
+			err = append(err, fmt.Errorf(
+				"kafka: preserving the order requires AllISRAcks, topic %s uses %d", topic, acks,
+			))
+		}
+	}
+	for topic, partition := range cfg.PinnedPartitions {
+		if partition < 0 {
+			err = append(err, fmt.Errorf("kafka: pinned partition cannot be negative for topic %s", topic))
+		}
+	}
+	for topic, partitions := range cfg.EnsureMinPartitions {
+		if partitions <= 0 {
+			err = append(err, fmt.Errorf("kafka: min partitions must be positive for topic %s", topic))
+		}
+	}
+	if _, e := compatPartitioner(cfg.CompatPartitioner); e != nil {
+		err = append(err, e)
 	}
 	return errors.Join(err...)
 }
@@ -105,8 +798,71 @@ func (cfg ProducerConfig) Validate() error {
 type Producer struct {
 	cfg    ProducerConfig
 	client *kgo.Client
+	// ackClients holds the clients used for the topics set in
+	// cfg.DurabilityByTopic, keyed by their RequiredAcks.
+	ackClients map[RequiredAcks]*kgo.Client
+	metrics    producerMetrics
+	stats      producerStats
+
+	// staticHeaders holds the headers added to all the records, computed
+	// once on construction.
+	staticHeaders []kgo.RecordHeader
+	// defaultHeaders holds cfg.DefaultHeaders sorted by key, computed once
+	// on construction.
+	defaultHeaders []kgo.RecordHeader
+	// metadataKeys holds cfg.MetadataKeys as a set, nil if not set.
+	metadataKeys map[string]struct{}
+	// dedup holds the idempotency keys seen within cfg.DedupWindow, nil if
+	// not set.
+	dedup *dedupCache
+	// drain tracks the pending records, nil if cfg.DrainMaxAge isn't set.
+	drain *drainTracker
+	// topics holds the topics routed to, nil if cfg.MaxDistinctTopics isn't
+	// set. It's guarded by topicsMu, since ProcessBatch is called
+	// concurrently.
+	topics   map[apmqueue.Topic]struct{}
+	topicsMu sync.Mutex
+	// partitionChecks tracks the checks of the partitions of the topics in
+	// cfg.EnsureMinPartitions, nil if it isn't set.
+	partitionChecks *partitionChecks
 
 	mu sync.RWMutex
+	// closed is closed once the producer stops accepting calls, with the
+	// write lock held. The clients may still be flushing.
+	closed chan struct{}
+	// closeClients closes the clients once.
+	closeClients sync.Once
+	// clock returns the current time. It defaults to time.Now and is only
+	// replaced in tests. It must only be replaced with the write lock held.
+	clock func() time.Time
+	// lastActive holds the time the last call returned in Unix nanoseconds.
+	// Only used when cfg.IdleTimeout > 0.
+	lastActive atomic.Int64
+
+	// inflight tracks the records which have been passed to the clients and
+	// haven't been produced or failed yet. Records are only added with the
+	// read lock held.
+	inflight sync.WaitGroup
+	// shutdown holds the state of an in progress Shutdown, nil otherwise.
+	shutdown atomic.Pointer[shutdownState]
+}
+
+// shutdownState records the records which fail to be produced while the
+// producer is shutting down.
+type shutdownState struct {
+	failed   atomic.Int64
+	firstErr atomic.Pointer[error]
+}
+
+// batchCompressed returns true if any of the compression codecs compresses
+// the record batches.
+func (cfg ProducerConfig) batchCompressed() bool {
+	for _, c := range cfg.CompressionCodec {
+		if c != kgo.NoCompression() {
+			return true
+		}
+	}
+	return false
 }
 
 // NewProducer returns a new Producer with the given config.
@@ -114,10 +870,29 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("kafka: invalid producer config: %w", err)
 	}
+	metrics, err := newProducerMetrics(cfg.MeterProvider)
+	if err != nil {
+		return nil, err
+	}
 
+	var logger kgo.Logger = kzap.New(cfg.Logger.Named("kafka"))
+	var hooks []kgo.Hook
+	if cfg.LogRetries {
+		retryLogger := newProduceRetryLogger(logger, cfg.Logger.Named("retry"))
+		logger = retryLogger
+		hooks = append(hooks, retryLogger)
+	}
+	if cfg.MeterProvider != nil || cfg.LogThrottling {
+		hook := throttleHook{throttleTime: metrics.throttleTime}
+		if cfg.LogThrottling {
+			hook.logger = cfg.Logger.Named("throttle")
+		}
+		hooks = append(hooks, hook)
+	}
 	opts := []kgo.Opt{
 		kgo.SeedBrokers(cfg.Brokers...),
-		kgo.WithLogger(kzap.New(cfg.Logger.Named("kafka"))),
+		kgo.WithLogger(logger),
+		kgo.WithHooks(hooks...),
 	}
 	if cfg.ClientID != "" {
 		opts = append(opts, kgo.ClientID(cfg.ClientID))
@@ -128,14 +903,65 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 		}
 	}
 	if cfg.TLS != nil {
-		opts = append(opts, kgo.DialTLSConfig(cfg.TLS.Clone()))
+		tlsCfg, err := secureTLSConfig(cfg.TLS, cfg.MinTLSVersion, cfg.RejectInsecureCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsCfg))
+	}
+	if cfg.TLSConfigProvider != nil {
+		provider := func() (*tls.Config, error) {
+			return secureTLSConfig(cfg.TLSConfigProvider(), cfg.MinTLSVersion, cfg.RejectInsecureCipherSuites)
+		}
+		opts = append(opts, kgo.Dialer(tlsDialer(provider, cfg.DialTimeout)))
 	}
 	if cfg.SASL != nil {
 		opts = append(opts, kgo.SASL(cfg.SASL))
 	}
-	if len(cfg.CompressionCodec) > 0 {
+	if _, ok := cfg.Encoder.(codec.ContentEncoder); ok {
+		// The values are compressed already.
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.NoCompression()))
+	} else if len(cfg.CompressionCodec) > 0 {
 		opts = append(opts, kgo.ProducerBatchCompression(cfg.CompressionCodec...))
 	}
+	if cfg.Linger > 0 {
+		opts = append(opts, kgo.ProducerLinger(cfg.Linger))
+	}
+	backoff := cfg.ReconnectBackoff
+	if backoff == nil {
+		backoff = defaultReconnectBackoff
+	}
+	opts = append(opts, kgo.RetryBackoffFn(backoff))
+	if cfg.MaxBufferedRecords > 0 {
+		opts = append(opts, kgo.MaxBufferedRecords(cfg.MaxBufferedRecords))
+	}
+	if cfg.BrokerMaxWriteBytes > 0 {
+		opts = append(opts, kgo.BrokerMaxWriteBytes(cfg.BrokerMaxWriteBytes))
+	}
+	if cfg.RequestTimeoutOverhead > 0 {
+		opts = append(opts, kgo.RequestTimeoutOverhead(cfg.RequestTimeoutOverhead))
+	}
+	if cfg.ConnIdleTimeout > 0 {
+		opts = append(opts, kgo.ConnIdleTimeout(cfg.ConnIdleTimeout))
+	}
+	if cfg.DialTimeout > 0 {
+		opts = append(opts, kgo.DialTimeout(cfg.DialTimeout))
+	}
+	// Validate ensures the compat partitioner is known.
+	partitioner, _ := compatPartitioner(cfg.CompatPartitioner)
+	if len(cfg.PinnedPartitions) > 0 {
+		if partitioner == nil {
+			// The kgo default partitioner.
+			partitioner = kgo.UniformBytesPartitioner(64<<10, true, true, nil)
+		}
+		partitioner = pinnedPartitioner{
+			partitions:  cfg.PinnedPartitions,
+			Partitioner: partitioner,
+		}
+	}
+	if partitioner != nil {
+		opts = append(opts, kgo.RecordPartitioner(partitioner))
+	}
 	client, err := kgo.NewClient(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("kafka: failed creating producer: %w", err)
@@ -143,74 +969,1331 @@ func NewProducer(cfg ProducerConfig) (*Producer, error) {
 	// Issue a metadata refresh request on construction, so the broker list is
 	// populated.
 	client.ForceMetadataRefresh()
+	if cfg.WaitForMetadata > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.WaitForMetadata)
+		err := waitForBrokers(ctx, client, backoff)
+		cancel()
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("kafka: no broker reachable within %s: %w", cfg.WaitForMetadata, err)
+		}
+	}
+
+	ackClients := make(map[RequiredAcks]*kgo.Client)
+	for _, acks := range cfg.DurabilityByTopic {
+		if _, ok := ackClients[acks]; ok || acks == AllISRAcks {
+			continue
+		}
+		kacks, _ := acks.kgoAcks() // Already validated.
+		ackClient, err := kgo.NewClient(append(opts[:len(opts):len(opts)],
+			kgo.RequiredAcks(kacks), kgo.DisableIdempotentWrite(),
+		)...)
+		if err != nil {
+			client.Close()
+			for _, c := range ackClients {
+				c.Close()
+			}
+			return nil, fmt.Errorf("kafka: failed creating producer: %w", err)
+		}
+		ackClient.ForceMetadataRefresh()
+		ackClients[acks] = ackClient
+	}
+
+	var staticHeaders []kgo.RecordHeader
+	if cfg.EmitContentTypeHeader {
+		staticHeaders = append(staticHeaders, kgo.RecordHeader{
+			Key:   ContentTypeHeader,
+			Value: []byte(cfg.Encoder.(codec.ContentTyper).ContentType()),
+		})
+		if ce, ok := cfg.Encoder.(codec.ContentEncoder); ok {
+			staticHeaders = append(staticHeaders, kgo.RecordHeader{
+				Key:   ContentEncodingHeader,
+				Value: []byte(ce.ContentEncoding()),
+			})
+		}
+	}
+	if cfg.EmitProducerVersionHeader {
+		staticHeaders = append(staticHeaders, kgo.RecordHeader{
+			Key:   ProducerVersionHeader,
+			Value: []byte(cfg.Version),
+		})
+		if cfg.ClientID != "" {
+			staticHeaders = append(staticHeaders, kgo.RecordHeader{
+				Key:   ProducerClientIDHeader,
+				Value: []byte(cfg.ClientID),
+			})
+		}
+	}
+	if cfg.SchemaVersion != "" {
+		staticHeaders = append(staticHeaders, kgo.RecordHeader{
+			Key:   SchemaVersionHeader,
+			Value: []byte(cfg.SchemaVersion),
+		})
+	}
+
+	defaultHeaders := make([]kgo.RecordHeader, 0, len(cfg.DefaultHeaders))
+	for k, v := range cfg.DefaultHeaders {
+		defaultHeaders = append(defaultHeaders, kgo.RecordHeader{
+			Key:   k,
+			Value: []byte(v),
+		})
+	}
+	sort.Slice(defaultHeaders, func(i, j int) bool {
+		return defaultHeaders[i].Key < defaultHeaders[j].Key
+	})
+
+	var metadataKeys map[string]struct{}
+	if cfg.MetadataKeys != nil {
+		metadataKeys = make(map[string]struct{}, len(cfg.MetadataKeys))
+		for _, k := range cfg.MetadataKeys {
+			metadataKeys[k] = struct{}{}
+		}
+	}
+
+	p := &Producer{
+		cfg:            cfg,
+		client:         client,
+		ackClients:     ackClients,
+		metrics:        metrics,
+		staticHeaders:  staticHeaders,
+		defaultHeaders: defaultHeaders,
+		metadataKeys:   metadataKeys,
+		closed:         make(chan struct{}),
+		clock:          time.Now,
+	}
+	if cfg.MaxDistinctTopics > 0 {
+		p.topics = make(map[apmqueue.Topic]struct{}, cfg.MaxDistinctTopics)
+	}
+	if cfg.DrainMaxAge > 0 {
+		p.drain = newDrainTracker()
+	}
+	if len(cfg.EnsureMinPartitions) > 0 {
+		p.partitionChecks = newPartitionChecks()
+	}
+	if cfg.DedupWindow > 0 {
+		maxKeys := cfg.DedupMaxKeys
+		if maxKeys <= 0 {
+			maxKeys = 100000
+		}
+		p.dedup = newDedupCache(cfg.DedupWindow, maxKeys)
+	}
+	if cfg.IdleTimeout > 0 {
+		p.lastActive.Store(p.clock().UnixNano())
+		go p.closeWhenIdle()
+	}
+	return p, nil
+}
+
+// NewProducerFromConfig returns a new Producer with the connection settings
+// in shared merged into cfg. The producer-specific settings take precedence:
+// the shared ones are only used for the fields which aren't set in cfg, so
+// individual producers can override them, for example, to use a different
+// ClientID. The TLS config is only used when cfg has neither TLS nor a
+// TLSConfigProvider set.
+func NewProducerFromConfig(shared apmqueue.Config, cfg ProducerConfig) (*Producer, error) {
+	return NewProducer(mergeSharedConfig(shared, cfg))
+}
 
-	return &Producer{
-		cfg:    cfg,
-		client: client,
-	}, nil
+// mergeSharedConfig sets the fields of cfg which aren't set from shared.
+func mergeSharedConfig(shared apmqueue.Config, cfg ProducerConfig) ProducerConfig {
+	if len(cfg.Brokers) == 0 {
+		cfg.Brokers = shared.Brokers
+	}
+	if cfg.SASL == nil {
+		cfg.SASL = shared.SASL
+	}
+	if cfg.TLS == nil && cfg.TLSConfigProvider == nil {
+		cfg.TLS = shared.TLS
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = shared.ClientID
+	}
+	return cfg
 }
 
-// Close stops the producer
+// Close stops the producer. The records which haven't been produced yet fail
+// to be produced, use Shutdown to wait for them. Close waits for in-flight
+// ProcessBatch calls to return, and for the produce callbacks of the failed
+// records to complete, so no callback, such as the ErrorHandler, runs after
+// Close returns. The callbacks may call the producer while it's closing, in
+// which case the calls return ErrProducerClosed. Calling Close more than once
+// has no effect.
 func (p *Producer) Close() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.client.Close()
+	p.stop()
+	p.mu.Unlock()
+	// Wait without holding the lock, since the callbacks may call the
+	// producer. The Kafka client fails the buffered records when it's
+	// closed, but may call their promises after Close returns.
+	p.close()
+	p.inflight.Wait()
 	return nil
 }
 
+// Shutdown stops accepting new events, waits until all the buffered records
+// have been produced or ctx is done, and closes the producer. It returns an
+// error if ctx is done before the records are produced, or if any records
+// fail to be produced while shutting down. Calling Shutdown on a closed
+// producer has no effect.
+//
+// If ProducerConfig.DrainMaxAge is set, Shutdown stops waiting once all the
+// records left have been pending for longer than it, and the abandoned
+// records fail to be produced.
+func (p *Producer) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	stopped := p.stop()
+	p.mu.Unlock()
+	if !stopped {
+		return nil
+	}
+	return p.flushAndClose(ctx)
+}
+
+// flushAndClose waits until all the buffered records have been produced or
+// ctx is done, and closes the clients. The producer must be stopped. The lock
+// mustn't be held, since the produce callbacks may call the producer, which
+// rejects the calls once stopped.
+func (p *Producer) flushAndClose(ctx context.Context) error {
+	state := &shutdownState{}
+	p.shutdown.Store(state)
+	defer p.shutdown.Store(nil)
+
+	errs := p.flush(ctx)
+	// Closing the clients fails the records which couldn't be flushed, wait
+	// for them to be failed.
+	p.close()
+	p.inflight.Wait()
+	if n := state.failed.Load(); n > 0 {
+		errs = append(errs, fmt.Errorf(
+			"kafka: %d records failed to be produced during shutdown: %w",
+			n, *state.firstErr.Load(),
+		))
+	}
+	return errors.Join(errs...)
+}
+
+// CloseAll shuts down all the producers concurrently, sharing ctx, so they
+// drain their buffered records within the same deadline. See Shutdown.
+//
+// All the producers are closed, even if some of them fail to drain their
+// records: a failure doesn't prevent the rest of the producers from being
+// drained. The errors of the failed producers are joined with errors.Join,
+// each prefixed by the index of the producer in producers. Nil producers are
+// ignored.
+func CloseAll(ctx context.Context, producers ...*Producer) error {
+	errs := make([]error, len(producers))
+	var wg sync.WaitGroup
+	for i, p := range producers {
+		if p == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, p *Producer) {
+			defer wg.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("kafka: failed closing producer %d: %w", i, err)
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// stop stops the producer from accepting calls, returning false if it was
+// stopped already. It must be called with the write lock held, so no calls
+// are in progress once it returns.
+func (p *Producer) stop() bool {
+	select {
+	case <-p.closed:
+		return false
+	default:
+		close(p.closed)
+		return true
+	}
+}
+
+// close closes the clients if they haven't been closed, failing the buffered
+// records. The producer must be stopped.
+func (p *Producer) close() {
+	p.closeClients.Do(func() {
+		p.client.Close()
+		for _, client := range p.ackClients {
+			client.Close()
+		}
+	})
+}
+
+// idleFlushTimeout bounds the time the buffered records are flushed for when
+// the producer is closed because it's idle, see ProducerConfig.IdleTimeout.
+const idleFlushTimeout = 30 * time.Second
+
+// closeWhenIdle shuts the producer down once it has been idle for longer than
+// cfg.IdleTimeout, or returns when the producer is closed. The buffered
+// records are flushed for up to idleFlushTimeout, like in Shutdown.
+func (p *Producer) closeWhenIdle() {
+	timer := time.NewTimer(p.cfg.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-timer.C:
+		}
+		p.mu.Lock()
+		idle := p.clock().Sub(time.Unix(0, p.lastActive.Load()))
+		if idle >= p.cfg.IdleTimeout {
+			p.cfg.Logger.Info("closing idle producer", zap.Duration("idle", idle))
+			p.stop()
+			p.mu.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), idleFlushTimeout)
+			defer cancel()
+			if err := p.flushAndClose(ctx); err != nil {
+				p.cfg.Logger.Warn("failed closing idle producer", zap.Error(err))
+			}
+			return
+		}
+		p.mu.Unlock()
+		timer.Reset(p.cfg.IdleTimeout - idle)
+	}
+}
+
 // ProcessBatch publishes the events in batch to the specified Kafka topic.
+//
+// The context metadata is read once, when ProcessBatch is called, and the
+// resulting headers are shared by all the records in the batch. Changes to
+// the metadata map after that point aren't reflected in the produced records.
+//
+// The records for all the events are built before any of them is produced,
+// so if building any of them fails, for example, because a Mutator returns
+// an error, the error is returned without producing any record. Panics in the
+// Encoder, Mutators or HeaderMutators are recovered and treated like the
+// errors they return, and the panic and its stack are logged.
+//
+// ProcessBatch waits for the records to be produced if the producer is Sync,
+// or the batch has fewer events than the AdaptiveSyncThreshold.
 func (p *Producer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
 	// Take a read lock to prevent Close from closing the client
 	// while we're attempting to produce records.
 	p.mu.RLock()
 	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return err
+	}
+	defer p.recordActivity()
+	p.recordBatchEvents(batch)
 
-	var headers []kgo.RecordHeader
-	if m, ok := queuecontext.MetadataFromContext(ctx); ok {
-		for k, v := range m {
-			headers = append(headers, kgo.RecordHeader{
-				Key:   k,
-				Value: []byte(v),
-			})
+	// The threshold applies to the events passed to ProcessBatch, before
+	// any of them is deduplicated or dropped.
+	wait := p.cfg.Sync || len(*batch) < p.cfg.AdaptiveSyncThreshold
+	records, err := p.prepareBatch(ctx, batch)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(records))
+	for _, record := range records {
+		p.recordSize(record)
+		p.produce(ctx, record, p.produceCallback(&wg))
+	}
+	if wait {
+		return waitProduced(ctx, &wg)
+	}
+	return nil
+}
+
+// prepareBatch deduplicates the events in batch and builds their records,
+// ensuring their topics have enough partitions. It must be called with the
+// read lock held.
+func (p *Producer) prepareBatch(ctx context.Context, batch *model.Batch) ([]*kgo.Record, error) {
+	var keys []string
+	if p.dedup != nil {
+		var deduped model.Batch
+		deduped, keys = p.deduplicate(*batch)
+		batch = &deduped
+	}
+	records, err := p.buildRecords(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	if p.topics != nil {
+		topics := make([]apmqueue.Topic, len(records))
+		for i, r := range records {
+			topics[i] = apmqueue.Topic(r.Topic)
+		}
+		if err := p.trackTopics(topics); err != nil {
+			return nil, err
+		}
+	}
+	if p.cfg.RecordIDGenerator != nil {
+		p.stampRecordIDs(records)
+	}
+	if len(p.cfg.EnsureMinPartitions) > 0 {
+		if err := p.ensureMinPartitions(ctx, records); err != nil {
+			return nil, err
 		}
 	}
+	if p.dedup != nil {
+		p.dedup.add(keys, p.clock())
+	}
+	p.stats.batches.Add(1)
+	return records, nil
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(*batch))
+// recordBatchEvents records the number of events in batch in the
+// producer.batch.events metric.
+func (p *Producer) recordBatchEvents(batch *model.Batch) {
+	p.metrics.batchEvents.Record(context.Background(), int64(len(*batch)))
+}
+
+// recordSize records the size of the record value in the producer.record.size
+// metric.
+func (p *Producer) recordSize(record *kgo.Record) {
+	p.metrics.recordSize.Record(context.Background(), int64(len(record.Value)),
+		attribute.String("topic", record.Topic),
+	)
+}
+
+// deduplicate returns the events in batch whose idempotency key hasn't been
+// seen within the dedup window, nor earlier in the batch, and their keys.
+func (p *Producer) deduplicate(batch model.Batch) (model.Batch, []string) {
+	now := p.clock()
+	deduped := make(model.Batch, 0, len(batch))
+	keys := make([]string, 0, len(batch))
+	inBatch := make(map[string]struct{}, len(batch))
+	for _, event := range batch {
+		key := p.cfg.IdempotencyKey(event)
+		if _, ok := inBatch[key]; ok || p.dedup.contains(key, now) {
+			p.recordDropped(dropReasonDuplicate)
+			continue
+		}
+		inBatch[key] = struct{}{}
+		deduped = append(deduped, event)
+		keys = append(keys, key)
+	}
+	return deduped, keys
+}
+
+// BuildRecords returns the records which ProcessBatch would produce for the
+// events in batch, without producing them. The TopicRouter, Encoder, Mutators
+// and the rest of the configured functions are applied like in ProcessBatch,
+// which makes it useful to test them in isolation. Like in ProcessBatch, the
+// events are counted by the producer.events.routed and producer.events.dropped
+// metrics. BuildRecords doesn't require a reachable broker, and can be called
+// once the producer is closed.
+//
+// BuildRecords has no effect on the state of the producer: the topics aren't
+// counted towards MaxDistinctTopics, though ErrTooManyTopics is returned if
+// producing the records would exceed the limit, and the RecordIDGenerator
+// isn't called, so the records don't hold the RecordIDHeader header.
+func (p *Producer) BuildRecords(ctx context.Context, batch *model.Batch) ([]*kgo.Record, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.buildRecords(ctx, batch)
+}
+
+// Render returns the records for the events in batch for the caller to
+// produce them elsewhere, for example, to tee them to an audit sink. The
+// events go through the same routing, encoding, mutators and header
+// construction as in ProcessBatch, but the records aren't produced.
+//
+// Unlike BuildRecords, the records are complete: the RecordIDGenerator is
+// called for each of them, like in ProcessBatch, and each record holds its
+// own copy of the headers, so the caller can modify them. Like BuildRecords,
+// the events are counted by the producer.events.routed and
+// producer.events.dropped metrics, but the topics don't count towards
+// MaxDistinctTopics, and the events aren't deduplicated.
+func (p *Producer) Render(ctx context.Context, batch *model.Batch) ([]*kgo.Record, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	records, err := p.buildRecords(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		// The headers may be shared by the records of an event routed to
+		// multiple topics, and by the context metadata headers.
+		r.Headers = append([]kgo.RecordHeader(nil), r.Headers...)
+	}
+	if p.cfg.RecordIDGenerator != nil {
+		p.stampRecordIDs(records)
+	}
+	return records, nil
+}
+
+// buildRecords builds the records for the events in batch. Events routed to
+// more than one topic result in a record per topic. It must be called with the
+// read lock held.
+func (p *Producer) buildRecords(ctx context.Context, batch *model.Batch) ([]*kgo.Record, error) {
+	headers := p.recordHeaders(ctx)
+	if p.cfg.PropagateBaggage {
+		headers = p.appendBaggageHeader(ctx, headers)
+	}
+	var timestamp time.Time
+	if p.cfg.TimestampMetadataKey != "" {
+		timestamp = p.metadataTimestamp(ctx)
+	}
+	records := make([]*kgo.Record, 0, len(*batch))
+	topics := make([]apmqueue.Topic, 0, 1)
+	// newTopics holds the topics routed to in the batch which count towards
+	// cfg.MaxDistinctTopics, nil if it isn't set.
+	var newTopics map[apmqueue.Topic]struct{}
+	if p.topics != nil {
+		newTopics = make(map[apmqueue.Topic]struct{})
+	}
 	for _, event := range *batch {
+		var err error
+		if topics, err = p.route(event, topics[:0], newTopics); err != nil {
+			return nil, err
+		}
+		if len(topics) == 0 {
+			p.recordDropped(dropReasonRouted)
+			continue
+		}
+		p.recordRouted(topics)
 		record := &kgo.Record{
-			Headers: headers,
-			Topic:   string(p.cfg.TopicRouter(event)),
+			// Use a full slice expression to ensure the shared headers
+			// are copied, rather than modified, when appending to them.
+			Headers: headers[:len(headers):len(headers)],
+			Topic:   string(topics[0]),
 		}
-		for _, rm := range p.cfg.Mutators {
-			if err := rm(event, record); err != nil {
-				return fmt.Errorf("failed to apply record mutator: %w", err)
+		if p.cfg.TimestampMetadataKey != "" {
+			// A zero timestamp is set to the produce time by the client.
+			record.Timestamp = timestamp
+			if timestamp.IsZero() {
+				record.Timestamp = event.Timestamp
 			}
 		}
-		encoded, err := p.cfg.Encoder.Encode(event)
-		if err != nil {
-			return fmt.Errorf("failed to encode event: %w", err)
+		if p.cfg.IdempotencyKey != nil {
+			key := p.cfg.IdempotencyKey(event)
+			record.Headers = append(record.Headers,
+				kgo.RecordHeader{Key: IdempotencyKeyHeader, Value: []byte(key)},
+			)
+			if p.cfg.IdempotencyKeyAsRecordKey {
+				record.Key = []byte(key)
+			}
 		}
-		record.Value = encoded
-		p.client.Produce(ctx, record, func(msg *kgo.Record, err error) {
-			defer wg.Done()
+		if p.cfg.KeyRouter != nil {
+			key, err := p.recordKey(event)
 			if err != nil {
-				p.cfg.Logger.Error("failed producing message",
-					zap.Error(err),
-					zap.String("topic", msg.Topic),
-					zap.Int64("offset", msg.Offset),
-					zap.Int32("partition", msg.Partition),
-					zap.Any("headers", headers),
+				return nil, err
+			}
+			record.Key = key
+		}
+		if p.cfg.RecordTTL != nil {
+			ttl := p.cfg.RecordTTL(event)
+			if ttl < 0 {
+				p.recordDropped(dropReasonExpired)
+				continue
+			}
+			if ttl > 0 {
+				expiresAt := p.clock().Add(ttl).UnixMilli()
+				record.Headers = append(record.Headers, kgo.RecordHeader{
+					Key:   ExpiresAtHeader,
+					Value: strconv.AppendInt(nil, expiresAt, 10),
+				})
+			}
+		}
+		if p.cfg.SpanLinkExtractor != nil {
+			if link := p.cfg.SpanLinkExtractor(event); link != "" {
+				record.Headers = append(record.Headers,
+					kgo.RecordHeader{Key: SpanLinkHeader, Value: []byte(link)},
 				)
 			}
-		})
-	}
-	if p.cfg.Sync {
-		wg.Wait()
-	}
+		}
+		for _, hm := range p.cfg.HeaderMutators {
+			if err := p.applyHeaderMutator(hm, event, record); err != nil {
+				return nil, fmt.Errorf("failed to apply header mutator: %w", err)
+			}
+		}
+		for _, rm := range p.cfg.Mutators {
+			if err := p.applyMutator(rm, event, record); err != nil {
+				return nil, fmt.Errorf("failed to apply record mutator: %w", err)
+			}
+		}
+		for _, nm := range p.cfg.NamedMutators {
+			if err := p.applyMutator(nm.Mutate, event, record); err != nil {
+				return nil, fmt.Errorf("failed to apply record mutator %s: %w", nm.Name(), err)
+			}
+		}
+		// A mutator may have set the value already, in which case it takes
+		// precedence over the encoder.
+		if record.Value == nil {
+			encoded, err := p.encode(event)
+			if err != nil {
+				if !p.cfg.SkipEncodeErrors {
+					return nil, fmt.Errorf("failed to encode event: %w", err)
+				}
+				p.cfg.Logger.Warn("skipping event which failed to be encoded",
+					zap.Error(err),
+				)
+				p.recordDropped(dropReasonEncodeError)
+				continue
+			}
+			if len(encoded) == 0 {
+				p.recordDropped(dropReasonEmpty)
+				continue
+			}
+			record.Value = encoded
+		}
+		if p.cfg.FinalizeRecord != nil {
+			if err := p.finalizeRecord(event, record); err != nil {
+				return nil, fmt.Errorf("failed to finalize record: %w", err)
+			}
+		}
+		records = append(records, record)
+		for _, topic := range topics[1:] {
+			// The encoded value and headers are shared by the copies.
+			records = append(records, &kgo.Record{
+				Key:       record.Key,
+				Value:     record.Value,
+				Headers:   record.Headers,
+				Topic:     string(topic),
+				Timestamp: record.Timestamp,
+			})
+		}
+	}
+	return records, nil
+}
+
+// stampRecordIDs adds the RecordIDHeader header, generated by
+// cfg.RecordIDGenerator, to each of the records.
+func (p *Producer) stampRecordIDs(records []*kgo.Record) {
+	for _, r := range records {
+		// Use a full slice expression, since the headers may be shared.
+		r.Headers = append(r.Headers[:len(r.Headers):len(r.Headers)], kgo.RecordHeader{
+			Key: RecordIDHeader, Value: []byte(p.cfg.RecordIDGenerator()),
+		})
+	}
+}
+
+// metadataTimestamp returns the timestamp held by the context metadata in
+// cfg.TimestampMetadataKey, or the zero time if it isn't set or is invalid.
+func (p *Producer) metadataTimestamp(ctx context.Context) time.Time {
+	m, _ := queuecontext.MetadataFromContext(ctx)
+	v, ok := m[p.cfg.TimestampMetadataKey]
+	if !ok {
+		return time.Time{}
+	}
+	if millis, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(millis)
+	}
+	// RFC3339Nano parses RFC3339 times with or without fractional seconds.
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		p.cfg.Logger.Warn("ignoring invalid timestamp in context metadata",
+			zap.String("key", p.cfg.TimestampMetadataKey),
+			zap.String("value", v),
+		)
+		return time.Time{}
+	}
+	return t
+}
+
+// waitProduced waits for the records tracked by wg to be produced, or returns
+// the context error as soon as ctx is done, in which case the callbacks
+// complete in the background.
+func waitProduced(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// route appends the topics where the event should be produced to topics,
+// returning an error if any of them isn't allowed, or exceeds the limit of
+// distinct topics along with the newTopics routed to earlier in the batch.
+func (p *Producer) route(event model.APMEvent, topics []apmqueue.Topic, newTopics map[apmqueue.Topic]struct{}) ([]apmqueue.Topic, error) {
+	if p.cfg.MultiTopicRouter != nil {
+		topics = append(topics, p.cfg.MultiTopicRouter(event)...)
+	} else {
+		topics = append(topics, p.cfg.TopicRouter(event))
+	}
+	if p.cfg.AllowedTopics != nil {
+		var errs []error
+		for _, topic := range topics {
+			if !p.cfg.AllowedTopics.Contains(topic) {
+				errs = append(errs, fmt.Errorf("%w: %q", ErrTopicNotAllowed, topic))
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			return topics, err
+		}
+	}
+	if p.topics != nil {
+		return topics, p.checkTopics(topics, newTopics)
+	}
+	return topics, nil
+}
+
+// recordKey returns the record key of the event, as returned by the
+// cfg.KeyRouter. In changelog mode, empty keys are an error.
+func (p *Producer) recordKey(event model.APMEvent) ([]byte, error) {
+	key := p.cfg.KeyRouter(event)
+	if key == "" {
+		if p.cfg.Changelog {
+			return nil, errors.New("kafka: changelog record key cannot be empty")
+		}
+		return nil, nil
+	}
+	return []byte(key), nil
+}
+
+// checkTopics adds the topics which weren't routed to before to newTopics,
+// returning an error if any of them exceeds cfg.MaxDistinctTopics along with
+// the topics routed to and newTopics. The topics routed to aren't modified.
+func (p *Producer) checkTopics(topics []apmqueue.Topic, newTopics map[apmqueue.Topic]struct{}) error {
+	p.topicsMu.Lock()
+	defer p.topicsMu.Unlock()
+	for _, topic := range topics {
+		if _, ok := p.topics[topic]; ok {
+			continue
+		}
+		if _, ok := newTopics[topic]; ok {
+			continue
+		}
+		if len(p.topics)+len(newTopics) >= p.cfg.MaxDistinctTopics {
+			return tooManyTopicsError(topic, p.cfg.MaxDistinctTopics)
+		}
+		newTopics[topic] = struct{}{}
+	}
+	return nil
+}
+
+// trackTopics adds the topics to the topics routed to. If any of them exceeds
+// cfg.MaxDistinctTopics, which may happen when batches are processed
+// concurrently, none are added and an error is returned.
+func (p *Producer) trackTopics(topics []apmqueue.Topic) error {
+	p.topicsMu.Lock()
+	defer p.topicsMu.Unlock()
+	newTopics := make(map[apmqueue.Topic]struct{})
+	for _, topic := range topics {
+		if _, ok := p.topics[topic]; ok {
+			continue
+		}
+		if _, ok := newTopics[topic]; ok {
+			continue
+		}
+		if len(p.topics)+len(newTopics) >= p.cfg.MaxDistinctTopics {
+			return tooManyTopicsError(topic, p.cfg.MaxDistinctTopics)
+		}
+		newTopics[topic] = struct{}{}
+	}
+	for topic := range newTopics {
+		p.topics[topic] = struct{}{}
+	}
+	return nil
+}
+
+func tooManyTopicsError(topic apmqueue.Topic, limit int) error {
+	return fmt.Errorf("%w: %q exceeds the limit of %d topics", ErrTooManyTopics, topic, limit)
+}
+
+// produce produces the record, recording whether producing it blocked.
+func (p *Producer) produce(ctx context.Context, record *kgo.Record, promise func(*kgo.Record, error)) {
+	start := time.Now()
+	p.clientFor(record.Topic).Produce(ctx, record, promise)
+	if time.Since(start) > produceBlockedThreshold {
+		// Produce may have returned because ctx is done, in which case
+		// the measurement would be dropped if recorded with ctx.
+		p.metrics.produceBlocked.Add(context.Background(), 1,
+			attribute.String("topic", record.Topic),
+		)
+	}
+}
+
+// recordRouted increments the producer.events.routed metric for the topics an
+// event is routed to.
+func (p *Producer) recordRouted(topics []apmqueue.Topic) {
+	for _, topic := range topics {
+		p.metrics.eventsRouted.Add(context.Background(), 1,
+			attribute.String("topic", string(topic)),
+		)
+	}
+}
+
+// recordDropped records an event which was dropped for reason.
+func (p *Producer) recordDropped(reason string) {
+	p.metrics.eventsDropped.Add(context.Background(), 1,
+		attribute.String("reason", reason),
+	)
+}
+
+// applyHeaderMutator adds the header returned by hm to the record, converting
+// panics into errors.
+func (p *Producer) applyHeaderMutator(hm HeaderMutator, event model.APMEvent, record *kgo.Record) (err error) {
+	defer p.recoverPanic("header mutator", &err)
+	if key, value, ok := hm(event); ok {
+		record.Headers = append(record.Headers,
+			kgo.RecordHeader{Key: key, Value: value},
+		)
+	}
+	return nil
+}
+
+// applyMutator applies rm to the record, converting panics into errors.
+func (p *Producer) applyMutator(rm RecordMutator, event model.APMEvent, record *kgo.Record) (err error) {
+	defer p.recoverPanic("record mutator", &err)
+	return rm(event, record)
+}
+
+// MutatorCount returns the number of mutators applied to the records, that
+// is, the Mutators and the NamedMutators.
+func (p *Producer) MutatorCount() int {
+	return len(p.cfg.Mutators) + len(p.cfg.NamedMutators)
+}
+
+// MutatorNames returns the names of the mutators applied to the records, in
+// the order they're applied in. The NamedMutators are reported by name, and
+// the Mutators by the name of their function, as reported by the runtime,
+// for example, "main.setKey" or "main.main.func1" for function literals.
+func (p *Producer) MutatorNames() []string {
+	names := make([]string, 0, p.MutatorCount())
+	for _, rm := range p.cfg.Mutators {
+		name := "unknown"
+		if fn := runtime.FuncForPC(reflect.ValueOf(rm).Pointer()); fn != nil {
+			name = fn.Name()
+		}
+		names = append(names, name)
+	}
+	for _, nm := range p.cfg.NamedMutators {
+		names = append(names, nm.Name())
+	}
+	return names
+}
+
+// finalizeRecord calls FinalizeRecord with the record, converting panics into
+// errors.
+func (p *Producer) finalizeRecord(event model.APMEvent, record *kgo.Record) (err error) {
+	defer p.recoverPanic("record finalizer", &err)
+	return p.cfg.FinalizeRecord(event, record)
+}
+
+// encode encodes the event with the configured Encoder, and validates the
+// encoded value with the OutputValidator, if set, converting panics into
+// errors.
+func (p *Producer) encode(event model.APMEvent) (encoded []byte, err error) {
+	defer p.recoverPanic("encoder", &err)
+	if encoded, err = p.cfg.Encoder.Encode(event); err != nil {
+		return nil, err
+	}
+	if p.cfg.OutputValidator != nil {
+		if err := p.cfg.OutputValidator(encoded); err != nil {
+			return nil, fmt.Errorf("invalid encoded event: %w", err)
+		}
+	}
+	return encoded, nil
+}
+
+// recoverPanic recovers from a panic in the user provided function name,
+// logging it and setting err. It must be called directly by defer.
+func (p *Producer) recoverPanic(name string, err *error) {
+	if r := recover(); r != nil {
+		p.cfg.Logger.Error(name+" panicked",
+			zap.Any("panic", r),
+			zap.Stack("stack"),
+		)
+		*err = fmt.Errorf("kafka: %s panicked: %v", name, r)
+	}
+}
+
+// ProduceTombstone produces a tombstone, a record with the given key and a nil
+// value, to the topic. On log compacted topics, tombstones cause all the
+// previous records with the same key to be deleted during compaction.
+//
+// The TopicRouter, Encoder and Mutators aren't applied to tombstones, but the
+// context metadata is still added as record headers.
+func (p *Producer) ProduceTombstone(ctx context.Context, topic apmqueue.Topic, key []byte) error {
+	if len(key) == 0 {
+		return errors.New("kafka: tombstone key cannot be empty")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return err
+	}
+	defer p.recordActivity()
+	return p.produceTombstones(ctx, []apmqueue.Topic{topic}, key)
+}
+
+// ProduceEventTombstone produces a tombstone for the entity the event
+// describes, deleting it from log compacted topics. The event is routed like
+// in ProcessBatch, and the tombstone key is returned by the KeyRouter, which
+// must be set and return a non-empty key. With the MultiTopicRouter, a
+// tombstone is produced to each topic. Only the context metadata is added as
+// record headers.
+func (p *Producer) ProduceEventTombstone(ctx context.Context, event model.APMEvent) error {
+	if p.cfg.KeyRouter == nil {
+		return errors.New("kafka: key router must be set to produce event tombstones")
+	}
+	key := p.cfg.KeyRouter(event)
+	if key == "" {
+		return errors.New("kafka: tombstone key cannot be empty")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return err
+	}
+	defer p.recordActivity()
+	var newTopics map[apmqueue.Topic]struct{}
+	if p.topics != nil {
+		newTopics = make(map[apmqueue.Topic]struct{})
+	}
+	topics, err := p.route(event, nil, newTopics)
+	if err != nil {
+		return err
+	}
+	if p.topics != nil {
+		if err := p.trackTopics(topics); err != nil {
+			return err
+		}
+	}
+	return p.produceTombstones(ctx, topics, []byte(key))
+}
+
+// produceTombstones produces a tombstone with the key to each of the topics.
+// It must be called with the read lock held.
+func (p *Producer) produceTombstones(ctx context.Context, topics []apmqueue.Topic, key []byte) error {
+	headers := p.recordHeaders(ctx)
+	var wg sync.WaitGroup
+	wg.Add(len(topics))
+	for _, topic := range topics {
+		p.clientFor(string(topic)).Produce(ctx, &kgo.Record{
+			Headers: headers,
+			Topic:   string(topic),
+			Key:     key,
+		}, p.produceCallback(&wg))
+	}
+	if p.cfg.Sync {
+		return waitProduced(ctx, &wg)
+	}
+	return nil
+}
+
+// ProduceRecords produces the given records as they are, which is useful to
+// forward records which are already encoded, for example, when bulk copying
+// records between clusters, without wrapping them in a model.APMEvent.
+//
+// The TopicRouter, Encoder, Mutators and HeaderMutators aren't applied, and
+// each record must have its Topic set. The context metadata is appended to
+// the record headers. The records are copied before being produced, so the
+// caller may reuse the slice once ProduceRecords returns. If the producer is
+// Sync, ProduceRecords waits for all the records to be produced. Use
+// MarkerRecord to produce control markers alongside the data records.
+func (p *Producer) ProduceRecords(ctx context.Context, records []kgo.Record) error {
+	for i, r := range records {
+		if r.Topic == "" {
+			return fmt.Errorf("kafka: record %d has no topic", i)
+		}
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return err
+	}
+	defer p.recordActivity()
+
+	meta := p.metadataHeaders(ctx)
+	var wg sync.WaitGroup
+	wg.Add(len(records))
+	for _, r := range records {
+		record := &kgo.Record{
+			Topic: r.Topic,
+			Key:   r.Key,
+			Value: r.Value,
+			// Use a full slice expression to avoid modifying the caller's
+			// headers when appending to them.
+			Headers:   append(r.Headers[:len(r.Headers):len(r.Headers)], meta...),
+			Timestamp: r.Timestamp,
+		}
+		p.clientFor(record.Topic).Produce(ctx, record, p.produceCallback(&wg))
+	}
+	if p.cfg.Sync {
+		return waitProduced(ctx, &wg)
+	}
 	return nil
 }
 
+// Replay produces the records stored in the configured Spooler, removing the
+// successfully produced records from it. The records which fail with a fatal
+// error are logged and dropped, since they would never be produced. Replay
+// stops on the first record which fails with any other error and returns it,
+// keeping the remaining records in the spool.
+func (p *Producer) Replay(ctx context.Context) error {
+	if p.cfg.Spooler == nil {
+		return errors.New("kafka: spooler not configured")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return err
+	}
+	defer p.recordActivity()
+	return p.cfg.Spooler.Drain(func(r *kgo.Record) error {
+		err := p.clientFor(r.Topic).ProduceSync(ctx, r).FirstErr()
+		if err == nil {
+			return nil
+		}
+		if class := ClassifyProduceError(err); !spoolable(err, class) {
+			// The record would block the spool forever, drop it.
+			p.cfg.Logger.Error("dropping spooled record which can't be produced",
+				zap.Error(err),
+				zap.Stringer("error_class", class),
+				zap.String("topic", r.Topic),
+			)
+			return nil
+		}
+		return fmt.Errorf("kafka: failed replaying spooled record: %w", err)
+	})
+}
+
+// spoolable returns true if a record which failed to be produced with err,
+// of the given class, may be produced when replayed. Fatal errors, except the
+// ones caused by the producer being closed or the context being cancelled,
+// fail the record again when it's replayed.
+func spoolable(err error, class ErrorClass) bool {
+	return class != ErrorClassFatal ||
+		errors.Is(err, kgo.ErrClientClosed) ||
+		errors.Is(err, context.Canceled)
+}
+
+// ReplayRecords produces the events held by the records again, for example,
+// records read from a topic to replay them through the producer. The record
+// values are decoded with the decoder, and the events are produced with
+// ProcessBatch, with the record headers restored as the context metadata (see
+// queuecontext.WithMetadataFromHeaders), so the produced records keep the
+// metadata the original records were produced with. The records' topics are
+// ignored, the events are routed by the TopicRouter.
+//
+// All the headers become metadata, including those added by the producer,
+// such as the IdempotencyKeyHeader. Set MetadataKeys to only keep some. The
+// events are produced one at a time, since records may hold distinct
+// headers, and ReplayRecords stops on the first error.
+func (p *Producer) ReplayRecords(ctx context.Context, decoder Decoder, records []*kgo.Record) error {
+	for _, r := range records {
+		var event model.APMEvent
+		if err := decoder.Decode(r.Value, &event); err != nil {
+			return fmt.Errorf("kafka: failed decoding record at offset %d: %w", r.Offset, err)
+		}
+		batch := model.Batch{event}
+		if err := p.ProcessBatch(queuecontext.WithMetadataFromHeaders(ctx, r.Headers), &batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateTopics returns an error naming the expected topics which don't exist
+// in the Kafka cluster. It can be called on startup to ensure all the topics a
+// TopicRouter may return exist, since records produced to missing topics are
+// dropped. The names of the topics are checked with ValidateTopic first, and
+// the errors for the invalid names are returned without querying the cluster.
+func (p *Producer) ValidateTopics(ctx context.Context, expected ...apmqueue.Topic) error {
+	if len(expected) == 0 {
+		return nil
+	}
+	var invalid []error
+	for _, topic := range expected {
+		if err := ValidateTopic(topic); err != nil {
+			invalid = append(invalid, err)
+		}
+	}
+	if err := errors.Join(invalid...); err != nil {
+		return err
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return err
+	}
+	defer p.recordActivity()
+	topics := make([]string, len(expected))
+	for i, topic := range expected {
+		topics[i] = string(topic)
+	}
+	// The admin client must not be closed, since it closes the underlying
+	// client.
+	details, err := kadm.NewClient(p.client).ListTopics(ctx, topics...)
+	if err != nil {
+		return fmt.Errorf("kafka: failed listing topics: %w", err)
+	}
+	var missing []string
+	for _, topic := range topics {
+		detail, ok := details[topic]
+		switch {
+		case !ok, errors.Is(detail.Err, kerr.UnknownTopicOrPartition):
+			missing = append(missing, topic)
+		case detail.Err != nil:
+			return fmt.Errorf("kafka: failed listing topic %s: %w", topic, detail.Err)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kafka: missing topics: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// compatPartitioner returns the kgo.Partitioner for the CompatPartitioner
+// mode, or nil if mode is empty.
+func compatPartitioner(mode string) (kgo.Partitioner, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case CompatPartitionerJavaMurmur2:
+		// A nil hasher masks and mods the murmur2 hash of the keys exactly
+		// like the Java client.
+		return kgo.StickyKeyPartitioner(nil), nil
+	}
+	return nil, fmt.Errorf("kafka: unknown compat partitioner %q", mode)
+}
+
+// pinnedPartitioner is a kgo.Partitioner which produces the records of the
+// pinned topics to their partition, and uses the embedded Partitioner for the
+// rest of the topics.
+type pinnedPartitioner struct {
+	kgo.Partitioner
+	partitions map[apmqueue.Topic]int32
+}
+
+func (p pinnedPartitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	if partition, ok := p.partitions[apmqueue.Topic(topic)]; ok {
+		return pinnedTopicPartitioner(partition)
+	}
+	return p.Partitioner.ForTopic(topic)
+}
+
+// pinnedTopicPartitioner is a kgo.TopicPartitioner which always returns the
+// same partition.
+type pinnedTopicPartitioner int32
+
+// RequiresConsistency returns true, so records are never produced to a
+// different partition while the pinned one is unavailable.
+func (pinnedTopicPartitioner) RequiresConsistency(*kgo.Record) bool { return true }
+
+func (p pinnedTopicPartitioner) Partition(*kgo.Record, int) int { return int(p) }
+
+// clientFor returns the client used to produce records to topic.
+func (p *Producer) clientFor(topic string) *kgo.Client {
+	if acks, ok := p.cfg.DurabilityByTopic[apmqueue.Topic(topic)]; ok {
+		if client, ok := p.ackClients[acks]; ok {
+			return client
+		}
+	}
+	return p.client
+}
+
+// ready returns ErrProducerClosed if the producer has been closed. It must be
+// called with the read lock held. Calls which pass must defer recordActivity.
+func (p *Producer) ready() error {
+	select {
+	case <-p.closed:
+		return ErrProducerClosed
+	default:
+	}
+	return nil
+}
+
+// recordActivity records the producer activity when a call returns, so the
+// producer isn't idle while calls are in progress, however long they take. It
+// must be called with the read lock held.
+func (p *Producer) recordActivity() {
+	if p.cfg.IdleTimeout > 0 {
+		p.lastActive.Store(p.clock().UnixNano())
+	}
+}
+
+// produceCallback returns a kgo.Client.Produce promise which logs produce
+// failures, spools the failed records if a Spooler is set, and marks wg as
+// done. It must be called once per produced record, with the read lock held.
+func (p *Producer) produceCallback(wg *sync.WaitGroup) func(*kgo.Record, error) {
+	p.inflight.Add(1)
+	var drainID uint64
+	if p.drain != nil {
+		drainID = p.drain.add(p.clock())
+	}
+	return func(msg *kgo.Record, err error) {
+		defer p.inflight.Done()
+		defer wg.Done()
+		if p.drain != nil {
+			p.drain.remove(drainID)
+		}
+		p.stats.recordProduced(msg, err)
+		if err == nil {
+			return
+		}
+		if state := p.shutdown.Load(); state != nil {
+			state.firstErr.CompareAndSwap(nil, &err)
+			state.failed.Add(1)
+		}
+		class := ClassifyProduceError(err)
+		p.cfg.Logger.Error("failed producing message",
+			zap.Error(err),
+			zap.Stringer("error_class", class),
+			zap.String("topic", msg.Topic),
+			zap.Int64("offset", msg.Offset),
+			zap.Int32("partition", msg.Partition),
+			zap.Any("headers", msg.Headers),
+		)
+		if p.cfg.ErrorHandler != nil {
+			p.cfg.ErrorHandler(msg, err, class)
+		}
+		if p.cfg.Spooler != nil && spoolable(err, class) {
+			// Spool a copy of the record, since msg holds the produce state,
+			// such as its context, which mustn't be reused on replay.
+			if err := p.cfg.Spooler.Append(&kgo.Record{
+				Topic:   msg.Topic,
+				Key:     msg.Key,
+				Value:   msg.Value,
+				Headers: msg.Headers,
+			}); err != nil {
+				p.cfg.Logger.Error("failed spooling message",
+					zap.Error(err),
+					zap.String("topic", msg.Topic),
+				)
+			}
+		}
+	}
+}
+
+// appendBaggageHeader appends the baggage stored in ctx to headers.
+func (p *Producer) appendBaggageHeader(ctx context.Context, headers []kgo.RecordHeader) []kgo.RecordHeader {
+	b := baggage.FromContext(ctx)
+	if b.Len() == 0 {
+		return headers
+	}
+	value := b.String()
+	if len(value) > maxBaggageBytes {
+		p.cfg.Logger.Warn("baggage exceeds the maximum size, not propagating it",
+			zap.Int("size", len(value)),
+		)
+		return headers
+	}
+	return append(headers, kgo.RecordHeader{Key: BaggageHeader, Value: []byte(value)})
+}
+
+// TraceSpanLink returns the span link of the event, formatted as the trace ID
+// and the span ID separated by a dash, "<trace-id>-<span-id>", like in the W3C
+// traceparent header. The span ID is the ID of the event's span, or of its
+// transaction if it isn't a span. It returns an empty string for events
+// without a trace ID or a span ID, such as metrics. It can be used as the
+// ProducerConfig.SpanLinkExtractor.
+func TraceSpanLink(event model.APMEvent) string {
+	var spanID string
+	switch {
+	case event.Span != nil:
+		spanID = event.Span.ID
+	case event.Transaction != nil:
+		spanID = event.Transaction.ID
+	}
+	if event.Trace.ID == "" || spanID == "" {
+		return ""
+	}
+	return event.Trace.ID + "-" + spanID
+}
+
+// RecordExpired returns true if the record has the ExpiresAtHeader set to a
+// time before now. Records without a valid ExpiresAtHeader never expire.
+func RecordExpired(record *kgo.Record, now time.Time) bool {
+	for _, h := range record.Headers {
+		if h.Key != ExpiresAtHeader {
+			continue
+		}
+		expiresAt, err := strconv.ParseInt(string(h.Value), 10, 64)
+		return err == nil && now.UnixMilli() > expiresAt
+	}
+	return false
+}
+
+// recordHeaders returns the headers shared by all the records produced with
+// ctx: the metadata headers, the default headers which aren't overridden by
+// the metadata, and the static headers.
+func (p *Producer) recordHeaders(ctx context.Context) []kgo.RecordHeader {
+	headers := p.metadataHeaders(ctx)
+	metadataLen := len(headers)
+	for _, dh := range p.defaultHeaders {
+		overridden := false
+		for _, h := range headers[:metadataLen] {
+			if h.Key == dh.Key {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			headers = append(headers, dh)
+		}
+	}
+	return append(headers, p.staticHeaders...)
+}
+
+// metadataHeaders returns a snapshot of the metadata stored in ctx as record
+// headers, filtered by cfg.MetadataKeys and converted by cfg.HeaderEncoder if
+// set, followed by the CorrelationIDHeader. The returned headers don't share
+// memory with the metadata map.
+func (p *Producer) metadataHeaders(ctx context.Context) []kgo.RecordHeader {
+	m, ok := queuecontext.MetadataFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	var headers []kgo.RecordHeader
+	if p.cfg.HeaderEncoder != nil {
+		// Pass a filtered copy, so the encoder can't observe nor cause
+		// changes to the metadata while the batch is processed.
+		filtered := make(map[string]string, len(m))
+		for k, v := range m {
+			if p.allowedMetadataKey(k) {
+				filtered[k] = v
+			}
+		}
+		// Use a full slice expression to ensure the encoder's headers are
+		// copied, rather than modified, when appending to them.
+		encoded := p.cfg.HeaderEncoder(filtered)
+		headers = encoded[:len(encoded):len(encoded)]
+	} else {
+		for k, v := range m {
+			if !p.allowedMetadataKey(k) {
+				continue
+			}
+			headers = append(headers, kgo.RecordHeader{
+				Key:   k,
+				Value: []byte(v),
+			})
+		}
+	}
+	if p.cfg.CorrelationIDKey != "" {
+		if v, ok := m[p.cfg.CorrelationIDKey]; ok {
+			headers = append(headers, kgo.RecordHeader{
+				Key:   CorrelationIDHeader,
+				Value: []byte(v),
+			})
+		}
+	}
+	return headers
+}
+
+// allowedMetadataKey returns true if the metadata key k is added to the
+// records according to cfg.MetadataKeys.
+func (p *Producer) allowedMetadataKey(k string) bool {
+	if p.metadataKeys == nil {
+		return true
+	}
+	_, ok := p.metadataKeys[k]
+	return ok
+}
+
+// ProcessEvent publishes a single event to the Kafka topic returned by the
+// configured TopicRouter. It is a convenience wrapper around ProcessBatch.
+func (p *Producer) ProcessEvent(ctx context.Context, event model.APMEvent) error {
+	batch := model.Batch{event}
+	return p.ProcessBatch(ctx, &batch)
+}
+
 // Healthy returns an error if the Kafka client fails to reach a discovered
 // broker.
 func (p *Producer) Healthy() error {
@@ -219,3 +2302,85 @@ func (p *Producer) Healthy() error {
 	}
 	return nil
 }
+
+// WaitReady blocks until any of the brokers is reachable, returning an error
+// if ctx is done first. Unlike Healthy, which pings the brokers once, the
+// brokers are pinged until one of them responds, waiting for the
+// ReconnectBackoff between attempts: by default, an exponential backoff
+// starting at 250ms and capped at 5s. This is useful for readiness probes.
+func (p *Producer) WaitReady(ctx context.Context) error {
+	backoff := p.cfg.ReconnectBackoff
+	if backoff == nil {
+		backoff = defaultReconnectBackoff
+	}
+	if err := waitForBrokers(ctx, p.client, backoff); err != nil {
+		return fmt.Errorf("kafka: no broker reachable: %w", err)
+	}
+	return nil
+}
+
+// tlsDialer returns a dial function which opens TLS connections using the
+// configuration returned by provider for every connection, which must return
+// a new configuration on every call, since it may be modified. Like
+// kgo.DialTLSConfig, the ServerName defaults to the dialed host. kgo doesn't
+// apply the DialTimeout to custom dialers, so it's applied here, defaulting to
+// 10s like kgo does.
+func tlsDialer(provider func() (*tls.Config, error), timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return func(ctx context.Context, network, host string) (net.Conn, error) {
+		cfg, err := provider()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.ServerName == "" {
+			server, _, err := net.SplitHostPort(host)
+			if err != nil {
+				return nil, fmt.Errorf("kafka: unable to split host:port for dialing: %w", err)
+			}
+			cfg.ServerName = server
+		}
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: timeout},
+			Config:    cfg,
+		}
+		return dialer.DialContext(ctx, network, host)
+	}
+}
+
+// waitForBrokers waits until any of the brokers is reachable, or ctx is done,
+// pinging them with the given backoff between attempts. It returns the last
+// ping error if ctx is done first.
+func waitForBrokers(ctx context.Context, client *kgo.Client, backoff func(int) time.Duration) error {
+	for attempt := 1; ; attempt++ {
+		err := client.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		timer := time.NewTimer(backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// defaultReconnectBackoff returns an exponential backoff which starts at 250ms
+// and doubles on each attempt up to 5s, with ±25% of jitter applied.
+func defaultReconnectBackoff(attempts int) time.Duration {
+	const (
+		min = 250 * time.Millisecond
+		max = 5 * time.Second
+	)
+	backoff := max
+	if attempts <= 0 {
+		backoff = min
+	} else if attempts <= 5 {
+		backoff = min << (attempts - 1)
+	}
+	jitter := 0.75 + 0.5*rand.Float64()
+	return time.Duration(float64(backoff) * jitter)
+}
@@ -19,21 +19,43 @@ package kafka
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	stdjson "encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kfake"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"go.opentelemetry.io/otel/baggage"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/elastic/apm-data/model"
 	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec"
+	"github.com/elastic/apm-queue/codec/compress"
 	"github.com/elastic/apm-queue/codec/json"
+	saslplain "github.com/elastic/apm-queue/kafka/sasl/plain"
 	"github.com/elastic/apm-queue/queuecontext"
 )
 
@@ -42,6 +64,31 @@ func TestNewProducer(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestProducerConfigValidate(t *testing.T) {
+	err := ProducerConfig{}.Validate()
+	require.Error(t, err)
+	for _, expected := range []error{
+		ErrNoBrokers, ErrNilLogger, ErrNilEncoder, ErrNoTopicRouter,
+	} {
+		assert.ErrorIs(t, err, expected)
+	}
+	assert.ErrorContains(t, ProducerConfig{
+		DurabilityByTopic: map[apmqueue.Topic]RequiredAcks{"topic": 2},
+	}.Validate(), "kafka: unknown required acks 2 for topic topic")
+
+	assert.EqualError(t, err, strings.Join([]string{
+		"kafka: brokers cannot be empty",
+		"kafka: logger cannot be nil",
+		"kafka: encoder cannot be nil",
+		"kafka: topic router must be set",
+	}, "\n"))
+
+	// Errors are still matchable when wrapped by NewProducer.
+	_, err = NewProducer(ProducerConfig{Logger: zap.NewNop()})
+	assert.ErrorIs(t, err, ErrNoBrokers)
+	assert.NotErrorIs(t, err, ErrNilLogger)
+}
+
 func TestNewProducerBasic(t *testing.T) {
 	// This test ensures that basic producing is working, it tests:
 	// * Producing to a single topic
@@ -108,21 +155,2720 @@ func TestNewProducerBasic(t *testing.T) {
 	assert.Len(t, fetches.Records(), 0)
 }
 
-func newClusterWithTopics(t *testing.T, topics ...string) (*kgo.Client, []string) {
-	t.Helper()
-	cluster, err := kfake.NewCluster()
+func TestProducerProcessEvent(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	codec := json.JSON{}
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: codec,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+	})
 	require.NoError(t, err)
-	t.Cleanup(cluster.Close)
+	defer producer.Close()
 
-	addrs := cluster.ListenAddrs()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
 
-	client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	require.NoError(t, producer.ProcessEvent(ctx, event))
+
+	client.AddConsumeTopics(topic)
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+
+	var decoded model.APMEvent
+	require.NoError(t, codec.Decode(records[0].Value, &decoded))
+	assert.Equal(t, event, decoded)
+
+	// Assert no more records have been produced.
+	//lint:ignore SA1012 passing a nil context is a valid use for this call.
+	fetches = client.PollRecords(nil, 1)
+	assert.Len(t, fetches.Records(), 0)
+}
+
+func TestProducerIdempotencyKey(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		IdempotencyKey: func(event model.APMEvent) string {
+			return event.Transaction.ID
+		},
+		IdempotencyKeyAsRecordKey: true,
+	})
 	require.NoError(t, err)
+	defer producer.Close()
 
-	kadmClient := kadm.NewClient(client)
-	t.Cleanup(kadmClient.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
 
-	_, err = kadmClient.CreateTopics(context.Background(), 2, 1, nil, topics...)
+	ctx = queuecontext.WithMetadata(ctx, map[string]string{"a": "b"})
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{ID: "2"}},
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	keys := make(map[string]int)
+	for _, record := range records {
+		sort.Slice(record.Headers, func(i, j int) bool {
+			return record.Headers[i].Key < record.Headers[j].Key
+		})
+		key := string(record.Key)
+		assert.Equal(t, []kgo.RecordHeader{
+			{Key: "a", Value: []byte("b")},
+			{Key: IdempotencyKeyHeader, Value: []byte(key)},
+		}, record.Headers)
+		keys[key]++
+	}
+	assert.Equal(t, map[string]int{"1": 2, "2": 1}, keys)
+}
+
+func TestProducerDedupWindow(t *testing.T) {
+	var produced []string
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		IdempotencyKey: func(event model.APMEvent) string {
+			return event.Transaction.ID
+		},
+		DedupWindow: time.Minute,
+		FinalizeRecord: func(event model.APMEvent, _ *kgo.Record) error {
+			produced = append(produced, event.Transaction.ID)
+			return nil
+		},
+	})
 	require.NoError(t, err)
-	return client, addrs
+	defer producer.Close()
+	now := time.Now()
+	setClock(producer, func() time.Time { return now })
+
+	newBatch := func(ids ...string) *model.Batch {
+		var batch model.Batch
+		for _, id := range ids {
+			batch = append(batch, model.APMEvent{Transaction: &model.Transaction{ID: id}})
+		}
+		return &batch
+	}
+	ctx := context.Background()
+	require.NoError(t, producer.ProcessBatch(ctx, newBatch("1", "1", "2")))
+	assert.Equal(t, []string{"1", "2"}, produced)
+
+	// The keys seen within the window are dropped.
+	now = now.Add(30 * time.Second)
+	require.NoError(t, producer.ProcessBatch(ctx, newBatch("1", "3")))
+	assert.Equal(t, []string{"1", "2", "3"}, produced)
+
+	// Once the window elapses, the keys are produced again.
+	now = now.Add(time.Minute)
+	require.NoError(t, producer.ProcessBatch(ctx, newBatch("1", "2")))
+	assert.Equal(t, []string{"1", "2", "3", "1", "2"}, produced)
+
+	_, err = NewProducer(ProducerConfig{
+		Brokers:     []string{"127.0.0.1:1"},
+		Logger:      zap.NewNop(),
+		Encoder:     json.JSON{},
+		TopicRouter: func(model.APMEvent) apmqueue.Topic { return "topic" },
+		DedupWindow: time.Minute,
+	})
+	assert.ErrorContains(t, err, "kafka: idempotency key must be set to deduplicate records")
+}
+
+func TestProducerMutatorSetsValue(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	encoder := &countingEncoder{}
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: encoder,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		Mutators: []RecordMutator{func(event model.APMEvent, r *kgo.Record) error {
+			r.Value = []byte("mutated")
+			return nil
+		}},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+	assert.Equal(t, 0, encoder.calls)
+
+	client.AddConsumeTopics(topic)
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("mutated"), records[0].Value)
+}
+
+func TestProducerSyncContextCancelled(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the records are never produced.
+		Brokers: []string{"127.0.0.1:1"},
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = producer.ProcessEvent(ctx, model.APMEvent{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestProducerErrorHandler(t *testing.T) {
+	var mu sync.Mutex
+	var classes []ErrorClass
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the records are never produced.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		ErrorHandler: func(r *kgo.Record, err error, class ErrorClass) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, "topic", r.Topic)
+			assert.ErrorIs(t, err, kgo.ErrClientClosed)
+			classes = append(classes, class)
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, producer.ProcessEvent(context.Background(), model.APMEvent{}))
+
+	// Shutting down fails the buffered record once the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, producer.Shutdown(ctx))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ErrorClass{ErrorClassFatal}, classes)
+}
+
+func TestProducerIdleTimeout(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Activity keeps the producer open.
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+
+	select {
+	case <-producer.closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the idle producer to be closed")
+	}
+	assert.ErrorIs(t, producer.ProcessEvent(ctx, model.APMEvent{}), ErrProducerClosed)
+
+	// The records produced asynchronously are flushed before closing.
+	client.AddConsumeTopics(topic)
+	var n int
+	for n < 2 {
+		fetches := client.PollRecords(ctx, 2)
+		require.NoError(t, fetches.Err())
+		n += fetches.NumRecords()
+	}
+}
+
+func TestProducerProduceTombstone(t *testing.T) {
+	topic := "compacted-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "default-topic"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	assert.Error(t, producer.ProduceTombstone(ctx, apmqueue.Topic(topic), nil))
+	require.NoError(t, producer.ProduceTombstone(ctx, apmqueue.Topic(topic), []byte("entity-1")))
+
+	client.AddConsumeTopics(topic)
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("entity-1"), records[0].Key)
+	assert.Nil(t, records[0].Value)
+}
+
+func TestProducerChangelog(t *testing.T) {
+	topic := "entities"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		KeyRouter: func(event model.APMEvent) string {
+			return event.Service.Name
+		},
+		Changelog: true,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var batch model.Batch
+	for i := 0; i < 3; i++ {
+		batch = append(batch, model.APMEvent{
+			Service:     model.Service{Name: "entity-1"},
+			Transaction: &model.Transaction{ID: fmt.Sprint(i)},
+		})
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.NoError(t, producer.ProduceEventTombstone(ctx, model.APMEvent{
+		Service: model.Service{Name: "entity-1"},
+	}))
+
+	err = producer.ProcessBatch(ctx, &model.Batch{{}})
+	assert.EqualError(t, err, "kafka: changelog record key cannot be empty")
+	assert.EqualError(t, producer.ProduceEventTombstone(ctx, model.APMEvent{}),
+		"kafka: tombstone key cannot be empty",
+	)
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < len(batch)+1 {
+		fetches := client.PollRecords(ctx, len(batch)+1)
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	require.Len(t, records, len(batch)+1)
+	for i, r := range records[:len(batch)] {
+		assert.Equal(t, []byte("entity-1"), r.Key)
+		var event model.APMEvent
+		require.NoError(t, json.JSON{}.Decode(r.Value, &event))
+		assert.Equal(t, fmt.Sprint(i), event.Transaction.ID)
+	}
+	tombstone := records[len(batch)]
+	assert.Equal(t, []byte("entity-1"), tombstone.Key)
+	assert.Nil(t, tombstone.Value)
+}
+
+func TestProducerChangelogConfig(t *testing.T) {
+	cfg := ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		Changelog: true,
+	}
+	assert.ErrorIs(t, cfg.Validate(), ErrNoKeyRouter)
+
+	cfg.KeyRouter = func(event model.APMEvent) string { return event.Service.Name }
+	cfg.IdempotencyKey = func(event model.APMEvent) string { return "" }
+	cfg.IdempotencyKeyAsRecordKey = true
+	assert.EqualError(t, cfg.Validate(), "kafka: key router and idempotency key as record key cannot be set together")
+
+	cfg.IdempotencyKeyAsRecordKey = false
+	cfg.DurabilityByTopic = map[apmqueue.Topic]RequiredAcks{"topic": LeaderAck}
+	assert.EqualError(t, cfg.Validate(), "kafka: preserving the order requires AllISRAcks, topic topic uses 1")
+
+	cfg.DurabilityByTopic = nil
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	defer producer.Close()
+
+	records, err := producer.BuildRecords(context.Background(), &model.Batch{
+		{Service: model.Service{Name: "entity-1"}},
+		{Service: model.Service{Name: "entity-2"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, []byte("entity-1"), records[0].Key)
+	assert.Equal(t, []byte("entity-2"), records[1].Key)
+
+	_, err = producer.BuildRecords(context.Background(), &model.Batch{{}})
+	assert.EqualError(t, err, "kafka: changelog record key cannot be empty")
+}
+
+func TestProducerReplayRecords(t *testing.T) {
+	topics := []string{"original", "replayed"}
+	client, brokers := newClusterWithTopics(t, topics...)
+	newProducer := func(topic string) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: brokers,
+			Sync:    true,
+			Logger:  zap.NewNop(),
+			Encoder: json.JSON{},
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return apmqueue.Topic(topic)
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{ID: "2"}},
+	}
+	metadata := map[string]string{"project": "1", "tenant": "a"}
+	require.NoError(t, newProducer("original").ProcessBatch(
+		queuecontext.WithMetadata(ctx, metadata), &batch,
+	))
+	poll := func(topic string) []*kgo.Record {
+		client.AddConsumeTopics(topic)
+		defer client.PurgeTopicsFromClient(topic)
+		var records []*kgo.Record
+		for len(records) < len(batch) {
+			fetches := client.PollRecords(ctx, len(batch))
+			require.NoError(t, fetches.Err())
+			records = append(records, fetches.Records()...)
+		}
+		return records
+	}
+	original := poll("original")
+
+	require.NoError(t, newProducer("replayed").ReplayRecords(ctx, json.JSON{}, original))
+	replayed := poll("replayed")
+	require.Len(t, replayed, len(original))
+	for i, r := range replayed {
+		assert.Equal(t, original[i].Value, r.Value)
+		assert.ElementsMatch(t, original[i].Headers, r.Headers)
+	}
+}
+
+func TestReplayMetadataRoundTrip(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	metadata := map[string]string{"project": "1", "tenant": "a"}
+	ctx := queuecontext.WithMetadata(context.Background(), metadata)
+	records, err := producer.BuildRecords(ctx, &model.Batch{{}})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	// Binary headers are skipped when restoring the metadata.
+	headers := append(records[0].Headers, kgo.RecordHeader{
+		Key: "binary", Value: []byte{0xff, 0xfe},
+	})
+	ctx = queuecontext.WithMetadataFromHeaders(context.Background(), headers)
+	replayed, err := producer.BuildRecords(ctx, &model.Batch{{}})
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	assert.ElementsMatch(t, records[0].Headers, replayed[0].Headers)
+}
+
+func TestProducerProduceRecords(t *testing.T) {
+	topics := []string{"topic-a", "topic-b"}
+	client, brokers := newClusterWithTopics(t, topics...)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "default-topic"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.EqualError(t, producer.ProduceRecords(ctx, []kgo.Record{{Value: []byte("a")}}),
+		"kafka: record 0 has no topic",
+	)
+	records := []kgo.Record{
+		{Topic: "topic-a", Key: []byte("key-a"), Value: []byte("a")},
+		{Topic: "topic-b", Value: []byte("b"), Headers: []kgo.RecordHeader{
+			{Key: "h", Value: []byte("v")},
+		}},
+	}
+	ctx = queuecontext.WithMetadata(ctx, map[string]string{"a": "b"})
+	require.NoError(t, producer.ProduceRecords(ctx, records))
+	// The caller's records aren't modified.
+	assert.Len(t, records[1].Headers, 1)
+
+	client.AddConsumeTopics(topics...)
+	var produced []*kgo.Record
+	for len(produced) < 2 {
+		fetches := client.PollRecords(ctx, 2)
+		require.NoError(t, fetches.Err())
+		produced = append(produced, fetches.Records()...)
+	}
+	sort.Slice(produced, func(i, j int) bool { return produced[i].Topic < produced[j].Topic })
+	assert.Equal(t, []byte("key-a"), produced[0].Key)
+	assert.Equal(t, []byte("a"), produced[0].Value)
+	assert.Equal(t, []kgo.RecordHeader{{Key: "a", Value: []byte("b")}}, produced[0].Headers)
+	assert.Equal(t, []byte("b"), produced[1].Value)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "h", Value: []byte("v")},
+		{Key: "a", Value: []byte("b")},
+	}, produced[1].Headers)
+}
+
+func TestProducerIdleTimeoutClock(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		IdleTimeout: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	clock := newFakeClock(time.Now())
+	setClock(producer, clock.Now)
+
+	// The producer isn't closed while the clock is stopped.
+	select {
+	case <-producer.closed:
+		t.Fatal("producer closed before the idle timeout elapsed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The producer isn't idle while a call is in progress, however long it
+	// takes: the idle time is counted from the time it returns.
+	errMutator := errors.New("mutator failed")
+	producer.cfg.Mutators = []RecordMutator{func(model.APMEvent, *kgo.Record) error {
+		clock.Advance(time.Minute)
+		// Give the idle timer time to fire while the call is in progress.
+		time.Sleep(50 * time.Millisecond)
+		return errMutator
+	}}
+	err = producer.ProcessEvent(context.Background(), model.APMEvent{})
+	assert.ErrorIs(t, err, errMutator)
+	select {
+	case <-producer.closed:
+		t.Fatal("producer closed right after a long call")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-producer.closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the idle producer to be closed")
+	}
+}
+
+func TestProducerHeaderMutators(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		HeaderMutators: []HeaderMutator{
+			func(event model.APMEvent) (string, []byte, bool) {
+				return "service.name", []byte(event.Service.Name), event.Service.Name != ""
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ctx = queuecontext.WithMetadata(ctx, map[string]string{"a": "b"})
+	batch := model.Batch{
+		{Service: model.Service{Name: "svc-1"}},
+		{},
+		{Service: model.Service{Name: "svc-2"}},
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	var services []string
+	for _, record := range records {
+		assert.Equal(t, kgo.RecordHeader{Key: "a", Value: []byte("b")}, record.Headers[0])
+		switch len(record.Headers) {
+		case 1:
+			services = append(services, "")
+		case 2:
+			assert.Equal(t, "service.name", record.Headers[1].Key)
+			services = append(services, string(record.Headers[1].Value))
+		default:
+			t.Fatalf("unexpected headers: %v", record.Headers)
+		}
+	}
+	assert.ElementsMatch(t, []string{"svc-1", "", "svc-2"}, services)
+}
+
+func TestProducerFinalizeRecord(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		FinalizeRecord: func(event model.APMEvent, r *kgo.Record) error {
+			// The record value is set by the time the record is finalized.
+			r.Headers = append(r.Headers, kgo.RecordHeader{
+				Key:   "size",
+				Value: []byte(strconv.Itoa(len(r.Value))),
+			})
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{
+		Transaction: &model.Transaction{ID: "1"},
+	}))
+
+	client.AddConsumeTopics(topic)
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	records := fetches.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, []kgo.RecordHeader{{
+		Key:   "size",
+		Value: []byte(strconv.Itoa(len(records[0].Value))),
+	}}, records[0].Headers)
+
+	producer, err = NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		FinalizeRecord: func(model.APMEvent, *kgo.Record) error {
+			return errors.New("boom")
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+	assert.EqualError(t, producer.ProcessEvent(ctx, model.APMEvent{}),
+		"failed to finalize record: boom",
+	)
+}
+
+func TestProducerSkipEncodeErrors(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	newProducer := func(skip bool) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers:          brokers,
+			Sync:             true,
+			Logger:           zap.NewNop(),
+			Encoder:          spanFailingEncoder{},
+			SkipEncodeErrors: skip,
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return apmqueue.Topic(topic)
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Span: &model.Span{ID: "2"}},
+		{Transaction: &model.Transaction{ID: "3"}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	// Encode errors are fatal by default.
+	err := newProducer(false).ProcessBatch(ctx, &batch)
+	assert.ErrorIs(t, err, errEncode)
+
+	require.NoError(t, newProducer(true).ProcessBatch(ctx, &batch))
+	client.AddConsumeTopics(topic)
+	fetches := client.PollRecords(ctx, 2)
+	require.NoError(t, fetches.Err())
+	var ids []string
+	for _, record := range fetches.Records() {
+		var event model.APMEvent
+		require.NoError(t, json.JSON{}.Decode(record.Value, &event))
+		ids = append(ids, event.Transaction.ID)
+	}
+	assert.Equal(t, []string{"1", "3"}, ids)
+}
+
+func TestProducerOutputValidator(t *testing.T) {
+	errInvalid := errors.New("missing transaction")
+	newProducer := func(skip bool) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers:          []string{"127.0.0.1:1"},
+			Logger:           zap.NewNop(),
+			Encoder:          json.JSON{},
+			SkipEncodeErrors: skip,
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return "topic"
+			},
+			OutputValidator: func(value []byte) error {
+				var event map[string]any
+				if err := stdjson.Unmarshal(value, &event); err != nil {
+					return err
+				}
+				if event["Transaction"] == nil {
+					return errInvalid
+				}
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Span: &model.Span{ID: "2"}},
+		{Transaction: &model.Transaction{ID: "3"}},
+	}
+
+	// Validation errors are fatal by default, like encode errors.
+	_, err := newProducer(false).BuildRecords(context.Background(), &batch)
+	assert.ErrorIs(t, err, errInvalid)
+
+	records, err := newProducer(true).BuildRecords(context.Background(), &batch)
+	require.NoError(t, err)
+	var ids []string
+	for _, record := range records {
+		var event model.APMEvent
+		require.NoError(t, json.JSON{}.Decode(record.Value, &event))
+		ids = append(ids, event.Transaction.ID)
+	}
+	assert.Equal(t, []string{"1", "3"}, ids)
+}
+
+func setServiceKey(event model.APMEvent, r *kgo.Record) error {
+	r.Key = []byte(event.Service.Name)
+	return nil
+}
+
+func TestProducerMutatorNames(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		Mutators: []RecordMutator{setServiceKey},
+		NamedMutators: []NamedRecordMutator{
+			NameMutator("service-header", func(event model.APMEvent, r *kgo.Record) error {
+				r.Headers = append(r.Headers, kgo.RecordHeader{
+					Key: "service", Value: []byte(event.Service.Name),
+				})
+				return nil
+			}),
+			NameMutator("fail-empty", func(event model.APMEvent, r *kgo.Record) error {
+				if event.Service.Name == "" {
+					return errors.New("empty service name")
+				}
+				return nil
+			}),
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	assert.Equal(t, 3, producer.MutatorCount())
+	assert.Equal(t, []string{
+		"github.com/elastic/apm-queue/kafka.setServiceKey",
+		"service-header",
+		"fail-empty",
+	}, producer.MutatorNames())
+
+	records, err := producer.BuildRecords(context.Background(), &model.Batch{
+		{Service: model.Service{Name: "svc"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("svc"), records[0].Key)
+	assert.Equal(t, []kgo.RecordHeader{{Key: "service", Value: []byte("svc")}}, records[0].Headers)
+
+	_, err = producer.BuildRecords(context.Background(), &model.Batch{{}})
+	assert.EqualError(t, err, "failed to apply record mutator fail-empty: empty service name")
+}
+
+func TestProducerAdaptiveSyncThreshold(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the records are never acked.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		AdaptiveSyncThreshold: 3,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// Small batches wait for the records to be acked.
+	small := model.Batch{{}, {}}
+	assert.ErrorIs(t, producer.ProcessBatch(ctx, &small), context.DeadlineExceeded)
+
+	// Large batches return as soon as the records are buffered.
+	large := model.Batch{{}, {}, {}}
+	start := time.Now()
+	require.NoError(t, producer.ProcessBatch(context.Background(), &large))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	err = ProducerConfig{Sync: true, AdaptiveSyncThreshold: 1}.Validate()
+	assert.ErrorContains(t, err, "kafka: sync and adaptive sync threshold cannot be set together")
+}
+
+func TestProducerBuildRecords(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		// No broker is needed to build the records.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			if event.Transaction != nil {
+				return "transactions"
+			}
+			return "spans"
+		},
+		HeaderMutators: []HeaderMutator{
+			func(event model.APMEvent) (string, []byte, bool) {
+				return "service.name", []byte(event.Service.Name), true
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{"a": "b"})
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}, Service: model.Service{Name: "svc-1"}},
+		{Span: &model.Span{ID: "2"}, Service: model.Service{Name: "svc-2"}},
+	}
+	records, err := producer.BuildRecords(ctx, &batch)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	for i, topic := range []string{"transactions", "spans"} {
+		assert.Equal(t, topic, records[i].Topic)
+		encoded, err := json.JSON{}.Encode(batch[i])
+		require.NoError(t, err)
+		assert.Equal(t, encoded, records[i].Value)
+		assert.Equal(t, []kgo.RecordHeader{
+			{Key: "a", Value: []byte("b")},
+			{Key: "service.name", Value: []byte(batch[i].Service.Name)},
+		}, records[i].Headers)
+	}
+}
+
+func TestProducerRecordIDGenerator(t *testing.T) {
+	var calls int
+	var mu sync.Mutex
+	var records []*kgo.Record
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		MultiTopicRouter: func(event model.APMEvent) []apmqueue.Topic {
+			if event.Transaction != nil {
+				return []apmqueue.Topic{"transactions", "all"}
+			}
+			return []apmqueue.Topic{"spans"}
+		},
+		HeaderMutators: []HeaderMutator{
+			func(event model.APMEvent) (string, []byte, bool) {
+				return "a", []byte("b"), true
+			},
+		},
+		RecordIDGenerator: func() string {
+			calls++
+			return fmt.Sprint("id-", calls)
+		},
+		// Nothing listens on the brokers address, so the records fail to be
+		// produced once the producer is closed.
+		ErrorHandler: func(r *kgo.Record, _ error, _ ErrorClass) {
+			mu.Lock()
+			defer mu.Unlock()
+			records = append(records, r)
+		},
+	})
+	require.NoError(t, err)
+
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Span: &model.Span{ID: "2"}},
+		{Span: &model.Span{ID: "3"}},
+	}
+	// BuildRecords doesn't call the generator.
+	built, err := producer.BuildRecords(context.Background(), &batch)
+	require.NoError(t, err)
+	require.Len(t, built, 4)
+	assert.Equal(t, 0, calls)
+	for _, r := range built {
+		assert.Len(t, r.Headers, 1)
+	}
+
+	// ProcessBatch calls the generator once per record.
+	require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, producer.Close())
+	assert.Equal(t, 4, calls)
+	require.Len(t, records, 4)
+	ids := make(map[string]struct{})
+	for _, r := range records {
+		require.Len(t, r.Headers, 2)
+		assert.Equal(t, kgo.RecordHeader{Key: "a", Value: []byte("b")}, r.Headers[0])
+		assert.Equal(t, RecordIDHeader, r.Headers[1].Key)
+		ids[string(r.Headers[1].Value)] = struct{}{}
+	}
+	// The records of an event routed to multiple topics have distinct IDs.
+	assert.Len(t, ids, len(records))
+}
+
+func TestProducerRender(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		KeyRouter: func(event model.APMEvent) string {
+			return event.Service.Name
+		},
+		HeaderMutators: []HeaderMutator{
+			func(event model.APMEvent) (string, []byte, bool) {
+				return "service.name", []byte(event.Service.Name), true
+			},
+		},
+		Mutators: []RecordMutator{
+			func(event model.APMEvent, record *kgo.Record) error {
+				record.Headers = append(record.Headers, kgo.RecordHeader{Key: "mutated"})
+				return nil
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = queuecontext.WithMetadata(ctx, map[string]string{"a": "b"})
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}, Service: model.Service{Name: "svc-1"}},
+		{Span: &model.Span{ID: "2"}, Service: model.Service{Name: "svc-2"}},
+	}
+	rendered, err := producer.Render(ctx, &batch)
+	require.NoError(t, err)
+	require.Len(t, rendered, len(batch))
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client.AddConsumeTopics(topic)
+	var produced []*kgo.Record
+	for len(produced) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		produced = append(produced, fetches.Records()...)
+	}
+	// The events are in different partitions, so match them by key.
+	byKey := make(map[string]*kgo.Record)
+	for _, r := range produced {
+		byKey[string(r.Key)] = r
+	}
+	for _, r := range rendered {
+		p, ok := byKey[string(r.Key)]
+		require.True(t, ok, "missing record with key %s", r.Key)
+		assert.Equal(t, r.Topic, p.Topic)
+		assert.Equal(t, r.Value, p.Value)
+		assert.Equal(t, r.Headers, p.Headers)
+	}
+}
+
+func TestProducerRenderRecordIDs(t *testing.T) {
+	var calls int
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		MultiTopicRouter: func(event model.APMEvent) []apmqueue.Topic {
+			return []apmqueue.Topic{"primary", "audit"}
+		},
+		HeaderMutators: []HeaderMutator{
+			func(event model.APMEvent) (string, []byte, bool) {
+				return "a", []byte("b"), true
+			},
+		},
+		RecordIDGenerator: func() string {
+			calls++
+			return fmt.Sprint("id-", calls)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	rendered, err := producer.Render(context.Background(), &model.Batch{{}})
+	require.NoError(t, err)
+	require.Len(t, rendered, 2)
+	assert.Equal(t, 2, calls)
+	for i, r := range rendered {
+		assert.Equal(t, []kgo.RecordHeader{
+			{Key: "a", Value: []byte("b")},
+			{Key: RecordIDHeader, Value: []byte(fmt.Sprint("id-", i+1))},
+		}, r.Headers)
+	}
+	// The records own their headers.
+	rendered[0].Headers[0].Value = []byte("c")
+	rendered[0].Headers = append(rendered[0].Headers, kgo.RecordHeader{Key: "d"})
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "a", Value: []byte("b")},
+		{Key: RecordIDHeader, Value: []byte("id-2")},
+	}, rendered[1].Headers)
+}
+
+func TestProducerMetadataSnapshot(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	metadata := map[string]string{"a": "b"}
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		// Mutate the source metadata map while the batch is being processed.
+		Mutators: []RecordMutator{func(event model.APMEvent, r *kgo.Record) error {
+			metadata["a"] = event.Transaction.ID
+			metadata[event.Transaction.ID] = "new"
+			return nil
+		}},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var batch model.Batch
+	for i := 0; i < 100; i++ {
+		batch = append(batch, model.APMEvent{
+			Transaction: &model.Transaction{ID: fmt.Sprint(i)},
+		})
+	}
+	require.NoError(t, producer.ProcessBatch(
+		queuecontext.WithMetadata(ctx, metadata), &batch,
+	))
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	for _, record := range records {
+		assert.Equal(t, []kgo.RecordHeader{{Key: "a", Value: []byte("b")}}, record.Headers)
+	}
+}
+
+func TestProducerHeaderEncoder(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		MetadataKeys: []string{"a", "c"},
+		// Pack the metadata into a single header.
+		HeaderEncoder: func(m map[string]string) []kgo.RecordHeader {
+			packed, err := stdjson.Marshal(m)
+			require.NoError(t, err)
+			return []kgo.RecordHeader{{Key: "metadata", Value: packed}}
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"a": "b",
+		"c": "d",
+		"e": "f",
+	})
+	batch := model.Batch{{}, {}}
+	records, err := producer.BuildRecords(ctx, &batch)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	for _, record := range records {
+		assert.Equal(t, []kgo.RecordHeader{
+			{Key: "metadata", Value: []byte(`{"a":"b","c":"d"}`)},
+		}, record.Headers)
+	}
+}
+
+func TestProducerCorrelationID(t *testing.T) {
+	var headers []kgo.RecordHeader
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		MetadataKeys:     []string{"a"},
+		CorrelationIDKey: "request_id",
+		FinalizeRecord: func(_ model.APMEvent, r *kgo.Record) error {
+			headers = r.Headers
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"a":          "b",
+		"c":          "d",
+		"request_id": "123",
+	})
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "a", Value: []byte("b")},
+		{Key: CorrelationIDHeader, Value: []byte("123")},
+	}, headers)
+
+	// The correlation ID is only added when it's in the metadata.
+	ctx = queuecontext.WithMetadata(context.Background(), map[string]string{"c": "d"})
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+	assert.Empty(t, headers)
+}
+
+func TestProducerDefaultHeaders(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		DefaultHeaders: map[string]string{
+			"datacenter": "dc-1",
+			"cluster":    "cluster-1",
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{{}}
+	records, err := producer.BuildRecords(context.Background(), &batch)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "cluster", Value: []byte("cluster-1")},
+		{Key: "datacenter", Value: []byte("dc-1")},
+	}, records[0].Headers)
+
+	// The context metadata takes precedence over the default headers.
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"cluster": "cluster-2",
+	})
+	records, err = producer.BuildRecords(ctx, &batch)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: "cluster", Value: []byte("cluster-2")},
+		{Key: "datacenter", Value: []byte("dc-1")},
+	}, records[0].Headers)
+}
+
+func TestProducerTimestampMetadataKey(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.New(core),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		TimestampMetadataKey: "replay_time",
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	eventTime := time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC)
+	batch := model.Batch{{Timestamp: eventTime}, {}}
+	timestamps := func(value string) []time.Time {
+		ctx := context.Background()
+		if value != "" {
+			ctx = queuecontext.WithMetadata(ctx, map[string]string{"replay_time": value})
+		}
+		records, err := producer.BuildRecords(ctx, &batch)
+		require.NoError(t, err)
+		var timestamps []time.Time
+		for _, record := range records {
+			timestamps = append(timestamps, record.Timestamp.UTC())
+		}
+		return timestamps
+	}
+
+	replayTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, []time.Time{replayTime, replayTime}, timestamps("2023-01-02T03:04:05Z"))
+	assert.Equal(t, []time.Time{replayTime, replayTime}, timestamps(strconv.FormatInt(replayTime.UnixMilli(), 10)))
+	assert.Empty(t, logs.All())
+
+	// Invalid timestamps fall back to the event time, like missing ones,
+	// and a zero timestamp is set to the produce time by the client.
+	zero := time.Time{}.UTC()
+	assert.Equal(t, []time.Time{eventTime, zero}, timestamps(""))
+	assert.Equal(t, []time.Time{eventTime, zero}, timestamps("yesterday"))
+	entries := logs.TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "ignoring invalid timestamp in context metadata", entries[0].Message)
+	assert.Equal(t, "yesterday", entries[0].ContextMap()["value"])
+}
+
+func TestProducerMetadataSize(t *testing.T) {
+	var headers []kgo.RecordHeader
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		FinalizeRecord: func(_ model.APMEvent, r *kgo.Record) error {
+			headers = r.Headers
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx := queuecontext.WithMetadata(context.Background(), map[string]string{
+		"a":            "b",
+		"service.name": "svc",
+		"empty":        "",
+	})
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+	var size int
+	for _, h := range headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	assert.Equal(t, 22, size)
+	assert.Equal(t, size, queuecontext.MetadataSize(ctx))
+	assert.Zero(t, queuecontext.MetadataSize(context.Background()))
+}
+
+func TestProducerDurabilityByTopic(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, "audit", "debug", "default")
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Service.Name)
+		},
+		DurabilityByTopic: map[apmqueue.Topic]RequiredAcks{
+			"audit": AllISRAcks,
+			"debug": LeaderAck,
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	for topic, expected := range map[string]kgo.Acks{
+		"audit":   kgo.AllISRAcks(),
+		"debug":   kgo.LeaderAck(),
+		"default": kgo.AllISRAcks(),
+	} {
+		acks := producer.clientFor(topic).OptValue(kgo.RequiredAcks)
+		assert.Equal(t, expected, acks, topic)
+	}
+	assert.Len(t, producer.ackClients, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batch := model.Batch{
+		{Service: model.Service{Name: "audit"}},
+		{Service: model.Service{Name: "debug"}},
+		{Service: model.Service{Name: "default"}},
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client.AddConsumeTopics("audit", "debug", "default")
+	topics := make(map[string]int)
+	for len(topics) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		fetches.EachRecord(func(r *kgo.Record) { topics[r.Topic]++ })
+	}
+	assert.Equal(t, map[string]int{"audit": 1, "debug": 1, "default": 1}, topics)
+}
+
+func TestProducerPreserveOrder(t *testing.T) {
+	// The order is kept by both PreserveOrder and the changelog mode.
+	for name, configure := range map[string]func(*ProducerConfig){
+		"preserve_order": func(cfg *ProducerConfig) { cfg.PreserveOrder = true },
+		"changelog":      func(cfg *ProducerConfig) { cfg.Changelog = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			testProducerPreserveOrder(t, configure)
+		})
+	}
+}
+
+// testProducerPreserveOrder asserts that the records with the same key are
+// written in the order they're produced in when a produce request is retried.
+func testProducerPreserveOrder(t *testing.T, configure func(*ProducerConfig)) {
+	topic := "default-topic"
+	cluster, err := kfake.NewCluster(kfake.SeedTopics(2, topic))
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	brokers := cluster.ListenAddrs()
+	client, err := kgo.NewClient(kgo.SeedBrokers(brokers...))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	// Fail the first produce request with a retriable error, so its records
+	// are retried while the following requests are produced.
+	var failed atomic.Bool
+	cluster.ControlKey(int16(kmsg.Produce), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		if !failed.CompareAndSwap(false, true) {
+			return nil, nil, false
+		}
+		req := kreq.(*kmsg.ProduceRequest)
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewProduceResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewProduceResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = kerr.NotEnoughReplicas.Code
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	cfg := ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		KeyRouter: func(event model.APMEvent) string {
+			return event.Service.Name
+		},
+	}
+	configure(&cfg)
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Produce the events in separate batches, so they're spread over
+	// multiple produce requests.
+	var batch model.Batch
+	for i := 0; i < 100; i++ {
+		event := model.APMEvent{
+			Service:     model.Service{Name: fmt.Sprint("svc-", i%2)},
+			Transaction: &model.Transaction{ID: fmt.Sprint(i)},
+		}
+		batch = append(batch, event)
+		require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{event}))
+	}
+	require.NoError(t, producer.Shutdown(ctx))
+	assert.True(t, failed.Load(), "no produce request was retried")
+
+	client.AddConsumeTopics(topic)
+	ids := make(map[string][]string)
+	var n int
+	for n < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		fetches.EachRecord(func(r *kgo.Record) {
+			var event model.APMEvent
+			require.NoError(t, json.JSON{}.Decode(r.Value, &event))
+			ids[string(r.Key)] = append(ids[string(r.Key)], event.Transaction.ID)
+			n++
+		})
+	}
+	for key, keyIDs := range ids {
+		var expected []string
+		for _, event := range batch {
+			if event.Service.Name == key {
+				expected = append(expected, event.Transaction.ID)
+			}
+		}
+		assert.Equal(t, expected, keyIDs, key)
+	}
+}
+
+func TestProducerPreserveOrderConfig(t *testing.T) {
+	cfg := ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		PreserveOrder: true,
+		DurabilityByTopic: map[apmqueue.Topic]RequiredAcks{
+			"all":    AllISRAcks,
+			"leader": LeaderAck,
+		},
+	}
+	// Idempotent writes are disabled for the LeaderAck client.
+	assert.EqualError(t, cfg.Validate(), "kafka: preserving the order requires AllISRAcks, topic leader uses 1")
+
+	delete(cfg.DurabilityByTopic, "leader")
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestProducerPinnedPartitions(t *testing.T) {
+	pinned, other := "pinned-topic", "other-topic"
+	client, brokers := newClusterWithTopics(t, pinned, other)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			if event.Transaction != nil {
+				return apmqueue.Topic(pinned)
+			}
+			return apmqueue.Topic(other)
+		},
+		PinnedPartitions: map[apmqueue.Topic]int32{apmqueue.Topic(pinned): 1},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var batch model.Batch
+	for i := 0; i < 10; i++ {
+		batch = append(batch, model.APMEvent{
+			Transaction: &model.Transaction{ID: strconv.Itoa(i)},
+		})
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+
+	client.AddConsumeTopics(pinned)
+	var records []*kgo.Record
+	for len(records) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	for i, record := range records {
+		assert.Equal(t, int32(1), record.Partition)
+		var event model.APMEvent
+		require.NoError(t, json.JSON{}.Decode(record.Value, &event))
+		assert.Equal(t, strconv.Itoa(i), event.Transaction.ID)
+	}
+
+	_, err = NewProducer(ProducerConfig{
+		Brokers:          brokers,
+		Logger:           zap.NewNop(),
+		Encoder:          json.JSON{},
+		TopicRouter:      func(model.APMEvent) apmqueue.Topic { return "topic" },
+		PinnedPartitions: map[apmqueue.Topic]int32{"topic": -1},
+	})
+	assert.ErrorContains(t, err, "kafka: pinned partition cannot be negative for topic topic")
+}
+
+func TestCompatPartitionerJavaMurmur2(t *testing.T) {
+	partitioner, err := compatPartitioner(CompatPartitionerJavaMurmur2)
+	require.NoError(t, err)
+	tp := partitioner.ForTopic("topic")
+
+	// The murmur2 hashes computed by the Java client, from Kafka's UtilsTest.
+	javaHashes := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, hash := range javaHashes {
+		record := &kgo.Record{Key: []byte(key)}
+		assert.True(t, tp.RequiresConsistency(record))
+		for _, n := range []int{1, 3, 16, 100} {
+			// The Java client's Utils.toPositive(hash) % n.
+			expected := int(hash&0x7fffffff) % n
+			assert.Equal(t, expected, tp.Partition(record, n), "key %q", key)
+		}
+	}
+
+	_, err = NewProducer(ProducerConfig{
+		Brokers:           []string{"127.0.0.1:1"},
+		Logger:            zap.NewNop(),
+		Encoder:           json.JSON{},
+		TopicRouter:       func(model.APMEvent) apmqueue.Topic { return "topic" },
+		CompatPartitioner: "python",
+	})
+	assert.EqualError(t, err, `kafka: invalid producer config: kafka: unknown compat partitioner "python"`)
+}
+
+func TestProducerValidateTopics(t *testing.T) {
+	_, brokers := newClusterWithTopics(t, "logs", "metrics")
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "logs"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, producer.ValidateTopics(ctx, "logs", "metrics"))
+	assert.EqualError(t, producer.ValidateTopics(ctx, "logs", "metrcs", "traces"),
+		"kafka: missing topics: metrcs, traces",
+	)
+}
+
+func TestProducerEmitContentTypeHeader(t *testing.T) {
+	topic := "mixed-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	newProducer := func(encoder Encoder) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: brokers,
+			Sync:    true,
+			Logger:  zap.NewNop(),
+			Encoder: encoder,
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return apmqueue.Topic(topic)
+			},
+			EmitContentTypeHeader: true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	_, err := NewProducer(ProducerConfig{
+		Brokers:               brokers,
+		Logger:                zap.NewNop(),
+		Encoder:               &countingEncoder{},
+		TopicRouter:           func(model.APMEvent) apmqueue.Topic { return "" },
+		EmitContentTypeHeader: true,
+	})
+	assert.ErrorContains(t, err, "encoder must implement codec.ContentTyper")
+
+	gzip := compress.Gzip{Codec: json.JSON{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	require.NoError(t, newProducer(json.JSON{}).ProcessEvent(ctx, event))
+	require.NoError(t, newProducer(gzip).ProcessEvent(ctx, event))
+
+	var registry codec.Registry
+	registry.Register(json.ContentType, json.JSON{})
+	registry.Register(compress.GzipContentType, gzip)
+
+	client.AddConsumeTopics(topic)
+	var contentTypes []string
+	for len(contentTypes) < 2 {
+		fetches := client.PollRecords(ctx, 2)
+		require.NoError(t, fetches.Err())
+		fetches.EachRecord(func(r *kgo.Record) {
+			require.Len(t, r.Headers, 1)
+			require.Equal(t, ContentTypeHeader, r.Headers[0].Key)
+			contentType := string(r.Headers[0].Value)
+			decoder, ok := registry.DecoderFor(contentType)
+			require.True(t, ok, contentType)
+
+			var decoded model.APMEvent
+			require.NoError(t, decoder.Decode(r.Value, &decoded))
+			assert.Equal(t, event, decoded)
+			contentTypes = append(contentTypes, contentType)
+		})
+	}
+	assert.ElementsMatch(t, []string{json.ContentType, compress.GzipContentType}, contentTypes)
+}
+
+func TestProducerPropagateBaggage(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		PropagateBaggage: true,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tenant, err := baggage.NewMember("tenant", "acme")
+	require.NoError(t, err)
+	b, err := baggage.New(tenant)
+	require.NoError(t, err)
+	require.NoError(t, producer.ProcessEvent(
+		baggage.ContextWithBaggage(ctx, b), model.APMEvent{},
+	))
+	// Without baggage, no header is added.
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < 2 {
+		fetches := client.PollRecords(ctx, 2)
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	var headers [][]kgo.RecordHeader
+	for _, r := range records {
+		headers = append(headers, r.Headers)
+	}
+	assert.ElementsMatch(t, [][]kgo.RecordHeader{
+		nil,
+		{{Key: BaggageHeader, Value: []byte("tenant=acme")}},
+	}, headers)
+}
+
+func TestProducerEmitProducerVersionHeader(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	cfg := ProducerConfig{
+		Brokers:  brokers,
+		ClientID: "apm-server",
+		Version:  "8.8.0",
+		Sync:     true,
+		Logger:   zap.NewNop(),
+		Encoder:  json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		EmitProducerVersionHeader: true,
+	}
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+
+	client.AddConsumeTopics(topic)
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	require.Len(t, fetches.Records(), 1)
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: ProducerVersionHeader, Value: []byte("8.8.0")},
+		{Key: ProducerClientIDHeader, Value: []byte("apm-server")},
+	}, fetches.Records()[0].Headers)
+
+	cfg.Version = ""
+	_, err = NewProducer(cfg)
+	assert.ErrorContains(t, err, "version must be set")
+}
+
+func TestProducerSchemaVersion(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		SchemaVersion: "2",
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{{}, {}}
+	records, err := producer.BuildRecords(context.Background(), &batch)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	for _, record := range records {
+		assert.Equal(t, []kgo.RecordHeader{
+			{Key: SchemaVersionHeader, Value: []byte("2")},
+		}, record.Headers)
+	}
+}
+
+func TestProducerRecoversPanics(t *testing.T) {
+	newProducer := func(cfg ProducerConfig) *Producer {
+		// Encoding happens before producing, so no cluster is needed.
+		cfg.Brokers = []string{"127.0.0.1:1"}
+		cfg.Logger = zap.NewNop()
+		cfg.TopicRouter = func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		}
+		if cfg.Encoder == nil {
+			cfg.Encoder = json.JSON{}
+		}
+		producer, err := NewProducer(cfg)
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	ctx := context.Background()
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+
+	producer := newProducer(ProducerConfig{Encoder: panickingEncoder{}})
+	assert.EqualError(t, producer.ProcessEvent(ctx, event),
+		"failed to encode event: kafka: encoder panicked: boom",
+	)
+
+	producer = newProducer(ProducerConfig{
+		Mutators: []RecordMutator{func(model.APMEvent, *kgo.Record) error {
+			panic("boom")
+		}},
+	})
+	assert.EqualError(t, producer.ProcessEvent(ctx, event),
+		"failed to apply record mutator: kafka: record mutator panicked: boom",
+	)
+
+	producer = newProducer(ProducerConfig{
+		HeaderMutators: []HeaderMutator{func(model.APMEvent) (string, []byte, bool) {
+			panic("boom")
+		}},
+	})
+	assert.EqualError(t, producer.ProcessEvent(ctx, event),
+		"failed to apply header mutator: kafka: header mutator panicked: boom",
+	)
+}
+
+func TestProducerAllowedTopics(t *testing.T) {
+	var allowed apmqueue.TopicSet
+	allowed.Register("logs", "metrics")
+	encoder := &countingEncoder{}
+	producer, err := NewProducer(ProducerConfig{
+		// The topic is validated before producing, so no cluster is needed.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: encoder,
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Service.Name)
+		},
+		AllowedTopics: &allowed,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx := context.Background()
+	err = producer.ProcessEvent(ctx, model.APMEvent{Service: model.Service{Name: "metrcs"}})
+	assert.ErrorIs(t, err, ErrTopicNotAllowed)
+	assert.EqualError(t, err, `kafka: topic not allowed: "metrcs"`)
+	assert.Zero(t, encoder.calls)
+
+	assert.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{Service: model.Service{Name: "logs"}}))
+	assert.Equal(t, 1, encoder.calls)
+
+	// The errors for all the disallowed topics are returned.
+	producer.cfg.MultiTopicRouter = func(model.APMEvent) []apmqueue.Topic {
+		return []apmqueue.Topic{"logs", "traces", "spans"}
+	}
+	err = producer.ProcessEvent(ctx, model.APMEvent{})
+	assert.ErrorIs(t, err, ErrTopicNotAllowed)
+	assert.EqualError(t, err, "kafka: topic not allowed: \"traces\"\nkafka: topic not allowed: \"spans\"")
+}
+
+func TestProducerMaxDistinctTopics(t *testing.T) {
+	var n int
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		// A buggy router which routes every event to a new topic.
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			n++
+			return apmqueue.Topic(fmt.Sprintf("topic-%d", n))
+		},
+		MaxDistinctTopics: 3,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+	}
+	err = producer.ProcessEvent(ctx, model.APMEvent{})
+	assert.ErrorIs(t, err, ErrTooManyTopics)
+	assert.EqualError(t, err, `kafka: too many distinct topics: "topic-4" exceeds the limit of 3 topics`)
+
+	// The topics which were already routed to can still be produced to.
+	producer.cfg.TopicRouter = func(model.APMEvent) apmqueue.Topic { return "topic-2" }
+	assert.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+
+	// Building records checks the limit, but doesn't count towards it.
+	producer, err = NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(event.Service.Name)
+		},
+		MaxDistinctTopics: 2,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+	event := func(topic string) model.APMEvent {
+		return model.APMEvent{Service: model.Service{Name: topic}}
+	}
+	_, err = producer.BuildRecords(ctx, &model.Batch{event("a"), event("b"), event("c")})
+	assert.EqualError(t, err, `kafka: too many distinct topics: "c" exceeds the limit of 2 topics`)
+	for _, topic := range []string{"c", "d", "e"} {
+		_, err = producer.BuildRecords(ctx, &model.Batch{event(topic)})
+		assert.NoError(t, err)
+	}
+	// A rejected batch doesn't count its topics towards the limit.
+	err = producer.ProcessBatch(ctx, &model.Batch{event("a"), event("b"), event("c")})
+	assert.ErrorIs(t, err, ErrTooManyTopics)
+	require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{event("d"), event("e")}))
+	err = producer.ProcessEvent(ctx, event("a"))
+	assert.EqualError(t, err, `kafka: too many distinct topics: "a" exceeds the limit of 2 topics`)
+
+	_, err = NewProducer(ProducerConfig{
+		Brokers:           []string{"127.0.0.1:1"},
+		Logger:            zap.NewNop(),
+		Encoder:           json.JSON{},
+		TopicRouter:       func(model.APMEvent) apmqueue.Topic { return "topic" },
+		MaxDistinctTopics: -1,
+	})
+	assert.ErrorContains(t, err, "kafka: max distinct topics cannot be negative")
+}
+
+func TestProducerMultiTopicRouter(t *testing.T) {
+	topics := []string{"primary", "analytics"}
+	client, brokers := newClusterWithTopics(t, topics...)
+	encoder := &countingEncoder{}
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: encoder,
+		MultiTopicRouter: func(event model.APMEvent) []apmqueue.Topic {
+			if event.Transaction == nil {
+				return nil
+			}
+			return []apmqueue.Topic{"primary", "analytics"}
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	event := model.APMEvent{Transaction: &model.Transaction{ID: "1"}}
+	require.NoError(t, producer.ProcessBatch(ctx, &model.Batch{
+		event,
+		{}, // Not routed to any topic.
+	}))
+	// The event is encoded once.
+	assert.Equal(t, 1, encoder.calls)
+
+	client.AddConsumeTopics(topics...)
+	var produced []string
+	for len(produced) < 2 {
+		fetches := client.PollRecords(ctx, 2)
+		require.NoError(t, fetches.Err())
+		fetches.EachRecord(func(r *kgo.Record) {
+			var decoded model.APMEvent
+			require.NoError(t, json.JSON{}.Decode(r.Value, &decoded))
+			assert.Equal(t, event, decoded)
+			produced = append(produced, r.Topic)
+		})
+	}
+	assert.ElementsMatch(t, topics, produced)
+}
+
+func TestProducerSpanLinkExtractor(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		SpanLinkExtractor: TraceSpanLink,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	batch := model.Batch{
+		{Trace: model.Trace{ID: "trace-1"}, Transaction: &model.Transaction{ID: "tx-1"}},
+		{Trace: model.Trace{ID: "trace-2"}, Span: &model.Span{ID: "span-1"}},
+		{Trace: model.Trace{ID: "trace-1"}, Span: &model.Span{ID: "span-2"}},
+		// Events without a span ID have no span link.
+		{Trace: model.Trace{ID: "trace-3"}},
+	}
+	records, err := producer.BuildRecords(context.Background(), &batch)
+	require.NoError(t, err)
+	var links []string
+	for _, record := range records {
+		var link string
+		for _, h := range record.Headers {
+			if h.Key == SpanLinkHeader {
+				link = string(h.Value)
+			}
+		}
+		links = append(links, link)
+	}
+	assert.Equal(t, []string{"trace-1-tx-1", "trace-2-span-1", "trace-1-span-2", ""}, links)
+}
+
+func TestRecordExpired(t *testing.T) {
+	now := time.Now()
+	header := func(v string) *kgo.Record {
+		return &kgo.Record{Headers: []kgo.RecordHeader{{Key: ExpiresAtHeader, Value: []byte(v)}}}
+	}
+	expiresAt := now.UnixMilli()
+	assert.False(t, RecordExpired(&kgo.Record{}, now))
+	assert.False(t, RecordExpired(header("invalid"), now))
+	assert.False(t, RecordExpired(header(fmt.Sprint(expiresAt)), now))
+	assert.True(t, RecordExpired(header(fmt.Sprint(expiresAt)), now.Add(time.Millisecond)))
+}
+
+func TestProducerCloseWaitsForCallbacks(t *testing.T) {
+	var mu sync.Mutex
+	var closed bool
+	var failed []error
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, so the records are buffered until
+		// the producer is closed.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		ErrorHandler: func(_ *kgo.Record, err error, _ ErrorClass) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.False(t, closed, "callback ran after Close returned")
+			failed = append(failed, err)
+		},
+	})
+	require.NoError(t, err)
+
+	// Produce from multiple goroutines, and close the producer right away.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := model.Batch{{}, {}, {}}
+			if err := producer.ProcessBatch(context.Background(), &batch); err != nil {
+				assert.ErrorIs(t, err, ErrProducerClosed)
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, producer.Close())
+	mu.Lock()
+	defer mu.Unlock()
+	closed = true
+	assert.Len(t, failed, 30)
+	for _, err := range failed {
+		assert.ErrorIs(t, err, kgo.ErrClientClosed)
+	}
+}
+
+func TestProducerCloseReentrantErrorHandler(t *testing.T) {
+	for name, closeProducer := range map[string]func(*Producer) error{
+		"close": (*Producer).Close,
+		"shutdown": func(p *Producer) error {
+			// Nothing listens on the brokers address, so the records can't
+			// be flushed.
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			return p.Shutdown(ctx)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var producer *Producer
+			var mu sync.Mutex
+			var reentrantErrs []error
+			producer, err := NewProducer(ProducerConfig{
+				Brokers: []string{"127.0.0.1:1"},
+				Logger:  zap.NewNop(),
+				Encoder: json.JSON{},
+				TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+					return "topic"
+				},
+				// The ErrorHandler shouldn't block, but calling the producer
+				// from it mustn't deadlock Close nor Shutdown.
+				ErrorHandler: func(r *kgo.Record, err error, _ ErrorClass) {
+					err = producer.ProduceRecords(context.Background(), []kgo.Record{
+						DeadLetterRecord(r, "dead-letters", err),
+					})
+					mu.Lock()
+					defer mu.Unlock()
+					reentrantErrs = append(reentrantErrs, err)
+				},
+			})
+			require.NoError(t, err)
+
+			batch := model.Batch{{}, {}, {}}
+			require.NoError(t, producer.ProcessBatch(context.Background(), &batch))
+			closed := make(chan error)
+			go func() { closed <- closeProducer(producer) }()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out closing the producer")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Len(t, reentrantErrs, 3)
+			for _, err := range reentrantErrs {
+				assert.ErrorIs(t, err, ErrProducerClosed)
+			}
+		})
+	}
+}
+
+func TestProducerShutdown(t *testing.T) {
+	newProducer := func(brokers []string) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: brokers,
+			Logger:  zap.NewNop(),
+			Encoder: json.JSON{},
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return "default-topic"
+			},
+		})
+		require.NoError(t, err)
+		return producer
+	}
+	t.Run("flushed", func(t *testing.T) {
+		client, brokers := newClusterWithTopics(t, "default-topic")
+		producer := newProducer(brokers)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, producer.ProcessEvent(ctx, model.APMEvent{}))
+		require.NoError(t, producer.Shutdown(ctx))
+		assert.ErrorIs(t, producer.ProcessEvent(ctx, model.APMEvent{}), ErrProducerClosed)
+		assert.NoError(t, producer.Shutdown(ctx))
+
+		client.AddConsumeTopics("default-topic")
+		fetches := client.PollRecords(ctx, 1)
+		require.NoError(t, fetches.Err())
+		assert.Len(t, fetches.Records(), 1)
+	})
+	t.Run("failed", func(t *testing.T) {
+		// Nothing listens on this address, so the record can't be produced.
+		producer := newProducer([]string{"127.0.0.1:1"})
+		require.NoError(t, producer.ProcessEvent(context.Background(), model.APMEvent{}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := producer.Shutdown(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorIs(t, err, kgo.ErrClientClosed)
+		assert.ErrorContains(t, err, "kafka: 1 records failed to be produced during shutdown")
+	})
+}
+
+func TestCloseAll(t *testing.T) {
+	client, brokers := newClusterWithTopics(t, "default-topic")
+	newProducer := func(brokers []string) *Producer {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: brokers,
+			Logger:  zap.NewNop(),
+			Encoder: json.JSON{},
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return "default-topic"
+			},
+		})
+		require.NoError(t, err)
+		return producer
+	}
+	producers := []*Producer{
+		newProducer(brokers),
+		// Nothing listens on this address, so the record can't be produced.
+		newProducer([]string{"127.0.0.1:1"}),
+		newProducer(brokers),
+	}
+	for _, producer := range producers {
+		require.NoError(t, producer.ProcessEvent(context.Background(), model.APMEvent{}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := CloseAll(ctx, producers...)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "kafka: failed closing producer 1")
+	assert.NotContains(t, err.Error(), "producer 0")
+	assert.NotContains(t, err.Error(), "producer 2")
+
+	// All the producers are closed, and the healthy ones were drained.
+	for _, producer := range producers {
+		assert.ErrorIs(t, producer.ProcessEvent(ctx, model.APMEvent{}), ErrProducerClosed)
+	}
+	pollCtx, pollCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer pollCancel()
+	client.AddConsumeTopics("default-topic")
+	var records []*kgo.Record
+	for len(records) < 2 {
+		fetches := client.PollRecords(pollCtx, 2)
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	assert.Len(t, records, 2)
+}
+
+func TestNewProducerTimeouts(t *testing.T) {
+	cfg := ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		RequestTimeoutOverhead: 30 * time.Second,
+		ConnIdleTimeout:        time.Minute,
+		DialTimeout:            15 * time.Second,
+	}
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	defer producer.Close()
+	assert.Equal(t, 30*time.Second, producer.client.OptValue(kgo.RequestTimeoutOverhead))
+	assert.Equal(t, time.Minute, producer.client.OptValue(kgo.ConnIdleTimeout))
+	// The dial timeout isn't exposed by kgo.Client.OptValue.
+
+	cfg.RequestTimeoutOverhead = -1
+	cfg.ConnIdleTimeout = -1
+	cfg.DialTimeout = -1
+	_, err = NewProducer(cfg)
+	assert.ErrorContains(t, err, "request timeout overhead cannot be negative")
+	assert.ErrorContains(t, err, "conn idle timeout cannot be negative")
+	assert.ErrorContains(t, err, "dial timeout cannot be negative")
+}
+
+func TestNewProducerBrokerMaxWriteBytes(t *testing.T) {
+	cfg := ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	}
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, int32(100<<20), producer.client.OptValue(kgo.BrokerMaxWriteBytes))
+	require.NoError(t, producer.Close())
+
+	cfg.BrokerMaxWriteBytes = 10 << 20
+	producer, err = NewProducer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, int32(10<<20), producer.client.OptValue(kgo.BrokerMaxWriteBytes))
+	require.NoError(t, producer.Close())
+
+	cfg.BrokerMaxWriteBytes = -1
+	_, err = NewProducer(cfg)
+	assert.ErrorContains(t, err, "kafka: broker max write bytes cannot be negative")
+}
+
+func TestNewProducerThroughputOptions(t *testing.T) {
+	cfg := ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		Linger:             10 * time.Millisecond,
+		MaxBufferedRecords: 100,
+		CompressionCodec:   []kgo.CompressionCodec{kgo.ZstdCompression()},
+	}
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Millisecond, producer.client.OptValue(kgo.ProducerLinger))
+	assert.Equal(t, int64(100), producer.client.OptValue(kgo.MaxBufferedRecords))
+	assert.Equal(t, []kgo.CompressionCodec{kgo.ZstdCompression()},
+		producer.client.OptValue(kgo.ProducerBatchCompression),
+	)
+	require.NoError(t, producer.Close())
+
+	cfg.Linger = -1
+	_, err = NewProducer(cfg)
+	assert.ErrorContains(t, err, "kafka: linger cannot be negative")
+}
+
+func TestProducerZstdDictEncoder(t *testing.T) {
+	newEvent := func(i int) model.APMEvent {
+		return model.APMEvent{
+			Service: model.Service{Name: "service", Environment: "production"},
+			Metricset: &model.Metricset{
+				Name: "app",
+				Samples: []model.MetricsetSample{
+					{Name: "system.memory.actual.free", Value: float64(i)},
+				},
+			},
+		}
+	}
+	var dict []byte
+	for i := 0; i < 3; i++ {
+		encoded, err := json.JSON{}.Encode(newEvent(i))
+		require.NoError(t, err)
+		dict = append(dict, encoded...)
+	}
+	newEncoder := func(dict []byte) *compress.Zstd {
+		encoder, err := compress.NewZstd(json.JSON{}, dict)
+		require.NoError(t, err)
+		return encoder
+	}
+	cfg := ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		EmitContentTypeHeader: true,
+	}
+	newProducer := func(encoder Encoder) *Producer {
+		cfg := cfg
+		cfg.Encoder = encoder
+		producer, err := NewProducer(cfg)
+		require.NoError(t, err)
+		t.Cleanup(func() { producer.Close() })
+		return producer
+	}
+	buildRecords := func(producer *Producer) []*kgo.Record {
+		var batch model.Batch
+		for i := 10; i < 20; i++ {
+			batch = append(batch, newEvent(i))
+		}
+		records, err := producer.BuildRecords(context.Background(), &batch)
+		require.NoError(t, err)
+		return records
+	}
+	recordsSize := func(records []*kgo.Record) int {
+		var size int
+		for _, r := range records {
+			size += len(r.Value)
+		}
+		return size
+	}
+	sizeWithoutDict := recordsSize(buildRecords(newProducer(newEncoder(nil))))
+	producer := newProducer(newEncoder(dict))
+	records := buildRecords(producer)
+	// The sizes are approximate, but the dictionary makes a big difference
+	// for such small records.
+	assert.Less(t, recordsSize(records)*2, sizeWithoutDict)
+
+	// The values are compressed already, so the batches aren't.
+	assert.Equal(t, []kgo.CompressionCodec{kgo.NoCompression()},
+		producer.client.OptValue(kgo.ProducerBatchCompression),
+	)
+	// The content type describes the payload, and the content encoding its
+	// compression.
+	assert.Equal(t, []kgo.RecordHeader{
+		{Key: ContentTypeHeader, Value: []byte(json.ContentType)},
+		{Key: ContentEncodingHeader, Value: []byte(compress.ZstdContentEncoding)},
+	}, records[0].Headers)
+
+	// The records are decoded with the same dictionary.
+	var event model.APMEvent
+	require.NoError(t, newEncoder(dict).Decode(records[0].Value, &event))
+	assert.Equal(t, newEvent(10), event)
+
+	// The values aren't compressed twice.
+	cfg.Encoder = newEncoder(dict)
+	cfg.CompressionCodec = []kgo.CompressionCodec{kgo.ZstdCompression()}
+	_, err := NewProducer(cfg)
+	assert.ErrorContains(t, err, "kafka: batch compression cannot be combined with an encoder which compresses the values")
+	cfg.CompressionCodec = []kgo.CompressionCodec{kgo.NoCompression()}
+	producer, err = NewProducer(cfg)
+	require.NoError(t, err)
+	require.NoError(t, producer.Close())
+
+	// The wrapped codec must have a content type to emit the header.
+	encoder, err := compress.NewZstd(struct{ compress.Codec }{json.JSON{}}, nil)
+	require.NoError(t, err)
+	cfg.Encoder = encoder
+	_, err = NewProducer(cfg)
+	assert.ErrorContains(t, err, "kafka: encoder must implement codec.ContentTyper to emit the content type header")
+}
+
+func TestProducerTLSConfigProvider(t *testing.T) {
+	_, err := NewProducer(ProducerConfig{
+		Brokers:           []string{"127.0.0.1:1"},
+		Logger:            zap.NewNop(),
+		Encoder:           json.JSON{},
+		TopicRouter:       func(model.APMEvent) apmqueue.Topic { return "topic" },
+		TLS:               &tls.Config{},
+		TLSConfigProvider: func() *tls.Config { return &tls.Config{} },
+	})
+	assert.ErrorContains(t, err, "kafka: TLS and TLS config provider cannot be set together")
+
+	// The server records the certificate presented by each client.
+	serverCert := newTestCertificate(t, "server")
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	require.NoError(t, err)
+	defer lis.Close()
+	clientCerts := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err == nil {
+				clientCerts <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+
+	var mu sync.Mutex
+	cert := newTestCertificate(t, "client-1")
+	dial := tlsDialer(func() (*tls.Config, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+		}, nil
+	}, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "client-1", <-clientCerts)
+
+	// Rotate the certificate, new connections use it.
+	mu.Lock()
+	cert = newTestCertificate(t, "client-2")
+	mu.Unlock()
+	conn, err = dial(ctx, "tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "client-2", <-clientCerts)
+}
+
+// newTestCertificate returns a self-signed certificate for commonName.
+func newTestCertificate(t testing.TB, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestProducerReconnectBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []int
+	producer, err := NewProducer(ProducerConfig{
+		// Nothing listens on this address, causing the connection attempts
+		// to fail and to be retried.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		ReconnectBackoff: func(attempt int) time.Duration {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, attempt)
+			return time.Millisecond
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	// The backoff function is shared by different retry loops, each keeping
+	// its own attempt count, so look for the first occurrence of each attempt.
+	indexOf := func(attempt int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, a := range attempts {
+			if a == attempt {
+				return i
+			}
+		}
+		return -1
+	}
+	assert.Eventually(t, func() bool {
+		return indexOf(3) >= 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Less(t, indexOf(1), indexOf(2))
+	assert.Less(t, indexOf(2), indexOf(3))
+}
+
+func TestNewProducerWaitForMetadata(t *testing.T) {
+	// Reserve a port for the cluster, which is started after the producer.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	cfg := ProducerConfig{
+		Brokers: []string{fmt.Sprintf("127.0.0.1:%d", port)},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		ReconnectBackoff: func(int) time.Duration { return 10 * time.Millisecond },
+		WaitForMetadata:  50 * time.Millisecond,
+	}
+	_, err = NewProducer(cfg)
+	assert.ErrorContains(t, err, "kafka: no broker reachable within 50ms")
+
+	cfg.WaitForMetadata = 5 * time.Second
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		time.Sleep(200 * time.Millisecond)
+		cluster, err := kfake.NewCluster(kfake.Ports(port))
+		if assert.NoError(t, err) {
+			t.Cleanup(cluster.Close)
+		}
+	}()
+	producer, err := NewProducer(cfg)
+	require.NoError(t, err)
+	<-started
+	assert.NoError(t, producer.Healthy())
+	assert.NoError(t, producer.Close())
+}
+
+func TestProducerWaitReady(t *testing.T) {
+	// Reserve a port for the cluster, which is started after the producer.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{fmt.Sprintf("127.0.0.1:%d", port)},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		ReconnectBackoff: func(int) time.Duration { return 10 * time.Millisecond },
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, producer.WaitReady(ctx), "kafka: no broker reachable")
+
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		time.Sleep(200 * time.Millisecond)
+		cluster, err := kfake.NewCluster(kfake.Ports(port))
+		if assert.NoError(t, err) {
+			t.Cleanup(cluster.Close)
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, producer.WaitReady(ctx))
+	<-started
+}
+
+// BenchmarkProducerProcessBatch measures the throughput of a Sync producer,
+// producing batches of different sizes with different compression codecs to
+// an in-memory cluster. Each iteration produces a single batch, so ns/op is
+// the latency of ProcessBatch and events/s its throughput. Since the cluster
+// runs in process, the results reflect the client-side cost of encoding,
+// batching and compressing the records, and are only meaningful when compared
+// with each other, for example, before and after a change:
+//
+//	go test -run - -bench BenchmarkProducerProcessBatch -benchmem ./kafka
+func BenchmarkProducerProcessBatch(b *testing.B) {
+	codecs := map[string]kgo.CompressionCodec{
+		"none":   kgo.NoCompression(),
+		"snappy": kgo.SnappyCompression(),
+		"lz4":    kgo.Lz4Compression(),
+		"zstd":   kgo.ZstdCompression(),
+	}
+	for _, size := range []int{1, 100, 1000} {
+		for name, codec := range codecs {
+			b.Run(fmt.Sprintf("batch=%d/compression=%s", size, name), func(b *testing.B) {
+				benchmarkProducerProcessBatch(b, size, codec)
+			})
+		}
+	}
+}
+
+func benchmarkProducerProcessBatch(b *testing.B, size int, codec kgo.CompressionCodec) {
+	topic := "default-topic"
+	_, brokers := newClusterWithTopics(b, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers:          brokers,
+		Sync:             true,
+		Logger:           zap.NewNop(),
+		Encoder:          json.JSON{},
+		CompressionCodec: []kgo.CompressionCodec{codec},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+	})
+	require.NoError(b, err)
+	defer producer.Close()
+
+	batch := make(model.Batch, size)
+	for i := range batch {
+		batch[i] = model.APMEvent{
+			Transaction: &model.Transaction{ID: strconv.Itoa(i), Name: "GET /"},
+			Service:     model.Service{Name: "service"},
+		}
+	}
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := producer.ProcessBatch(ctx, &batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*size)/b.Elapsed().Seconds(), "events/s")
+}
+
+func TestNewProducerFromConfig(t *testing.T) {
+	// The SASL mechanisms are told apart by the user they authenticate.
+	saslUser := func(m sasl.Mechanism) string {
+		_, msg, err := m.Authenticate(context.Background(), "127.0.0.1:1")
+		require.NoError(t, err)
+		return strings.Split(string(msg), "\x00")[1]
+	}
+	shared := apmqueue.Config{
+		Brokers:  []string{"127.0.0.1:1"},
+		SASL:     saslplain.New(saslplain.Plain{User: "shared", Pass: "secret"}),
+		TLS:      &tls.Config{ServerName: "shared"},
+		ClientID: "shared",
+	}
+	producer, err := NewProducerFromConfig(shared, ProducerConfig{
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		// The producer-specific settings take precedence.
+		ClientID: "producer",
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+	assert.Equal(t, []string{"127.0.0.1:1"}, producer.cfg.Brokers)
+	assert.Equal(t, "shared", saslUser(producer.cfg.SASL))
+	assert.Equal(t, "shared", producer.cfg.TLS.ServerName)
+	assert.Equal(t, "producer", producer.cfg.ClientID)
+
+	provider := func() *tls.Config { return &tls.Config{ServerName: "producer"} }
+	merged := mergeSharedConfig(shared, ProducerConfig{
+		Brokers:           []string{"127.0.0.1:2"},
+		SASL:              saslplain.New(saslplain.Plain{User: "producer", Pass: "secret"}),
+		TLSConfigProvider: provider,
+	})
+	assert.Equal(t, []string{"127.0.0.1:2"}, merged.Brokers)
+	assert.Equal(t, "producer", saslUser(merged.SASL))
+	// The shared TLS config isn't used along with a TLSConfigProvider.
+	assert.Nil(t, merged.TLS)
+	assert.Equal(t, "shared", merged.ClientID)
+}
+
+func newClusterWithTopics(t testing.TB, topics ...string) (*kgo.Client, []string) {
+	t.Helper()
+	cluster, err := kfake.NewCluster()
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+
+	addrs := cluster.ListenAddrs()
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(addrs...))
+	require.NoError(t, err)
+
+	kadmClient := kadm.NewClient(client)
+	t.Cleanup(kadmClient.Close)
+
+	_, err = kadmClient.CreateTopics(context.Background(), 2, 1, nil, topics...)
+	require.NoError(t, err)
+	return client, addrs
+}
+
+type countingEncoder struct {
+	calls int
+}
+
+func (e *countingEncoder) Encode(event model.APMEvent) ([]byte, error) {
+	e.calls++
+	return json.JSON{}.Encode(event)
+}
+
+// setClock replaces the clock used by the producer, resetting the last
+// activity time, which NewProducer seeds from the real clock.
+func setClock(p *Producer, clock func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clock = clock
+	p.lastActive.Store(clock().UnixNano())
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// spanFailingEncoder fails to encode spans, encoding the rest of the events
+// as JSON.
+type spanFailingEncoder struct{}
+
+func (spanFailingEncoder) Encode(event model.APMEvent) ([]byte, error) {
+	if event.Span != nil {
+		return nil, errEncode
+	}
+	return json.JSON{}.Encode(event)
+}
+
+type panickingEncoder struct{}
+
+func (panickingEncoder) Encode(model.APMEvent) ([]byte, error) {
+	panic("boom")
 }
@@ -0,0 +1,163 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+)
+
+const (
+	// RateLimitBlock blocks ProcessBatch until the batch is within the rate
+	// limit, or the context is done.
+	RateLimitBlock RateLimitPolicy = iota
+	// RateLimitError fails ProcessBatch with ErrRateLimited when the batch
+	// exceeds the rate limit, without processing it.
+	RateLimitError
+)
+
+// ErrRateLimited is returned by RateLimitProcessor.ProcessBatch when a batch
+// exceeds the rate limit and the RateLimitError policy is used.
+var ErrRateLimited = errors.New("kafka: rate limit exceeded")
+
+// RateLimitPolicy determines what happens to batches which exceed the limit.
+type RateLimitPolicy uint8
+
+// RateLimitConfig holds the configuration of a RateLimitProcessor.
+type RateLimitConfig struct {
+	// RecordsPerSecond is the sustained rate of events which are processed.
+	RecordsPerSecond float64
+	// Burst is the maximum number of events which are processed at once,
+	// after the limit hasn't been reached for a while. If <= 0, it defaults
+	// to RecordsPerSecond, rounded up.
+	Burst int
+	// Policy determines what happens to the batches exceeding the limit.
+	// If not set, it defaults to RateLimitBlock.
+	Policy RateLimitPolicy
+}
+
+// RateLimitProcessor is a model.BatchProcessor which limits the rate of the
+// events processed by its processor, using a token bucket which holds up to
+// Burst tokens and is refilled at RecordsPerSecond. Each event consumes a
+// token.
+//
+// With the RateLimitBlock policy, batches which exceed the available tokens
+// wait for the tokens to be refilled, including batches larger than Burst,
+// which wait until the limiter has recovered from the excess. With the
+// RateLimitError policy, they're rejected with ErrRateLimited.
+type RateLimitProcessor struct {
+	processor model.BatchProcessor
+	cfg       RateLimitConfig
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimitProcessor returns a new RateLimitProcessor which limits the
+// rate of the events processed by processor, according to cfg.
+func NewRateLimitProcessor(processor model.BatchProcessor, cfg RateLimitConfig) (*RateLimitProcessor, error) {
+	var errs []error
+	if processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	if cfg.RecordsPerSecond <= 0 {
+		errs = append(errs, errors.New("kafka: records per second must be greater than zero"))
+	}
+	switch cfg.Policy {
+	case RateLimitBlock, RateLimitError:
+	default:
+		errs = append(errs, fmt.Errorf("kafka: unknown rate limit policy %d", cfg.Policy))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.RecordsPerSecond))
+	}
+	return &RateLimitProcessor{
+		processor: processor,
+		cfg:       cfg,
+		tokens:    float64(cfg.Burst),
+		last:      time.Now(),
+	}, nil
+}
+
+// ProcessBatch processes the batch once it's within the rate limit. With the
+// RateLimitBlock policy, it returns the context error if ctx is done while
+// waiting, without processing the batch.
+func (r *RateLimitProcessor) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	n := float64(len(*batch))
+	wait, ok := r.reserve(n)
+	if !ok {
+		return ErrRateLimited
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			r.release(n)
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return r.processor.ProcessBatch(ctx, batch)
+}
+
+// reserve takes n tokens, returning how long to wait until they're available.
+// With the RateLimitError policy, it returns false if the tokens aren't
+// available, without taking them.
+func (r *RateLimitProcessor) reserve(n float64) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refill()
+	if r.tokens >= n {
+		r.tokens -= n
+		return 0, true
+	}
+	if r.cfg.Policy == RateLimitError {
+		return 0, false
+	}
+	missing := n - r.tokens
+	r.tokens -= n
+	return time.Duration(missing / r.cfg.RecordsPerSecond * float64(time.Second)), true
+}
+
+// release returns n tokens which were reserved, but not used.
+func (r *RateLimitProcessor) release(n float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refill()
+	r.tokens = math.Min(r.tokens+n, float64(r.cfg.Burst))
+}
+
+// refill adds the tokens accumulated since the last refill. It must be called
+// with the lock held.
+func (r *RateLimitProcessor) refill() {
+	now := time.Now()
+	elapsed := now.Sub(r.last).Seconds()
+	r.last = now
+	r.tokens = math.Min(r.tokens+elapsed*r.cfg.RecordsPerSecond, float64(r.cfg.Burst))
+}
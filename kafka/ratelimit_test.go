@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestNewRateLimitProcessor(t *testing.T) {
+	_, err := NewRateLimitProcessor(nil, RateLimitConfig{Policy: 10})
+	assert.EqualError(t, err, "kafka: processor must be set\n"+
+		"kafka: records per second must be greater than zero\n"+
+		"kafka: unknown rate limit policy 10",
+	)
+}
+
+func TestRateLimitProcessor(t *testing.T) {
+	newProcessor := func(t *testing.T, cfg RateLimitConfig) (*RateLimitProcessor, *int) {
+		var processed int
+		r, err := NewRateLimitProcessor(model.ProcessBatchFunc(
+			func(_ context.Context, b *model.Batch) error {
+				processed += len(*b)
+				return nil
+			},
+		), cfg)
+		require.NoError(t, err)
+		return r, &processed
+	}
+	batch := func(n int) *model.Batch {
+		b := make(model.Batch, n)
+		return &b
+	}
+	ctx := context.Background()
+
+	t.Run("block", func(t *testing.T) {
+		r, processed := newProcessor(t, RateLimitConfig{RecordsPerSecond: 100, Burst: 10})
+		start := time.Now()
+		require.NoError(t, r.ProcessBatch(ctx, batch(10)))
+		assert.Less(t, time.Since(start), 10*time.Millisecond)
+
+		// The burst has been consumed, the next 5 events take 50ms.
+		require.NoError(t, r.ProcessBatch(ctx, batch(5)))
+		assert.GreaterOrEqual(t, time.Since(start), 45*time.Millisecond)
+		assert.Equal(t, 15, *processed)
+	})
+	t.Run("error", func(t *testing.T) {
+		r, processed := newProcessor(t, RateLimitConfig{
+			RecordsPerSecond: 1, Burst: 10, Policy: RateLimitError,
+		})
+		require.NoError(t, r.ProcessBatch(ctx, batch(8)))
+		assert.ErrorIs(t, r.ProcessBatch(ctx, batch(5)), ErrRateLimited)
+		require.NoError(t, r.ProcessBatch(ctx, batch(2)))
+		assert.Equal(t, 10, *processed)
+	})
+	t.Run("context_cancelled", func(t *testing.T) {
+		r, processed := newProcessor(t, RateLimitConfig{RecordsPerSecond: 1, Burst: 1})
+		require.NoError(t, r.ProcessBatch(ctx, batch(1)))
+
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, r.ProcessBatch(ctx, batch(1)), context.DeadlineExceeded)
+		assert.Equal(t, 1, *processed)
+	})
+}
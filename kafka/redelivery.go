@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/instrument"
+)
+
+// redeliveryTracker counts the records which are consumed again after their
+// offsets were committed by the consumer, typically, after a rebalance
+// reassigns a partition whose processed records weren't all committed, or
+// whose offsets were committed elsewhere.
+//
+// It's a heuristic: only the offsets committed by the consumer since it was
+// created are known, so the records committed by other group members, or
+// before a restart, aren't counted.
+type redeliveryTracker struct {
+	mu sync.Mutex
+	// committed holds the offset of the next record to consume of each
+	// partition, as committed by the consumer.
+	committed   map[topicPartition]int64
+	redelivered instrument.Int64Counter
+}
+
+func newRedeliveryTracker(redelivered instrument.Int64Counter) *redeliveryTracker {
+	return &redeliveryTracker{
+		committed:   make(map[topicPartition]int64),
+		redelivered: redelivered,
+	}
+}
+
+// commit records that the offset of the next record to consume from the
+// partition has been committed. Offsets lower than the highest committed one
+// are ignored. It's a no-op when t is nil.
+func (t *redeliveryTracker) commit(topic string, partition int32, offset int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tp := topicPartition{topic: topic, partition: partition}
+	if offset > t.committed[tp] {
+		t.committed[tp] = offset
+	}
+}
+
+// observe counts the records whose offsets have already been committed in
+// the consumer.records.redelivered metric. It must be called before the
+// offsets of the records are committed. It's a no-op when t is nil.
+func (t *redeliveryTracker) observe(records []*kgo.Record) {
+	if t == nil || len(records) == 0 {
+		return
+	}
+	counts := make(map[string]int64)
+	t.mu.Lock()
+	for _, r := range records {
+		tp := topicPartition{topic: r.Topic, partition: r.Partition}
+		if committed, ok := t.committed[tp]; ok && r.Offset < committed {
+			counts[r.Topic]++
+		}
+	}
+	t.mu.Unlock()
+	for topic, n := range counts {
+		t.redelivered.Add(context.Background(), n,
+			attribute.String("topic", topic),
+		)
+	}
+}
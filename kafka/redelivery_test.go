@@ -0,0 +1,179 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestRedeliveryTracker(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	cm, err := newConsumerMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	require.NoError(t, err)
+	tracker := newRedeliveryTracker(cm.recordsRedelivered)
+
+	records := func(topic string, partition int32, offsets ...int64) []*kgo.Record {
+		rs := make([]*kgo.Record, 0, len(offsets))
+		for _, o := range offsets {
+			rs = append(rs, &kgo.Record{Topic: topic, Partition: partition, Offset: o})
+		}
+		return rs
+	}
+	// Nothing has been committed yet.
+	tracker.observe(records("a", 0, 0, 1, 2))
+	assert.NotContains(t, collectMetrics(t, reader), "consumer.records.redelivered")
+
+	tracker.commit("a", 0, 3)
+	// Lower offsets are ignored.
+	tracker.commit("a", 0, 1)
+	tracker.observe(records("a", 0, 1, 2, 3, 4))
+	// Other partitions have their own committed offsets.
+	tracker.observe(records("a", 1, 0, 1))
+	tracker.commit("b", 0, 1)
+	tracker.observe(records("b", 0, 0))
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "consumer.records.redelivered")
+	sum, ok := metrics["consumer.records.redelivered"].(metricdata.Sum[int64])
+	require.True(t, ok)
+	redelivered := make(map[attribute.Set]int64)
+	for _, dp := range sum.DataPoints {
+		redelivered[dp.Attributes] = dp.Value
+	}
+	assert.Equal(t, map[attribute.Set]int64{
+		attribute.NewSet(attribute.String("topic", "a")): 2,
+		attribute.NewSet(attribute.String("topic", "b")): 1,
+	}, redelivered)
+
+	// A nil tracker is a no-op.
+	var nilTracker *redeliveryTracker
+	nilTracker.commit("a", 0, 1)
+	nilTracker.observe(records("a", 0, 0))
+}
+
+func TestConsumerRecordsRedelivered(t *testing.T) {
+	topic := "default-topic"
+	_, brokers := newClusterWithTopics(t, topic)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	// Produce 5 records to each of the topic's partitions.
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < 10; i++ {
+		res := client.ProduceSync(ctx, &kgo.Record{
+			Topic: topic, Partition: int32(i % 2), Value: []byte(`{}`),
+		})
+		require.NoError(t, res.FirstErr())
+	}
+
+	newConsumer := func(mp *sdkmetric.MeterProvider, processed *atomic.Int64) *Consumer {
+		cfg := ConsumerConfig{
+			Brokers:         brokers,
+			Topics:          []string{topic},
+			GroupID:         "group",
+			Decoder:         json.JSON{},
+			Logger:          zap.NewNop(),
+			Delivery:        apmqueue.AtLeastOnceDeliveryType,
+			AutoOffsetReset: OffsetResetEarliest,
+			Processor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				processed.Add(1)
+				return nil
+			}),
+			CommitCallback: func(context.Context, map[string]map[int32]int64) error {
+				return nil
+			},
+			// Simulate an offset store which lost the committed offsets, so
+			// the records are re-delivered when a partition is reassigned.
+			LoadOffsets: func(_ context.Context, partitions map[string][]int32) (map[string]map[int32]int64, error) {
+				offsets := make(map[string]map[int32]int64)
+				for topic, ps := range partitions {
+					offsets[topic] = make(map[int32]int64)
+					for _, p := range ps {
+						offsets[topic][p] = 0
+					}
+				}
+				return offsets, nil
+			},
+		}
+		if mp != nil {
+			cfg.MeterProvider = mp
+		}
+		consumer, err := NewConsumer(cfg)
+		require.NoError(t, err)
+		return consumer
+	}
+	run := func(consumer *Consumer) func() {
+		runCtx, runCancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			consumer.Run(runCtx)
+		}()
+		return func() {
+			runCancel()
+			<-done
+			assert.NoError(t, consumer.Close())
+		}
+	}
+
+	reader := sdkmetric.NewManualReader()
+	var processed atomic.Int64
+	consumer := newConsumer(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), &processed)
+	defer run(consumer)()
+	require.Eventually(t, func() bool {
+		return processed.Load() == 10
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, collectMetrics(t, reader), "consumer.records.redelivered")
+
+	// Force a rebalance: a second member joins the group, taking over one
+	// of the partitions, and leaves it, handing the partition back.
+	var otherProcessed atomic.Int64
+	stop := run(newConsumer(nil, &otherProcessed))
+	require.Eventually(t, func() bool {
+		return otherProcessed.Load() == 5
+	}, 10*time.Second, 10*time.Millisecond)
+	stop()
+
+	// The records of the partition which was handed back are consumed
+	// again from the loaded offsets, after being committed.
+	assert.Eventually(t, func() bool {
+		sum, ok := collectMetrics(t, reader)["consumer.records.redelivered"].(metricdata.Sum[int64])
+		return ok && len(sum.DataPoints) == 1 && sum.DataPoints[0].Value == 5
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(15), processed.Load())
+}
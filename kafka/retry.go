@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// RetryConfig holds the configuration of a RetryProcessor.
+type RetryConfig struct {
+	// MaxRetries is the maximum number of times a failed batch is retried.
+	MaxRetries int
+	// Backoff returns how long to wait before retrying a failed batch, given
+	// the retry attempt (starting at 1). If nil, it defaults to an exponential
+	// backoff starting at 250ms and capped at 5s, with ±25% jitter applied.
+	Backoff func(attempt int) time.Duration
+	// MaxElapsedTime, if greater than zero, stops retrying a batch once the
+	// next retry would start after MaxElapsedTime since the first attempt.
+	MaxElapsedTime time.Duration
+}
+
+// RetryProcessor is a model.BatchProcessor which retries the batches which
+// its processor fails to process, waiting for a backoff between attempts.
+//
+// Processors which process a batch partially before failing may process the
+// same events more than once.
+type RetryProcessor struct {
+	processor model.BatchProcessor
+	cfg       RetryConfig
+}
+
+// NewRetryProcessor returns a new RetryProcessor which retries the batches
+// that processor fails to process, according to cfg.
+func NewRetryProcessor(processor model.BatchProcessor, cfg RetryConfig) (*RetryProcessor, error) {
+	var errs []error
+	if processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	if cfg.MaxRetries < 0 {
+		errs = append(errs, errors.New("kafka: max retries cannot be negative"))
+	}
+	if cfg.MaxElapsedTime < 0 {
+		errs = append(errs, errors.New("kafka: max elapsed time cannot be negative"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if cfg.Backoff == nil {
+		cfg.Backoff = defaultReconnectBackoff
+	}
+	return &RetryProcessor{processor: processor, cfg: cfg}, nil
+}
+
+// ProcessBatch processes the batch, retrying it on failure. It returns the
+// last error once the retries are exhausted, or as soon as ctx is done.
+func (r *RetryProcessor) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := r.processor.ProcessBatch(ctx, batch)
+		if err == nil {
+			return nil
+		}
+		backoff := r.cfg.Backoff(attempt)
+		if attempt > r.cfg.MaxRetries || (r.cfg.MaxElapsedTime > 0 &&
+			time.Since(start)+backoff > r.cfg.MaxElapsedTime) {
+			return fmt.Errorf("kafka: batch failed after %d attempts: %w", attempt, err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("kafka: batch retry aborted after %d attempts: %w",
+				attempt, errors.Join(err, ctx.Err()),
+			)
+		case <-timer.C:
+		}
+	}
+}
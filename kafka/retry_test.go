@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestNewRetryProcessor(t *testing.T) {
+	_, err := NewRetryProcessor(nil, RetryConfig{MaxRetries: -1, MaxElapsedTime: -1})
+	assert.EqualError(t, err, "kafka: processor must be set\n"+
+		"kafka: max retries cannot be negative\n"+
+		"kafka: max elapsed time cannot be negative",
+	)
+}
+
+func TestRetryProcessor(t *testing.T) {
+	errProcess := errors.New("process failed")
+	// failing returns a processor which fails n times before succeeding.
+	failing := func(n int, calls *int) model.BatchProcessor {
+		return model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			*calls++
+			if *calls <= n {
+				return errProcess
+			}
+			return nil
+		})
+	}
+	noBackoff := func(int) time.Duration { return 0 }
+
+	t.Run("success_after_retry", func(t *testing.T) {
+		var calls int
+		var attempts []int
+		r, err := NewRetryProcessor(failing(2, &calls), RetryConfig{
+			MaxRetries: 3,
+			Backoff: func(attempt int) time.Duration {
+				attempts = append(attempts, attempt)
+				return time.Millisecond
+			},
+		})
+		require.NoError(t, err)
+		assert.NoError(t, r.ProcessBatch(context.Background(), &model.Batch{}))
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, []int{1, 2}, attempts)
+	})
+	t.Run("exhausted", func(t *testing.T) {
+		var calls int
+		r, err := NewRetryProcessor(failing(10, &calls), RetryConfig{
+			MaxRetries: 2,
+			Backoff:    noBackoff,
+		})
+		require.NoError(t, err)
+		err = r.ProcessBatch(context.Background(), &model.Batch{})
+		assert.ErrorIs(t, err, errProcess)
+		assert.EqualError(t, err, "kafka: batch failed after 3 attempts: process failed")
+		assert.Equal(t, 3, calls)
+	})
+	t.Run("max_elapsed_time", func(t *testing.T) {
+		var calls int
+		r, err := NewRetryProcessor(failing(10, &calls), RetryConfig{
+			MaxRetries:     10,
+			Backoff:        func(int) time.Duration { return 10 * time.Millisecond },
+			MaxElapsedTime: 15 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		// The second retry would start after MaxElapsedTime.
+		assert.ErrorIs(t, r.ProcessBatch(context.Background(), &model.Batch{}), errProcess)
+		assert.Equal(t, 2, calls)
+	})
+	t.Run("context_cancelled", func(t *testing.T) {
+		var calls int
+		r, err := NewRetryProcessor(failing(10, &calls), RetryConfig{
+			MaxRetries: 10,
+			Backoff:    func(int) time.Duration { return time.Hour },
+		})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err = r.ProcessBatch(ctx, &model.Batch{})
+		assert.ErrorIs(t, err, errProcess)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, calls)
+	})
+}
@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+)
+
+// The messages logged by kgo when a produce request or a partition fails, and
+// the failed batch is retried. They aren't part of the kgo API, and are pinned
+// to the kgo version in use by TestKgoRetryLogMessages.
+const (
+	kgoBatchFailedMsg    = "batch in a produce request failed"
+	kgoPartitionErrorMsg = "produce partition load error, bumping error count on first stored batch"
+)
+
+// produceRetryLogger is a kgo.Logger which wraps another kgo.Logger, and logs
+// a structured event for each produce retry. kgo doesn't expose the retries
+// through hooks, so they're detected from the messages kgo logs when a produce
+// request or a partition fails. The attempts of a partition are counted until
+// a batch is successfully produced to it, which is reported by the
+// kgo.HookProduceBatchWritten hook.
+//
+// The level of the wrapped logger is kept, so the failed produce requests,
+// logged at the info level, are only detected when the info level is enabled,
+// which is the level the retry events are logged at anyway.
+type produceRetryLogger struct {
+	kgo.Logger
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	attempts map[topicPartition]int
+}
+
+func newProduceRetryLogger(wrapped kgo.Logger, logger *zap.Logger) *produceRetryLogger {
+	return &produceRetryLogger{
+		Logger:   wrapped,
+		logger:   logger,
+		attempts: make(map[topicPartition]int),
+	}
+}
+
+// Log logs the message with the wrapped logger, and logs a retry event if the
+// message reports a failed batch which is retried.
+func (l *produceRetryLogger) Log(level kgo.LogLevel, msg string, keyvals ...any) {
+	l.Logger.Log(level, msg, keyvals...)
+	if msg != kgoBatchFailedMsg && msg != kgoPartitionErrorMsg {
+		return
+	}
+	var (
+		broker string
+		tp     topicPartition
+		err    error
+		failed bool
+	)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case "broker":
+			broker = fmt.Sprint(keyvals[i+1])
+		case "topic":
+			tp.topic, _ = keyvals[i+1].(string)
+		case "partition":
+			tp.partition, _ = keyvals[i+1].(int32)
+		case "err":
+			err, _ = keyvals[i+1].(error)
+		case "max_retries_reached", "will_fail":
+			// The batch fails instead of being retried.
+			failed, _ = keyvals[i+1].(bool)
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if failed {
+		delete(l.attempts, tp)
+		return
+	}
+	l.attempts[tp]++
+	l.logger.Info("retrying produce",
+		zap.String("broker", broker),
+		zap.String("topic", tp.topic),
+		zap.Int32("partition", tp.partition),
+		zap.Int("attempt", l.attempts[tp]),
+		zap.Error(err),
+	)
+}
+
+// OnProduceBatchWritten resets the attempts of the partition the batch was
+// produced to.
+func (l *produceRetryLogger) OnProduceBatchWritten(_ kgo.BrokerMetadata, topic string, partition int32, _ kgo.ProduceBatchMetrics) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, topicPartition{topic: topic, partition: partition})
+}
@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	"go/build"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type testKgoLogger struct {
+	level  kgo.LogLevel
+	logged []string
+}
+
+func (l *testKgoLogger) Level() kgo.LogLevel { return l.level }
+
+func (l *testKgoLogger) Log(_ kgo.LogLevel, msg string, _ ...any) {
+	l.logged = append(l.logged, msg)
+}
+
+func TestProduceRetryLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	wrapped := &testKgoLogger{level: kgo.LogLevelInfo}
+	l := newProduceRetryLogger(wrapped, zap.New(core))
+	// The level of the wrapped logger isn't raised.
+	assert.Equal(t, kgo.LogLevelInfo, l.Level())
+	assert.Equal(t, kgo.LogLevelWarn, newProduceRetryLogger(
+		&testKgoLogger{level: kgo.LogLevelWarn}, zap.New(core),
+	).Level())
+
+	produceErr := errors.New("not leader for partition")
+	failBatch := func(final bool) {
+		l.Log(kgo.LogLevelInfo, kgoBatchFailedMsg,
+			"broker", "1",
+			"topic", "topic",
+			"partition", int32(2),
+			"err", produceErr,
+			"err_is_retryable", true,
+			"max_retries_reached", final,
+		)
+	}
+	failBatch(false)
+	failBatch(false)
+	assert.Equal(t, []string{kgoBatchFailedMsg, kgoBatchFailedMsg}, wrapped.logged)
+	wrapped.logged = nil
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 2)
+	for i, entry := range entries {
+		assert.Equal(t, "retrying produce", entry.Message)
+		assert.Equal(t, map[string]any{
+			"broker":    "1",
+			"topic":     "topic",
+			"partition": int32(2),
+			"attempt":   int64(i + 1),
+			"error":     produceErr.Error(),
+		}, entry.ContextMap())
+	}
+
+	// Partition errors are forwarded and count as attempts too.
+	l.Log(kgo.LogLevelWarn, kgoPartitionErrorMsg,
+		"broker", "1",
+		"topic", "topic",
+		"partition", int32(2),
+		"err", produceErr,
+		"will_fail", false,
+	)
+	assert.Equal(t, []string{kgoPartitionErrorMsg}, wrapped.logged)
+	entries = logs.TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(3), entries[0].ContextMap()["attempt"])
+
+	// A successfully written batch resets the attempts.
+	l.OnProduceBatchWritten(kgo.BrokerMetadata{}, "topic", 2, kgo.ProduceBatchMetrics{})
+	failBatch(false)
+	entries = logs.TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(1), entries[0].ContextMap()["attempt"])
+
+	// Batches which aren't retried aren't logged, and reset the attempts.
+	failBatch(true)
+	assert.Empty(t, logs.TakeAll())
+	failBatch(false)
+	entries = logs.TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(1), entries[0].ContextMap()["attempt"])
+}
+
+// TestKgoRetryLogMessages pins the messages, and their keys, which the
+// produceRetryLogger detects the retries from to the kgo version in use, since
+// they aren't part of the kgo API.
+func TestKgoRetryLogMessages(t *testing.T) {
+	const kgoModule = "github.com/twmb/franz-go"
+	info, ok := debug.ReadBuildInfo()
+	require.True(t, ok)
+	var dir string
+	for _, dep := range info.Deps {
+		if dep.Path != kgoModule {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		modCache := os.Getenv("GOMODCACHE")
+		if modCache == "" {
+			modCache = filepath.Join(build.Default.GOPATH, "pkg", "mod")
+		}
+		dir = filepath.Join(modCache, dep.Path+"@"+dep.Version, "pkg", "kgo")
+	}
+	require.NotEmpty(t, dir, "kgo module not found in the build info")
+	source, err := os.ReadFile(filepath.Join(dir, "sink.go"))
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skipf("kgo source not found in %s", dir)
+	}
+	require.NoError(t, err)
+
+	for msg, keys := range map[string][]string{
+		kgoBatchFailedMsg:    {"broker", "topic", "partition", "err", "max_retries_reached"},
+		kgoPartitionErrorMsg: {"broker", "topic", "partition", "err", "will_fail"},
+	} {
+		i := bytes.Index(source, []byte(`"`+msg+`"`))
+		require.NotEqual(t, -1, i, "kgo doesn't log %q anymore", msg)
+		// The keys are logged in the same call, before the closing paren.
+		call := source[i : i+bytes.Index(source[i:], []byte("\n\t\t)"))]
+		for _, key := range keys {
+			assert.Contains(t, string(call), `"`+key+`"`, "kgo doesn't log %q with %q anymore", msg, key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// Sampler reports whether an event should be kept.
+type Sampler func(model.APMEvent) bool
+
+// SamplingProcessor is a model.BatchProcessor which only passes the events
+// kept by its Sampler to its processor. Batches where all the events are
+// dropped aren't passed to the processor.
+//
+// The events are filtered into a copy of the batch, the caller's batch is not
+// modified.
+type SamplingProcessor struct {
+	processor model.BatchProcessor
+	sampler   Sampler
+}
+
+// NewSamplingProcessor returns a new SamplingProcessor which passes the events
+// kept by sampler to processor.
+func NewSamplingProcessor(processor model.BatchProcessor, sampler Sampler) (*SamplingProcessor, error) {
+	var errs []error
+	if processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	if sampler == nil {
+		errs = append(errs, errors.New("kafka: sampler must be set"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &SamplingProcessor{processor: processor, sampler: sampler}, nil
+}
+
+// ProcessBatch filters the batch with the Sampler and processes the events
+// which are kept, if any.
+func (s *SamplingProcessor) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	sampled := make(model.Batch, 0, len(*batch))
+	for _, event := range *batch {
+		if s.sampler(event) {
+			sampled = append(sampled, event)
+		}
+	}
+	if len(sampled) == 0 {
+		return nil
+	}
+	return s.processor.ProcessBatch(ctx, &sampled)
+}
@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestNewSamplingProcessor(t *testing.T) {
+	_, err := NewSamplingProcessor(nil, nil)
+	assert.EqualError(t, err, "kafka: processor must be set\n"+
+		"kafka: sampler must be set",
+	)
+}
+
+func TestSamplingProcessor(t *testing.T) {
+	newProcessor := func(t *testing.T, sampler Sampler) (*SamplingProcessor, *[]model.Batch) {
+		var processed []model.Batch
+		s, err := NewSamplingProcessor(model.ProcessBatchFunc(
+			func(_ context.Context, b *model.Batch) error {
+				processed = append(processed, *b)
+				return nil
+			},
+		), sampler)
+		require.NoError(t, err)
+		return s, &processed
+	}
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Span: &model.Span{ID: "2"}},
+		{Transaction: &model.Transaction{ID: "3"}},
+	}
+	original := append(model.Batch(nil), batch...)
+
+	t.Run("partial", func(t *testing.T) {
+		s, processed := newProcessor(t, func(event model.APMEvent) bool {
+			return event.Transaction != nil
+		})
+		require.NoError(t, s.ProcessBatch(context.Background(), &batch))
+		assert.Equal(t, []model.Batch{{batch[0], batch[2]}}, *processed)
+		assert.Equal(t, original, batch)
+	})
+	t.Run("all_dropped", func(t *testing.T) {
+		s, processed := newProcessor(t, func(model.APMEvent) bool { return false })
+		require.NoError(t, s.ProcessBatch(context.Background(), &batch))
+		assert.Empty(t, *processed)
+		assert.Equal(t, original, batch)
+	})
+}
@@ -0,0 +1,119 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// SplitByBytesConfig holds the configuration of a SplitByBytesProcessor.
+type SplitByBytesConfig struct {
+	// MaxBytes is the maximum number of encoded bytes of the events in a
+	// sub-batch. It must be greater than zero.
+	MaxBytes int
+	// Encoder is used to measure the encoded size of the events. It should
+	// be the Encoder of the wrapped Producer.
+	Encoder Encoder
+	// Logger is used to warn about events larger than MaxBytes.
+	Logger *zap.Logger
+}
+
+// SplitByBytesProcessor is a model.BatchProcessor which splits the batches in
+// sub-batches whose events' encoded size is at most MaxBytes, and processes
+// each of them separately, in order. It sizes the batches by bytes rather
+// than by number of events, which helps to bound the size of the produce
+// requests when the event sizes vary widely.
+//
+// The events are encoded to measure their size, and encoded again by the
+// wrapped Producer, so the encoding cost is doubled. Events which are larger
+// than MaxBytes on their own are processed in a sub-batch of their own, and
+// logged as a warning.
+type SplitByBytesProcessor struct {
+	processor model.BatchProcessor
+	cfg       SplitByBytesConfig
+}
+
+// NewSplitByBytesProcessor returns a new SplitByBytesProcessor which splits
+// the batches processed by processor according to cfg.
+func NewSplitByBytesProcessor(processor model.BatchProcessor, cfg SplitByBytesConfig) (*SplitByBytesProcessor, error) {
+	var errs []error
+	if processor == nil {
+		errs = append(errs, errors.New("kafka: processor must be set"))
+	}
+	if cfg.MaxBytes <= 0 {
+		errs = append(errs, errors.New("kafka: max bytes must be greater than zero"))
+	}
+	if cfg.Encoder == nil {
+		errs = append(errs, errors.New("kafka: encoder must be set"))
+	}
+	if cfg.Logger == nil {
+		errs = append(errs, errors.New("kafka: logger must be set"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &SplitByBytesProcessor{processor: processor, cfg: cfg}, nil
+}
+
+// ProcessBatch splits the batch into sub-batches within the byte budget, and
+// processes them in order. It returns as soon as a sub-batch fails to be
+// processed, without processing the rest, or if an event fails to be encoded,
+// without processing any.
+func (s *SplitByBytesProcessor) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	sizes := make([]int, len(*batch))
+	for i, event := range *batch {
+		encoded, err := s.cfg.Encoder.Encode(event)
+		if err != nil {
+			return fmt.Errorf("kafka: failed encoding event %d: %w", i, err)
+		}
+		sizes[i] = len(encoded)
+	}
+	var start, size int
+	for i, n := range sizes {
+		if n > s.cfg.MaxBytes {
+			s.cfg.Logger.Warn("event exceeds the max bytes, processing it alone",
+				zap.Int("size", n),
+				zap.Int("max_bytes", s.cfg.MaxBytes),
+			)
+		}
+		if i > start && size+n > s.cfg.MaxBytes {
+			if err := s.process(ctx, (*batch)[start:i]); err != nil {
+				return err
+			}
+			start, size = i, 0
+		}
+		size += n
+	}
+	if start < len(sizes) {
+		return s.process(ctx, (*batch)[start:])
+	}
+	return nil
+}
+
+func (s *SplitByBytesProcessor) process(ctx context.Context, events model.Batch) error {
+	// Use a full slice expression so the processor can't append to the
+	// caller's batch.
+	sub := events[:len(events):len(events)]
+	return s.processor.ProcessBatch(ctx, &sub)
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestNewSplitByBytesProcessor(t *testing.T) {
+	_, err := NewSplitByBytesProcessor(nil, SplitByBytesConfig{})
+	assert.EqualError(t, err, "kafka: processor must be set\n"+
+		"kafka: max bytes must be greater than zero\n"+
+		"kafka: encoder must be set\n"+
+		"kafka: logger must be set",
+	)
+}
+
+func TestSplitByBytesProcessor(t *testing.T) {
+	const maxBytes = 1000
+	// Omit the empty fields, so the events' size is dominated by their
+	// message.
+	encoder := json.New(json.Options{OmitEmpty: true})
+	encodedSize := func(t *testing.T, event model.APMEvent) int {
+		encoded, err := encoder.Encode(event)
+		require.NoError(t, err)
+		return len(encoded)
+	}
+	var batches []model.Batch
+	core, logs := observer.New(zap.WarnLevel)
+	s, err := NewSplitByBytesProcessor(model.ProcessBatchFunc(
+		func(_ context.Context, b *model.Batch) error {
+			batches = append(batches, *b)
+			return nil
+		},
+	), SplitByBytesConfig{MaxBytes: maxBytes, Encoder: encoder, Logger: zap.New(core)})
+	require.NoError(t, err)
+
+	var batch model.Batch
+	for _, n := range []int{10, 300, 50, 400, 200, 2000, 100, 600, 5, 450} {
+		batch = append(batch, model.APMEvent{Message: strings.Repeat("x", n)})
+	}
+	require.NoError(t, s.ProcessBatch(context.Background(), &batch))
+
+	var processed model.Batch
+	for _, b := range batches {
+		processed = append(processed, b...)
+		var size int
+		for _, event := range b {
+			size += encodedSize(t, event)
+		}
+		if len(b) > 1 {
+			assert.LessOrEqual(t, size, maxBytes)
+		} else {
+			assert.Greater(t, size, 0)
+		}
+	}
+	// The events are all processed, in order.
+	assert.Equal(t, batch, processed)
+	// The oversized event is processed alone.
+	var oversized int
+	for _, b := range batches {
+		if len(b) == 1 && encodedSize(t, b[0]) > maxBytes {
+			oversized++
+		}
+	}
+	assert.Equal(t, 1, oversized)
+	assert.Equal(t, 1, logs.FilterMessage("event exceeds the max bytes, processing it alone").Len())
+	assert.Greater(t, len(batches), 3)
+}
+
+func TestSplitByBytesProcessorError(t *testing.T) {
+	errProcess := errors.New("process failed")
+	var calls int
+	s, err := NewSplitByBytesProcessor(model.ProcessBatchFunc(
+		func(context.Context, *model.Batch) error {
+			calls++
+			return errProcess
+		},
+	), SplitByBytesConfig{MaxBytes: 1, Encoder: json.JSON{}, Logger: zap.NewNop()})
+	require.NoError(t, err)
+
+	// The rest of the sub-batches aren't processed after a failure.
+	batch := model.Batch{{}, {}, {}}
+	assert.ErrorIs(t, s.ProcessBatch(context.Background(), &batch), errProcess)
+	assert.Equal(t, 1, calls)
+
+	s.cfg.Encoder = failingEncoder{}
+	assert.ErrorIs(t, s.ProcessBatch(context.Background(), &batch), errEncode)
+	assert.Equal(t, 1, calls)
+}
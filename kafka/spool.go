@@ -0,0 +1,213 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Spooler stores records which failed to be produced, so they can be produced
+// again at a later time with Producer.Replay.
+type Spooler interface {
+	// Append stores the record.
+	Append(*kgo.Record) error
+	// Drain calls fn for each of the stored records, removing them from the
+	// spool. If fn returns an error, Drain stops and keeps the record which
+	// failed and all the records which haven't been drained yet.
+	Drain(fn func(*kgo.Record) error) error
+}
+
+// FileSpooler is a Spooler which stores records in a local file, one JSON
+// encoded record per line. Only the topic, key, value, headers and timestamp
+// of the records are stored. The records are replayed with their original
+// timestamp, so the records spooled for longer than the topic's
+// message.timestamp.difference.max.ms are rejected by the brokers.
+//
+// The spool file is only rewritten once Drain is done calling fn, so the
+// records aren't lost if the process stops while draining the spool: the
+// records which were drained before it stopped are drained again. Records
+// which are kept after a failed Drain stay ahead of any records spooled
+// while Drain was running.
+type FileSpooler struct {
+	mu   sync.Mutex
+	path string
+	// drainMu ensures a single Drain runs at a time.
+	drainMu sync.Mutex
+}
+
+type spooledRecord struct {
+	Topic     string             `json:"topic"`
+	Key       []byte             `json:"key,omitempty"`
+	Value     []byte             `json:"value,omitempty"`
+	Headers   []kgo.RecordHeader `json:"headers,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+// NewFileSpooler returns a FileSpooler which stores records in the file at
+// path, creating it if it doesn't exist.
+func NewFileSpooler(path string) (*FileSpooler, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("kafka: failed opening spool file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("kafka: failed opening spool file: %w", err)
+	}
+	return &FileSpooler{path: path}, nil
+}
+
+// Append appends the record to the spool file.
+func (s *FileSpooler) Append(r *kgo.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(spooledRecord{
+		Topic:     r.Topic,
+		Key:       r.Key,
+		Value:     r.Value,
+		Headers:   r.Headers,
+		Timestamp: r.Timestamp,
+	})
+}
+
+// Drain reads all the spooled records and calls fn for each of them. The
+// spool file lock isn't held while fn is called, so records can be appended
+// concurrently. Once done, the drained records are removed from the spool
+// file, which is replaced atomically.
+func (s *FileSpooler) Drain(fn func(*kgo.Record) error) error {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	records, size, err := s.read()
+	if err != nil {
+		return err
+	}
+	for i, r := range records {
+		if err := fn(&kgo.Record{
+			Topic:     r.Topic,
+			Key:       r.Key,
+			Value:     r.Value,
+			Headers:   r.Headers,
+			Timestamp: r.Timestamp,
+		}); err != nil {
+			if err := s.replace(records[i:], size); err != nil {
+				return fmt.Errorf("kafka: failed re-spooling records: %w", err)
+			}
+			return err
+		}
+	}
+	return s.replace(nil, size)
+}
+
+// read returns the spooled records, and the size of the spool file they were
+// read from.
+func (s *FileSpooler) read() ([]spooledRecord, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("kafka: failed reading spool file: %w", err)
+	}
+	var records []spooledRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var r spooledRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, 0, fmt.Errorf("kafka: failed decoding spooled record: %w", err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("kafka: failed reading spool file: %w", err)
+	}
+	return records, int64(len(data)), nil
+}
+
+// replace replaces the first size bytes of the spool file, which held the
+// drained records, with the records which were kept, keeping the records
+// appended since. The file is replaced atomically, by renaming a temporary
+// file over it.
+func (s *FileSpooler) replace(kept []spooledRecord, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("kafka: failed reading spool file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("kafka: failed creating spool file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // Fails once renamed.
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range kept {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return fmt.Errorf("kafka: failed encoding spooled record: %w", err)
+		}
+	}
+	if _, err := w.Write(data[size:]); err != nil {
+		tmp.Close()
+		return fmt.Errorf("kafka: failed writing spool file: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("kafka: failed writing spool file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("kafka: failed writing spool file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("kafka: failed writing spool file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("kafka: failed replacing spool file: %w", err)
+	}
+	return nil
+}
+
+// append must be called with the lock held.
+func (s *FileSpooler) append(records ...spooledRecord) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("kafka: failed opening spool file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return fmt.Errorf("kafka: failed encoding spooled record: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("kafka: failed writing spool file: %w", err)
+	}
+	return f.Close()
+}
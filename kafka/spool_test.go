@@ -0,0 +1,201 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestFileSpooler(t *testing.T) {
+	spooler, err := NewFileSpooler(filepath.Join(t.TempDir(), "spool"))
+	require.NoError(t, err)
+
+	timestamp := time.Date(2023, 4, 1, 12, 0, 0, 123e6, time.UTC)
+	for _, v := range []string{"1", "2", "3"} {
+		require.NoError(t, spooler.Append(&kgo.Record{
+			Topic:     "topic",
+			Key:       []byte("key-" + v),
+			Value:     []byte(v),
+			Headers:   []kgo.RecordHeader{{Key: "a", Value: []byte("b")}},
+			Timestamp: timestamp,
+		}))
+	}
+
+	// Fail on the second record, keeping it and the third one.
+	var drained []string
+	errDrain := errors.New("drain failed")
+	err = spooler.Drain(func(r *kgo.Record) error {
+		if string(r.Value) == "2" {
+			return errDrain
+		}
+		assert.Equal(t, "topic", r.Topic)
+		assert.Equal(t, []byte("key-"+string(r.Value)), r.Key)
+		assert.Equal(t, []kgo.RecordHeader{{Key: "a", Value: []byte("b")}}, r.Headers)
+		assert.True(t, timestamp.Equal(r.Timestamp), r.Timestamp)
+		drained = append(drained, string(r.Value))
+		return nil
+	})
+	assert.ErrorIs(t, err, errDrain)
+	assert.Equal(t, []string{"1"}, drained)
+
+	require.NoError(t, spooler.Drain(func(r *kgo.Record) error {
+		drained = append(drained, string(r.Value))
+		return nil
+	}))
+	assert.Equal(t, []string{"1", "2", "3"}, drained)
+
+	// The spool is empty.
+	require.NoError(t, spooler.Drain(func(r *kgo.Record) error {
+		t.Fatalf("unexpected record: %v", r)
+		return nil
+	}))
+}
+
+func TestFileSpoolerDrainKeepsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	spooler, err := NewFileSpooler(path)
+	require.NoError(t, err)
+	for _, v := range []string{"1", "2", "3"} {
+		require.NoError(t, spooler.Append(&kgo.Record{Topic: "topic", Value: []byte(v)}))
+	}
+
+	values := func(s *FileSpooler) []string {
+		records, _, err := s.read()
+		require.NoError(t, err)
+		var values []string
+		for _, r := range records {
+			values = append(values, string(r.Value))
+		}
+		return values
+	}
+	errDrain := errors.New("drain failed")
+	err = spooler.Drain(func(r *kgo.Record) error {
+		if string(r.Value) == "1" {
+			// The records are kept in the spool file while they're being
+			// drained, so they survive the process stopping mid-drain.
+			restarted, err := NewFileSpooler(path)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"1", "2", "3"}, values(restarted))
+			// Records can be spooled while draining.
+			require.NoError(t, spooler.Append(&kgo.Record{Topic: "topic", Value: []byte("4")}))
+			return nil
+		}
+		return errDrain
+	})
+	assert.ErrorIs(t, err, errDrain)
+	// The kept records stay ahead of the ones spooled while draining.
+	assert.Equal(t, []string{"2", "3", "4"}, values(spooler))
+}
+
+func TestProducerSpoolSkipsFatalRecords(t *testing.T) {
+	spooler, err := NewFileSpooler(filepath.Join(t.TempDir(), "spool"))
+	require.NoError(t, err)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		Spooler: spooler,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	for value, err := range map[string]error{
+		"too-large":    kerr.MessageTooLarge,
+		"unauthorized": kerr.TopicAuthorizationFailed,
+		"retryable":    kerr.NotEnoughReplicas,
+		"cancelled":    context.Canceled,
+		"closed":       kgo.ErrClientClosed,
+	} {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		producer.produceCallback(&wg)(&kgo.Record{Topic: "topic", Value: []byte(value)}, err)
+		wg.Wait()
+	}
+
+	var spooled []string
+	require.NoError(t, spooler.Drain(func(r *kgo.Record) error {
+		spooled = append(spooled, string(r.Value))
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"retryable", "cancelled", "closed"}, spooled)
+}
+
+func TestProducerSpoolAndReplay(t *testing.T) {
+	topic := "default-topic"
+	client, brokers := newClusterWithTopics(t, topic)
+	spooler, err := NewFileSpooler(filepath.Join(t.TempDir(), "spool"))
+	require.NoError(t, err)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+		Spooler: spooler,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	// Producing with a cancelled context fails all the records.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{ID: "2"}},
+	}
+	require.NoError(t, producer.ProcessBatch(cancelled, &batch))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, producer.Replay(ctx))
+
+	client.AddConsumeTopics(topic)
+	var records []*kgo.Record
+	for len(records) < len(batch) {
+		fetches := client.PollRecords(ctx, len(batch))
+		require.NoError(t, fetches.Err())
+		records = append(records, fetches.Records()...)
+	}
+	var ids []string
+	for _, record := range records {
+		var event model.APMEvent
+		require.NoError(t, json.JSON{}.Decode(record.Value, &event))
+		ids = append(ids, event.Transaction.ID)
+	}
+	assert.ElementsMatch(t, []string{"1", "2"}, ids)
+}
@@ -0,0 +1,73 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"sync/atomic"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// ProducerStats holds the cumulative produce counters of a Producer since it
+// was created, see Producer.Stats.
+type ProducerStats struct {
+	// Batches is the number of batches whose records have been passed to
+	// the Kafka client by ProcessBatch.
+	Batches int64
+	// Records is the number of records successfully produced.
+	Records int64
+	// Failed is the number of records which failed to be produced.
+	Failed int64
+	// Bytes is the total size in bytes of the keys and values of the
+	// records successfully produced.
+	Bytes int64
+}
+
+// producerStats holds the counters returned by Producer.Stats. They're
+// updated atomically, so they can be read while records are produced.
+type producerStats struct {
+	batches atomic.Int64
+	records atomic.Int64
+	failed  atomic.Int64
+	bytes   atomic.Int64
+}
+
+// recordProduced updates the counters with the outcome of a produced record.
+func (s *producerStats) recordProduced(r *kgo.Record, err error) {
+	if err != nil {
+		s.failed.Add(1)
+		return
+	}
+	s.records.Add(1)
+	s.bytes.Add(int64(len(r.Key) + len(r.Value)))
+}
+
+// Stats returns a snapshot of the producer's cumulative produce counters,
+// which is cheap enough to be called frequently, for example, to expose them
+// in a debug endpoint. The records produced with ProduceRecords and the
+// tombstones are counted too. Each counter is read atomically, but the
+// snapshot as a whole isn't, so records produced while it's taken may be
+// counted in some counters only.
+func (p *Producer) Stats() ProducerStats {
+	return ProducerStats{
+		Batches: p.stats.batches.Load(),
+		Records: p.stats.records.Load(),
+		Failed:  p.stats.failed.Load(),
+		Bytes:   p.stats.bytes.Load(),
+	}
+}
@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerStats(t *testing.T) {
+	topic := "default-topic"
+	_, brokers := newClusterWithTopics(t, topic)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return apmqueue.Topic(topic)
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+	assert.Equal(t, ProducerStats{}, producer.Stats())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	batch := model.Batch{
+		{Transaction: &model.Transaction{ID: "1"}},
+		{Transaction: &model.Transaction{ID: "2"}},
+	}
+	records, err := producer.BuildRecords(ctx, &batch)
+	require.NoError(t, err)
+	var size int64
+	for _, r := range records {
+		size += int64(len(r.Key) + len(r.Value))
+	}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	assert.Equal(t, ProducerStats{
+		Batches: 2,
+		Records: 4,
+		Bytes:   2 * size,
+	}, producer.Stats())
+}
+
+func TestProducerStatsFailed(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	batch := model.Batch{{}, {}, {}}
+	assert.ErrorIs(t, producer.ProcessBatch(ctx, &batch), context.DeadlineExceeded)
+
+	// Closing the producer fails the records which haven't been produced.
+	producer.Close()
+	assert.Equal(t, ProducerStats{Batches: 1, Failed: 3}, producer.Stats())
+}
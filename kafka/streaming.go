@@ -0,0 +1,167 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// StreamingConfig holds the configuration of a StreamingProducer.
+type StreamingConfig struct {
+	// BufferSize is the number of submitted events which are buffered while
+	// waiting to be batched. Submit blocks when the buffer is full. If <= 0,
+	// it defaults to 1000.
+	BufferSize int
+	// MaxBatchSize is the maximum number of events processed in a batch.
+	// A batch is processed as soon as it's full. If <= 0, it defaults to 100.
+	MaxBatchSize int
+	// Linger is the maximum time the first event of a batch waits for the
+	// batch to be full before the batch is processed. If <= 0, it defaults
+	// to 100ms.
+	Linger time.Duration
+	// ErrorHandler, if set, is called with the batches which fail to be
+	// processed, and the error. If nil, the errors are discarded.
+	ErrorHandler func(model.Batch, error)
+}
+
+// StreamingProducer is a model.BatchProcessor wrapper which accepts single
+// events with Submit, and processes them in batches in the background, when
+// MaxBatchSize events are buffered or after Linger. This decouples the
+// callers from the latency of the processor, for example, a Producer in Sync
+// mode, while Submit blocking on a full buffer applies backpressure.
+//
+// The batches are processed with a background context, since they mix events
+// submitted with different contexts, so the context metadata isn't added to
+// the produced records.
+type StreamingProducer struct {
+	processor model.BatchProcessor
+	cfg       StreamingConfig
+	events    chan model.APMEvent
+	done      chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewStreamingProducer returns a new StreamingProducer which processes the
+// submitted events with processor, and starts processing them.
+func NewStreamingProducer(processor model.BatchProcessor, cfg StreamingConfig) (*StreamingProducer, error) {
+	if processor == nil {
+		return nil, errors.New("kafka: processor must be set")
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1000
+	}
+	if cfg.MaxBatchSize <= 0 {
+		cfg.MaxBatchSize = 100
+	}
+	if cfg.Linger <= 0 {
+		cfg.Linger = 100 * time.Millisecond
+	}
+	s := &StreamingProducer{
+		processor: processor,
+		cfg:       cfg,
+		events:    make(chan model.APMEvent, cfg.BufferSize),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Submit buffers the event to be processed in the background. It blocks while
+// the buffer is full, until ctx is done, in which case it returns the context
+// error. It returns ErrProducerClosed once the StreamingProducer is closed.
+func (s *StreamingProducer) Submit(ctx context.Context, event model.APMEvent) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrProducerClosed
+	}
+	select {
+	case s.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting events, and waits for the buffered events to be
+// processed. It doesn't close the wrapped processor. Calling Close more than
+// once has no effect.
+func (s *StreamingProducer) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+// run batches the submitted events, and processes the batches until the
+// events channel is closed and drained.
+func (s *StreamingProducer) run() {
+	defer close(s.done)
+	var (
+		batch  model.Batch
+		timer  *time.Timer
+		linger <-chan time.Time
+	)
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, linger = nil, nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.processor.ProcessBatch(context.Background(), &batch); err != nil {
+			if s.cfg.ErrorHandler != nil {
+				s.cfg.ErrorHandler(batch, err)
+			}
+		}
+		// The processor may hold on to the batch, use a new one.
+		batch = nil
+	}
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				flush()
+				return
+			}
+			if batch == nil {
+				batch = make(model.Batch, 0, s.cfg.MaxBatchSize)
+				timer = time.NewTimer(s.cfg.Linger)
+				linger = timer.C
+			}
+			batch = append(batch, event)
+			if len(batch) >= s.cfg.MaxBatchSize {
+				flush()
+			}
+		case <-linger:
+			flush()
+		}
+	}
+}
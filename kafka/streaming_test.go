@@ -0,0 +1,147 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestNewStreamingProducer(t *testing.T) {
+	_, err := NewStreamingProducer(nil, StreamingConfig{})
+	assert.EqualError(t, err, "kafka: processor must be set")
+}
+
+func TestStreamingProducer(t *testing.T) {
+	newProducer := func(t *testing.T, cfg StreamingConfig) (*StreamingProducer, <-chan model.Batch) {
+		batches := make(chan model.Batch, 10)
+		s, err := NewStreamingProducer(model.ProcessBatchFunc(
+			func(_ context.Context, b *model.Batch) error {
+				batches <- *b
+				return nil
+			},
+		), cfg)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s, batches
+	}
+	submit := func(t *testing.T, s *StreamingProducer, ids ...string) {
+		for _, id := range ids {
+			require.NoError(t, s.Submit(context.Background(), model.APMEvent{
+				Transaction: &model.Transaction{ID: id},
+			}))
+		}
+	}
+	ids := func(b model.Batch) []string {
+		var ids []string
+		for _, event := range b {
+			ids = append(ids, event.Transaction.ID)
+		}
+		return ids
+	}
+	receive := func(t *testing.T, batches <-chan model.Batch) model.Batch {
+		select {
+		case b := <-batches:
+			return b
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a batch")
+		}
+		return nil
+	}
+
+	t.Run("size", func(t *testing.T) {
+		s, batches := newProducer(t, StreamingConfig{MaxBatchSize: 2, Linger: time.Hour})
+		submit(t, s, "1", "2", "3", "4", "5")
+		assert.Equal(t, []string{"1", "2"}, ids(receive(t, batches)))
+		assert.Equal(t, []string{"3", "4"}, ids(receive(t, batches)))
+		// The last event waits for the batch to be full.
+		select {
+		case b := <-batches:
+			t.Fatalf("unexpected batch: %v", ids(b))
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+	t.Run("linger", func(t *testing.T) {
+		s, batches := newProducer(t, StreamingConfig{MaxBatchSize: 100, Linger: 20 * time.Millisecond})
+		start := time.Now()
+		submit(t, s, "1", "2")
+		assert.Equal(t, []string{"1", "2"}, ids(receive(t, batches)))
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+		submit(t, s, "3")
+		assert.Equal(t, []string{"3"}, ids(receive(t, batches)))
+	})
+	t.Run("drain_on_close", func(t *testing.T) {
+		s, batches := newProducer(t, StreamingConfig{MaxBatchSize: 2, Linger: time.Hour})
+		submit(t, s, "1", "2", "3")
+		require.NoError(t, s.Close())
+		assert.Equal(t, []string{"1", "2"}, ids(receive(t, batches)))
+		assert.Equal(t, []string{"3"}, ids(receive(t, batches)))
+
+		err := s.Submit(context.Background(), model.APMEvent{})
+		assert.ErrorIs(t, err, ErrProducerClosed)
+		assert.NoError(t, s.Close())
+	})
+}
+
+func TestStreamingProducerBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	s, err := NewStreamingProducer(model.ProcessBatchFunc(
+		func(context.Context, *model.Batch) error {
+			<-release
+			return nil
+		},
+	), StreamingConfig{BufferSize: 1, MaxBatchSize: 1})
+	require.NoError(t, err)
+	defer s.Close()
+	defer close(release)
+
+	// The first event is being processed, the second one fills the buffer.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var submitErr error
+	for i := 0; i < 3 && submitErr == nil; i++ {
+		submitErr = s.Submit(ctx, model.APMEvent{})
+	}
+	assert.ErrorIs(t, submitErr, context.DeadlineExceeded)
+}
+
+func TestStreamingProducerErrorHandler(t *testing.T) {
+	errProcess := errors.New("process failed")
+	var failed []string
+	s, err := NewStreamingProducer(model.ProcessBatchFunc(
+		func(context.Context, *model.Batch) error { return errProcess },
+	), StreamingConfig{
+		MaxBatchSize: 1,
+		ErrorHandler: func(b model.Batch, err error) {
+			failed = append(failed, fmt.Sprintf("%d: %v", len(b), err))
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Submit(context.Background(), model.APMEvent{}))
+	require.NoError(t, s.Close())
+	assert.Equal(t, []string{"1: process failed"}, failed)
+}
@@ -0,0 +1,54 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.uber.org/zap"
+)
+
+// throttleHook is a kgo.HookBrokerThrottle which records the time the brokers
+// throttle the client for, for example, when a produce quota is exceeded. The
+// client already waits for the throttle to elapse before sending more requests
+// to the broker, so the hook is informational only.
+type throttleHook struct {
+	// throttleTime records the throttle intervals, by broker.
+	throttleTime instrument.Int64Histogram
+	// logger, if not nil, is used to log each throttle.
+	logger *zap.Logger
+}
+
+// OnBrokerThrottle records the throttle interval imposed by the broker.
+func (h throttleHook) OnBrokerThrottle(meta kgo.BrokerMetadata, interval time.Duration, throttledAfterResponse bool) {
+	h.throttleTime.Record(context.Background(), interval.Milliseconds(),
+		attribute.Int64("broker", int64(meta.NodeID)),
+	)
+	if h.logger != nil {
+		h.logger.Info("throttled by broker",
+			zap.Int32("broker", meta.NodeID),
+			zap.String("host", meta.Host),
+			zap.Duration("interval", interval),
+			zap.Bool("after_response", throttledAfterResponse),
+		)
+	}
+}
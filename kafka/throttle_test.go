@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerThrottle(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	reader := sdkmetric.NewManualReader()
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.New(core),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+		LogThrottling: true,
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	// The fake cluster can't be configured to throttle, so the throttles are
+	// reported by calling the hooks registered in the client, as kgo does.
+	var throttled int
+	hooks := reflect.ValueOf(producer.client.OptValue(kgo.WithHooks))
+	for i := 0; i < hooks.Len(); i++ {
+		hook, ok := hooks.Index(i).Interface().(kgo.HookBrokerThrottle)
+		if !ok {
+			continue
+		}
+		meta := kgo.BrokerMetadata{NodeID: 1, Host: "broker-1", Port: 9092}
+		hook.OnBrokerThrottle(meta, 100*time.Millisecond, true)
+		hook.OnBrokerThrottle(meta, 250*time.Millisecond, true)
+		throttled++
+	}
+	require.Equal(t, 1, throttled)
+
+	metrics := collectMetrics(t, reader)
+	require.Contains(t, metrics, "producer.broker.throttle")
+	histogram, ok := metrics["producer.broker.throttle"].(metricdata.Histogram)
+	require.True(t, ok)
+	require.Len(t, histogram.DataPoints, 1)
+	dp := histogram.DataPoints[0]
+	assert.Equal(t, attribute.NewSet(attribute.Int64("broker", 1)), dp.Attributes)
+	assert.Equal(t, uint64(2), dp.Count)
+	assert.Equal(t, float64(350), dp.Sum)
+
+	entries := logs.FilterMessage("throttled by broker").AllUntimed()
+	require.Len(t, entries, 2)
+	assert.Equal(t, map[string]any{
+		"broker":         int32(1),
+		"host":           "broker-1",
+		"interval":       100 * time.Millisecond,
+		"after_response": true,
+	}, entries[0].ContextMap())
+}
+
+func TestProducerThrottleNotRegistered(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	hooks := reflect.ValueOf(producer.client.OptValue(kgo.WithHooks))
+	for i := 0; i < hooks.Len(); i++ {
+		_, ok := hooks.Index(i).Interface().(kgo.HookBrokerThrottle)
+		assert.False(t, ok)
+	}
+}
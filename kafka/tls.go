@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// defaultMinTLSVersion is the default of ProducerConfig.MinTLSVersion.
+const defaultMinTLSVersion = tls.VersionTLS12
+
+// secureTLSConfig returns a clone of cfg which requires at least minVersion,
+// defaulting to TLS 1.2, and without the insecure cipher suites if
+// rejectInsecure is set. The MinVersion of cfg is kept when it's higher.
+func secureTLSConfig(cfg *tls.Config, minVersion uint16, rejectInsecure bool) (*tls.Config, error) {
+	if minVersion == 0 {
+		minVersion = defaultMinTLSVersion
+	}
+	cfg = cfg.Clone()
+	if cfg.MinVersion < minVersion {
+		cfg.MinVersion = minVersion
+	}
+	if rejectInsecure && len(cfg.CipherSuites) > 0 {
+		insecure := make(map[uint16]struct{})
+		for _, suite := range tls.InsecureCipherSuites() {
+			insecure[suite.ID] = struct{}{}
+		}
+		suites := make([]uint16, 0, len(cfg.CipherSuites))
+		for _, id := range cfg.CipherSuites {
+			if _, ok := insecure[id]; !ok {
+				suites = append(suites, id)
+			}
+		}
+		if len(suites) == 0 {
+			return nil, errors.New("kafka: TLS config only holds insecure cipher suites")
+		}
+		cfg.CipherSuites = suites
+	}
+	return cfg, nil
+}
+
+// validTLSVersion returns an error if version isn't a known TLS version.
+func validTLSVersion(version uint16) error {
+	switch version {
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+		return nil
+	}
+	return fmt.Errorf("kafka: unknown min TLS version %#x", version)
+}
@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerMinTLSVersion(t *testing.T) {
+	newProducer := func(cfg *tls.Config, minVersion uint16) *tls.Config {
+		producer, err := NewProducer(ProducerConfig{
+			Brokers: []string{"127.0.0.1:1"},
+			Logger:  zap.NewNop(),
+			Encoder: json.JSON{},
+			TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+				return "topic"
+			},
+			TLS:           cfg,
+			MinTLSVersion: minVersion,
+		})
+		require.NoError(t, err)
+		defer producer.Close()
+		tlsCfg, ok := producer.client.OptValue(kgo.DialTLSConfig).(*tls.Config)
+		require.True(t, ok)
+		return tlsCfg
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS10}
+	assert.Equal(t, uint16(tls.VersionTLS12), newProducer(cfg, 0).MinVersion)
+	assert.Equal(t, uint16(tls.VersionTLS13), newProducer(cfg, tls.VersionTLS13).MinVersion)
+	// The caller's config is cloned, not modified.
+	assert.Equal(t, uint16(tls.VersionTLS10), cfg.MinVersion)
+	// A higher MinVersion is kept.
+	cfg = &tls.Config{MinVersion: tls.VersionTLS13}
+	assert.Equal(t, uint16(tls.VersionTLS13), newProducer(cfg, 0).MinVersion)
+
+	err := ProducerConfig{MinTLSVersion: 0x0200}.Validate()
+	assert.ErrorContains(t, err, "kafka: unknown min TLS version 0x200")
+}
+
+func TestSecureTLSConfigCipherSuites(t *testing.T) {
+	insecure := tls.InsecureCipherSuites()[0].ID
+	secure := tls.CipherSuites()[0].ID
+	cfg := &tls.Config{CipherSuites: []uint16{insecure, secure}}
+
+	secured, err := secureTLSConfig(cfg, 0, false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{insecure, secure}, secured.CipherSuites)
+
+	secured, err = secureTLSConfig(cfg, 0, true)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{secure}, secured.CipherSuites)
+	assert.Equal(t, []uint16{insecure, secure}, cfg.CipherSuites)
+
+	_, err = secureTLSConfig(&tls.Config{CipherSuites: []uint16{insecure}}, 0, true)
+	assert.EqualError(t, err, "kafka: TLS config only holds insecure cipher suites")
+
+	// Without cipher suites, Go's secure defaults are used.
+	secured, err = secureTLSConfig(&tls.Config{}, 0, true)
+	require.NoError(t, err)
+	assert.Empty(t, secured.CipherSuites)
+}
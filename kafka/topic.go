@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// maxTopicLength is the maximum length of a Kafka topic name.
+const maxTopicLength = 249
+
+// ErrInvalidTopic is returned by ValidateTopic for topics whose name isn't a
+// valid Kafka topic name.
+var ErrInvalidTopic = errors.New("kafka: invalid topic")
+
+// ValidateTopic returns an error wrapping ErrInvalidTopic if the topic name
+// doesn't follow the Kafka naming rules: it must be between 1 and 249
+// characters long, only contain ASCII alphanumerics, '.', '_' and '-', and
+// not be "." or "..". Use SanitizeTopic to turn any name into a valid one.
+func ValidateTopic(topic apmqueue.Topic) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("%w: name cannot be empty", ErrInvalidTopic)
+	case topic == "." || topic == "..":
+		return fmt.Errorf("%w: name cannot be %q", ErrInvalidTopic, topic)
+	case len(topic) > maxTopicLength:
+		return fmt.Errorf("%w: %q is longer than %d characters",
+			ErrInvalidTopic, topic, maxTopicLength,
+		)
+	}
+	if i := strings.IndexFunc(string(topic), func(r rune) bool {
+		return !validTopicRune(r)
+	}); i >= 0 {
+		return fmt.Errorf("%w: %q contains the invalid character %q",
+			ErrInvalidTopic, topic, []rune(string(topic[i:]))[0],
+		)
+	}
+	return nil
+}
+
+// SanitizeTopic returns a valid topic name for topic, see ValidateTopic, by
+// replacing its invalid characters with '_', and truncating it to 249
+// characters. The "." and ".." names are replaced with "_" and "__". An empty
+// name is returned as is, since it has no valid replacement. Distinct names
+// may be sanitized to the same one, for example, "a:b" and "a/b".
+func SanitizeTopic(topic apmqueue.Topic) apmqueue.Topic {
+	switch topic {
+	case ".":
+		return "_"
+	case "..":
+		return "__"
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		if validTopicRune(r) {
+			return r
+		}
+		return '_'
+	}, string(topic))
+	if len(sanitized) > maxTopicLength {
+		sanitized = sanitized[:maxTopicLength]
+	}
+	return apmqueue.Topic(sanitized)
+}
+
+// validTopicRune returns true if r is allowed in Kafka topic names.
+func validTopicRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return r == '.' || r == '_' || r == '-'
+}
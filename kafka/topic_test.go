@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestValidateTopic(t *testing.T) {
+	for _, topic := range []apmqueue.Topic{
+		"a", "logs", "apm.traces-v1_2", "...", apmqueue.Topic(strings.Repeat("a", 249)),
+	} {
+		assert.NoError(t, ValidateTopic(topic), topic)
+	}
+	for topic, expected := range map[apmqueue.Topic]string{
+		"":                                       "kafka: invalid topic: name cannot be empty",
+		".":                                      `kafka: invalid topic: name cannot be "."`,
+		"..":                                     `kafka: invalid topic: name cannot be ".."`,
+		"logs/app":                               `kafka: invalid topic: "logs/app" contains the invalid character '/'`,
+		"logs app":                               `kafka: invalid topic: "logs app" contains the invalid character ' '`,
+		"métricas":                               `kafka: invalid topic: "métricas" contains the invalid character 'é'`,
+		apmqueue.Topic(strings.Repeat("a", 250)): `kafka: invalid topic: "` + strings.Repeat("a", 250) + `" is longer than 249 characters`,
+	} {
+		err := ValidateTopic(topic)
+		assert.ErrorIs(t, err, ErrInvalidTopic)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func TestSanitizeTopic(t *testing.T) {
+	for topic, expected := range map[apmqueue.Topic]apmqueue.Topic{
+		"logs":                                   "logs",
+		"logs/app:1":                             "logs_app_1",
+		"métricas":                               "m_tricas",
+		".":                                      "_",
+		"..":                                     "__",
+		"":                                       "",
+		apmqueue.Topic(strings.Repeat("a", 300)): apmqueue.Topic(strings.Repeat("a", 249)),
+	} {
+		sanitized := SanitizeTopic(topic)
+		assert.Equal(t, expected, sanitized)
+		if topic != "" {
+			assert.NoError(t, ValidateTopic(sanitized))
+		}
+	}
+}
+
+func TestProducerValidateTopicsInvalid(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		// The invalid names are reported without querying the cluster.
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	err = producer.ValidateTopics(context.Background(), "logs", "logs/app", "")
+	assert.ErrorIs(t, err, ErrInvalidTopic)
+	assert.EqualError(t, err, "kafka: invalid topic: \"logs/app\" contains the invalid character '/'\n"+
+		"kafka: invalid topic: name cannot be empty",
+	)
+}
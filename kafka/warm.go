@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+
+	apmqueue "github.com/elastic/apm-queue"
+)
+
+// Warm opens the connections used to produce to the leaders of the partitions
+// of the topics, which are otherwise opened lazily by the first records
+// produced to them, so the first ProcessBatch call after startup isn't slowed
+// down by connecting to the brokers, including any TLS and SASL handshakes.
+//
+// Warming is best-effort: the connections may still be closed afterwards, for
+// example, once idle for ConnIdleTimeout, and partition leaders may change. It
+// returns an error if the topics' metadata can't be fetched, or connecting to
+// any of the leaders fails.
+func (p *Producer) Warm(ctx context.Context, topics ...apmqueue.Topic) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.ready(); err != nil {
+		return err
+	}
+	defer p.recordActivity()
+
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = string(topic)
+	}
+	// The admin client must not be closed, since it closes the underlying
+	// client.
+	details, err := kadm.NewClient(p.client).ListTopics(ctx, names...)
+	if err != nil {
+		return fmt.Errorf("kafka: failed listing topics: %w", err)
+	}
+	// Each client opens its own connections, so the leaders are warmed per
+	// client.
+	leaders := make(map[*kgo.Client]map[int32]struct{})
+	var errs []error
+	for _, topic := range names {
+		detail := details[topic]
+		if detail.Err != nil {
+			errs = append(errs, fmt.Errorf("kafka: failed listing topic %s: %w", topic, detail.Err))
+			continue
+		}
+		client := p.clientFor(topic)
+		if leaders[client] == nil {
+			leaders[client] = make(map[int32]struct{})
+		}
+		for _, partition := range detail.Partitions {
+			if partition.Leader >= 0 {
+				leaders[client][partition.Leader] = struct{}{}
+			}
+		}
+	}
+	for client, ids := range leaders {
+		for id := range ids {
+			if err := warmBroker(ctx, client.Broker(int(id))); err != nil {
+				errs = append(errs, fmt.Errorf("kafka: failed warming broker %d: %w", id, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// warmBroker opens the produce connection to the broker by sending it an
+// empty produce request, since kgo uses a dedicated connection for produce
+// requests. An empty produce request doesn't write any records.
+func warmBroker(ctx context.Context, broker *kgo.Broker) error {
+	req := kmsg.NewPtrProduceRequest()
+	req.Acks = -1
+	req.TimeoutMillis = 1000
+	_, err := broker.Request(ctx, req)
+	return err
+}
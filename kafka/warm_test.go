@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/elastic/apm-data/model"
+	apmqueue "github.com/elastic/apm-queue"
+	"github.com/elastic/apm-queue/codec/json"
+)
+
+func TestProducerWarm(t *testing.T) {
+	topics := []string{"logs", "traces"}
+	client, brokers := newClusterWithTopics(t, topics...)
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: brokers,
+		Sync:    true,
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "logs"
+		},
+	})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, producer.Warm(ctx, "logs", "traces"))
+	assert.Error(t, producer.Warm(ctx, "missing"))
+
+	batch := model.Batch{{Transaction: &model.Transaction{ID: "1"}}}
+	require.NoError(t, producer.ProcessBatch(ctx, &batch))
+	client.AddConsumeTopics("logs")
+	fetches := client.PollRecords(ctx, 1)
+	require.NoError(t, fetches.Err())
+	// The empty produce requests used to warm the connections write nothing.
+	assert.Len(t, fetches.Records(), 1)
+}
+
+func TestProducerWarmClosed(t *testing.T) {
+	producer, err := NewProducer(ProducerConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Logger:  zap.NewNop(),
+		Encoder: json.JSON{},
+		TopicRouter: func(event model.APMEvent) apmqueue.Topic {
+			return "topic"
+		},
+	})
+	require.NoError(t, err)
+	assert.NoError(t, producer.Warm(context.Background()))
+	require.NoError(t, producer.Close())
+	assert.ErrorIs(t, producer.Warm(context.Background(), "topic"), ErrProducerClosed)
+}
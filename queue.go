@@ -21,6 +21,7 @@ package apmqueue
 
 import (
 	"context"
+	"sync"
 
 	"github.com/elastic/apm-data/model"
 )
@@ -60,5 +61,33 @@ type Producer interface {
 // Topic represents a destination topic where to produce a message/record.
 type Topic string
 
+// TopicSet is a set of topics. It can be used to validate the topics returned
+// by a TopicRouter, catching routing bugs early. The zero value is ready to
+// use, and it is safe for concurrent use.
+type TopicSet struct {
+	mu     sync.RWMutex
+	topics map[Topic]struct{}
+}
+
+// Register adds the topics to the set.
+func (s *TopicSet) Register(topics ...Topic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.topics == nil {
+		s.topics = make(map[Topic]struct{}, len(topics))
+	}
+	for _, topic := range topics {
+		s.topics[topic] = struct{}{}
+	}
+}
+
+// Contains returns true if topic has been registered in the set.
+func (s *TopicSet) Contains(topic Topic) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.topics[topic]
+	return ok
+}
+
 // TopicRouter is used to determine the destination topic for an model.APMEvent.
 type TopicRouter func(event model.APMEvent) Topic
@@ -19,17 +19,43 @@
 // accessing a stored metadata.
 package queuecontext
 
-import "context"
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
 
 type metadataKey struct{}
 
+// namedMetadataKey is the context key of the metadata stored with a name.
+type namedMetadataKey struct{ name string }
+
 // WithMetadata enriches a context with metadata.
 func WithMetadata(ctx context.Context, metadata map[string]string) context.Context {
 	return context.WithValue(ctx, metadataKey{}, metadata)
 }
 
+// WithMetadataFromHeaders enriches a context with metadata holding the record
+// headers, for example, to produce a record again keeping the metadata it was
+// originally produced with. Since metadata values are strings, the headers
+// whose value isn't valid UTF-8, such as binary encoded headers, are skipped.
+// When multiple headers have the same key, the last one is kept.
+func WithMetadataFromHeaders(ctx context.Context, headers []kgo.RecordHeader) context.Context {
+	metadata := make(map[string]string, len(headers))
+	for _, h := range headers {
+		if !utf8.Valid(h.Value) {
+			continue
+		}
+		metadata[h.Key] = string(h.Value)
+	}
+	return WithMetadata(ctx, metadata)
+}
+
 // MetadataFromContext returns the metadata from the passed context and a bool
-// indicating whether the value is present or not.
+// indicating whether the value is present or not. The returned map is the one
+// stored in the context, not a copy, and must not be modified concurrently
+// with any reads.
 func MetadataFromContext(ctx context.Context) (map[string]string, bool) {
 	if v := ctx.Value(metadataKey{}); v != nil {
 		metadata, ok := v.(map[string]string)
@@ -37,3 +63,52 @@ func MetadataFromContext(ctx context.Context) (map[string]string, bool) {
 	}
 	return nil, false
 }
+
+// WithNamedMetadata enriches a context with metadata stored under name, so
+// multiple independent metadata maps can be stored in the same context, for
+// example, "headers" and "baggage". Each name is stored under its own key,
+// and doesn't interfere with the other names, nor with the metadata stored by
+// WithMetadata, which is the only metadata the producers add as headers.
+func WithNamedMetadata(ctx context.Context, name string, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, namedMetadataKey{name: name}, metadata)
+}
+
+// NamedMetadataFromContext returns the metadata stored under name by
+// WithNamedMetadata, and a bool indicating whether the value is present or
+// not. Like MetadataFromContext, the returned map isn't a copy.
+func NamedMetadataFromContext(ctx context.Context, name string) (map[string]string, bool) {
+	if v := ctx.Value(namedMetadataKey{name: name}); v != nil {
+		metadata, ok := v.(map[string]string)
+		return metadata, ok
+	}
+	return nil, false
+}
+
+// MetadataSize returns the number of bytes the metadata stored in ctx adds to
+// the produced records as headers, that is, the sum of the lengths of all its
+// keys and values. It returns 0 if ctx has no metadata.
+func MetadataSize(ctx context.Context) int {
+	metadata, _ := MetadataFromContext(ctx)
+	var size int
+	for k, v := range metadata {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// DetachedContext returns a new background context carrying a copy of the
+// metadata stored in ctx, if any, for use in goroutines which outlive ctx,
+// such as fire-and-forget producers. It intentionally drops the deadline,
+// cancellation and any other values of ctx, so the returned context is never
+// done.
+func DetachedContext(ctx context.Context) context.Context {
+	metadata, ok := MetadataFromContext(ctx)
+	if !ok {
+		return context.Background()
+	}
+	detached := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		detached[k] = v
+	}
+	return WithMetadata(context.Background(), detached)
+}
@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package queuecontext
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestDetachedContext(t *testing.T) {
+	metadata := map[string]string{"a": "b"}
+	ctx, cancel := context.WithCancel(WithMetadata(context.Background(), metadata))
+	detached := DetachedContext(ctx)
+	cancel()
+
+	assert.Error(t, ctx.Err())
+	assert.NoError(t, detached.Err())
+	_, hasDeadline := detached.Deadline()
+	assert.False(t, hasDeadline)
+
+	got, ok := MetadataFromContext(detached)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "b"}, got)
+	// The metadata is copied, so the parent's map can be modified.
+	metadata["a"] = "c"
+	assert.Equal(t, "b", got["a"])
+
+	_, ok = MetadataFromContext(DetachedContext(context.Background()))
+	assert.False(t, ok)
+}
+
+func TestWithMetadataFromHeaders(t *testing.T) {
+	ctx := WithMetadataFromHeaders(context.Background(), []kgo.RecordHeader{
+		{Key: "a", Value: []byte("b")},
+		{Key: "binary", Value: []byte{0xff, 0xfe, 0xfd}},
+		{Key: "empty"},
+		{Key: "c", Value: []byte("d")},
+		{Key: "c", Value: []byte("e")},
+	})
+	metadata, ok := MetadataFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "b", "empty": "", "c": "e"}, metadata)
+}
+
+func TestNamedMetadata(t *testing.T) {
+	ctx := WithMetadata(context.Background(), map[string]string{"a": "unnamed"})
+	ctx = WithNamedMetadata(ctx, "headers", map[string]string{"a": "headers"})
+	ctx = WithNamedMetadata(ctx, "baggage", map[string]string{"a": "baggage"})
+
+	headers, ok := NamedMetadataFromContext(ctx, "headers")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "headers"}, headers)
+	baggage, ok := NamedMetadataFromContext(ctx, "baggage")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "baggage"}, baggage)
+	// The named metadata doesn't interfere with the unnamed metadata.
+	unnamed, ok := MetadataFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "unnamed"}, unnamed)
+
+	_, ok = NamedMetadataFromContext(ctx, "other")
+	assert.False(t, ok)
+	_, ok = NamedMetadataFromContext(context.Background(), "headers")
+	assert.False(t, ok)
+}
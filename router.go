@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/apm-data/model"
+)
+
+// CachingTopicRouter returns a TopicRouter which routes the events by their
+// service name, using lookup to resolve the topic of each service, for
+// example, from an external configuration service.
+//
+// The topic returned by lookup for a service is cached for ttl, so lookup is
+// called at most once per service every ttl, except when concurrent events of
+// a service miss the cache at the same time. If lookup returns an error, the
+// events are routed to defaultTopic, and the error isn't cached, so the next
+// event of the service calls lookup again. The router is safe for concurrent
+// use.
+func CachingTopicRouter(
+	lookup func(serviceName string) (Topic, error),
+	ttl time.Duration,
+	defaultTopic Topic,
+) TopicRouter {
+	return newTopicCache(lookup, ttl, defaultTopic, time.Now).route
+}
+
+type topicCacheEntry struct {
+	topic     Topic
+	expiresAt time.Time
+}
+
+type topicCache struct {
+	lookup       func(serviceName string) (Topic, error)
+	ttl          time.Duration
+	defaultTopic Topic
+	clock        func() time.Time
+
+	mu      sync.RWMutex
+	entries map[string]topicCacheEntry
+}
+
+func newTopicCache(
+	lookup func(serviceName string) (Topic, error),
+	ttl time.Duration,
+	defaultTopic Topic,
+	clock func() time.Time,
+) *topicCache {
+	return &topicCache{
+		lookup:       lookup,
+		ttl:          ttl,
+		defaultTopic: defaultTopic,
+		clock:        clock,
+		entries:      make(map[string]topicCacheEntry),
+	}
+}
+
+func (c *topicCache) route(event model.APMEvent) Topic {
+	name := event.Service.Name
+	now := c.clock()
+	c.mu.RLock()
+	entry, ok := c.entries[name]
+	c.mu.RUnlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.topic
+	}
+	topic, err := c.lookup(name)
+	if err != nil {
+		return c.defaultTopic
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = topicCacheEntry{topic: topic, expiresAt: now.Add(c.ttl)}
+	return topic
+}
@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmqueue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-data/model"
+)
+
+func TestCachingTopicRouter(t *testing.T) {
+	lookups := make(map[string]int)
+	var failing bool
+	now := time.Now()
+	router := newTopicCache(func(serviceName string) (Topic, error) {
+		lookups[serviceName]++
+		if failing {
+			return "", errors.New("config service unavailable")
+		}
+		return Topic(serviceName + "-topic"), nil
+	}, time.Minute, "default", func() time.Time { return now }).route
+
+	event := func(serviceName string) model.APMEvent {
+		return model.APMEvent{Service: model.Service{Name: serviceName}}
+	}
+	// Misses call lookup, hits are served from the cache.
+	assert.Equal(t, Topic("a-topic"), router(event("a")))
+	assert.Equal(t, Topic("a-topic"), router(event("a")))
+	assert.Equal(t, Topic("b-topic"), router(event("b")))
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, lookups)
+
+	// Cached topics are used until they expire, even if lookup fails.
+	failing = true
+	now = now.Add(time.Minute - time.Nanosecond)
+	assert.Equal(t, Topic("a-topic"), router(event("a")))
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, lookups)
+
+	// Errors fall back to the default topic, and aren't cached.
+	now = now.Add(time.Nanosecond)
+	assert.Equal(t, Topic("default"), router(event("a")))
+	assert.Equal(t, Topic("default"), router(event("a")))
+	assert.Equal(t, map[string]int{"a": 3, "b": 1}, lookups)
+
+	failing = false
+	assert.Equal(t, Topic("a-topic"), router(event("a")))
+	assert.Equal(t, Topic("a-topic"), router(event("a")))
+	assert.Equal(t, map[string]int{"a": 4, "b": 1}, lookups)
+}